@@ -15,32 +15,32 @@ package main
 
 import proto "github.com/golang/protobuf/proto"
 import math "math"
+import pbs "github.com/whyrusleeping/go-pbs"
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 var _ = math.Inf
 
 type ChatProtocol struct {
-	Messages         chan *ChatProtocol_Message `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
-	Online           chan string                `protobuf:"bytes,2,rep,name=online" json:"online,omitempty"`
-	XXX_unrecognized []byte                     `json:"-"`
+	Messages         *pbs.Field[*ChatProtocol_Message] `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+	Online           *pbs.Field[string]                `protobuf:"bytes,2,rep,name=online" json:"online,omitempty"`
+	XXX_unrecognized []byte                            `json:"-"`
 
-	errors  chan error
-	closeCh chan struct{}
+	*pbs.Stream
 }
 
 func (m *ChatProtocol) Reset()         { *m = ChatProtocol{} }
 func (m *ChatProtocol) String() string { return proto.CompactTextString(m) }
 func (*ChatProtocol) ProtoMessage()    {}
 
-func (m *ChatProtocol) GetMessages() chan *ChatProtocol_Message {
+func (m *ChatProtocol) GetMessages() *pbs.Field[*ChatProtocol_Message] {
 	if m != nil {
 		return m.Messages
 	}
 	return nil
 }
 
-func (m *ChatProtocol) GetOnline() chan string {
+func (m *ChatProtocol) GetOnline() *pbs.Field[string] {
 	if m != nil {
 		return m.Online
 	}
@@ -48,21 +48,52 @@ func (m *ChatProtocol) GetOnline() chan string {
 }
 
 func (m *ChatProtocol) Close() error {
-	close(m.Messages)
-	close(m.Online)
-	close(m.errors)
-	close(m.closeCh)
-	return nil
+	err := m.Stream.Close()
+	m.Messages.Close()
+	m.Online.Close()
+	return err
 }
 
-func (m *ChatProtocol) Errors() chan error {
-	return m.errors
+// ChatProtocolProducer is the producer view of a ChatProtocol stream
+type ChatProtocolProducer struct {
+	Messages pbs.Sender[*ChatProtocol_Message]
+	Online   pbs.Sender[string]
+	m        *ChatProtocol
 }
 
-func (m *ChatProtocol) Closed() <-chan struct{} {
-	return m.closeCh
+func (m *ChatProtocol) Producer() *ChatProtocolProducer {
+	return &ChatProtocolProducer{
+		Messages: m.Messages,
+		Online:   m.Online,
+		m:        m,
+	}
+}
+
+func (v *ChatProtocolProducer) Close() error              { return v.m.Close() }
+func (v *ChatProtocolProducer) Err() error                { return v.m.Err() }
+func (v *ChatProtocolProducer) Closed() <-chan struct{}   { return v.m.Closed() }
+func (v *ChatProtocolProducer) Source() pbs.StreamMessage { return v.m }
+
+// ChatProtocolConsumer is the consumer view of a ChatProtocol stream
+type ChatProtocolConsumer struct {
+	Messages pbs.Receiver[*ChatProtocol_Message]
+	Online   pbs.Receiver[string]
+	m        *ChatProtocol
 }
 
+func (m *ChatProtocol) Consumer() *ChatProtocolConsumer {
+	return &ChatProtocolConsumer{
+		Messages: m.Messages,
+		Online:   m.Online,
+		m:        m,
+	}
+}
+
+func (v *ChatProtocolConsumer) Close() error            { return v.m.Close() }
+func (v *ChatProtocolConsumer) Err() error              { return v.m.Err() }
+func (v *ChatProtocolConsumer) Closed() <-chan struct{} { return v.m.Closed() }
+func (v *ChatProtocolConsumer) Sink() pbs.StreamMessage { return v.m }
+
 type ChatProtocol_Message struct {
 	From             *string `protobuf:"bytes,1,req,name=from" json:"from,omitempty"`
 	Text             *string `protobuf:"bytes,2,req,name=text" json:"text,omitempty"`
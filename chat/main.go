@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	pbs "github.com/whyrusleeping/go-pbs"
 	"io"
@@ -12,52 +13,51 @@ var chatters = []string{"jbenet", "whyrusleeping", "mafintosh", "tperson", "odg"
 var messages = []string{"Hey guys", "ipfs is cool", "protobufs are 1337", "i like cats"}
 
 func NewChatProtocol() *ChatProtocol {
-	cproto := new(ChatProtocol)
-	cproto.Messages = make(chan *ChatProtocol_Message)
-	cproto.Online = make(chan string)
-	cproto.closeCh = make(chan struct{})
-	cproto.errors = make(chan error)
-	return cproto
+	return &ChatProtocol{
+		Messages: pbs.NewField[*ChatProtocol_Message](),
+		Online:   pbs.NewField[string](),
+		Stream:   pbs.NewStream(),
+	}
 }
 
 func ChatConsumer(r io.Reader) {
-	cproto := NewChatProtocol()
+	cproto := NewChatProtocol().Consumer()
 
-	err := pbs.StreamDecode(r, cproto)
+	err := pbs.Decode(r, cproto)
 	if err != nil {
 		panic(err)
 	}
 
 	for {
 		select {
-		case mes, ok := <-cproto.Messages:
+		case mes, ok := <-cproto.Messages.C():
 			if !ok {
 				return
 			}
 			fmt.Printf("%s:  %s\n", mes.GetFrom(), mes.GetText())
-		case join, ok := <-cproto.Online:
+		case join, ok := <-cproto.Online.C():
 			if !ok {
 				return
 			}
 			fmt.Printf("--> %s joined chat\n", join)
-		case err, ok := <-cproto.Errors():
-			if !ok {
-				return
+		case <-cproto.Closed():
+			if err := cproto.Err(); err != nil {
+				fmt.Println("ERROR: ", err)
 			}
-
-			fmt.Println("ERROR: ", err)
+			return
 		}
 	}
 }
 
 func ChatProducer(w io.WriteCloser) {
-	cproto := NewChatProtocol()
+	cproto := NewChatProtocol().Producer()
 
-	err := pbs.StreamEncode(w, cproto)
+	err := pbs.Encode(w, cproto)
 	if err != nil {
 		panic(err)
 	}
 
+	ctx := context.Background()
 	for {
 		select {
 		case <-time.After(time.Second * time.Duration(rand.Intn(6)+1)):
@@ -66,13 +66,20 @@ func ChatProducer(w io.WriteCloser) {
 			mes := new(ChatProtocol_Message)
 			mes.From = &who
 			mes.Text = &what
-			cproto.Messages <- mes
+			if err := cproto.Messages.Send(ctx, mes); err != nil {
+				return
+			}
 
 		case <-time.After(time.Second * time.Duration(rand.Intn(6)+4)):
 			who := chatters[rand.Intn(len(chatters))]
-			cproto.Online <- who
-		case err := <-cproto.Errors():
-			fmt.Println("PRODUCER ERROR: ", err)
+			if err := cproto.Online.Send(ctx, who); err != nil {
+				return
+			}
+		case <-cproto.Closed():
+			if err := cproto.Err(); err != nil {
+				fmt.Println("PRODUCER ERROR: ", err)
+			}
+			return
 		}
 	}
 }
@@ -0,0 +1,103 @@
+package pbs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionPolicy decides what the decoder does with a value whose
+// checksum does not match
+type CorruptionPolicy int
+
+const (
+	// CorruptAbort fails the stream with a *CorruptionError. This is the
+	// default.
+	CorruptAbort CorruptionPolicy = iota
+
+	// CorruptSkip drops the value and carries on with the next one. This
+	// only helps when the corruption did not hit the tag or the length of
+	// the value, or the rest of the stream is garbage anyway. A length
+	// over the decoder's size limit fails the stream with a
+	// *CorruptionError whatever the policy, as the next value cannot be
+	// found.
+	CorruptSkip
+)
+
+// CorruptionError is the error a stream fails with when the checksum of a
+// value does not match its contents
+type CorruptionError struct {
+	// Field is the field number read from the corrupt value's tag
+	Field int
+
+	// Offset is where the value starts in the stream, after any
+	// decompression
+	Offset int64
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("pbs: checksum mismatch in field %d at offset %d", e.Field, e.Offset)
+}
+
+// appendChecksum appends the CRC32C of an encoded value to it
+func appendChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+}
+
+// checksumReader computes the checksum of each value read through it
+type checksumReader struct {
+	r *bufio.Reader
+
+	crc    uint32
+	offset int64
+
+	// begin is the offset of the value being read
+	begin int64
+}
+
+// start begins a new value
+func (cr *checksumReader) start() {
+	cr.crc = 0
+	cr.begin = cr.offset
+}
+
+func (cr *checksumReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	cr.crc = crc32.Update(cr.crc, castagnoli, []byte{b})
+	cr.offset++
+	return b, nil
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = crc32.Update(cr.crc, castagnoli, p[:n])
+	cr.offset += int64(n)
+	return n, err
+}
+
+// verify reads the checksum following the value of field, and checks it
+// against the value
+func (cr *checksumReader) verify(field int) error {
+	var sum [4]byte
+	_, err := io.ReadFull(cr.r, sum[:])
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	cr.offset += 4
+
+	if binary.LittleEndian.Uint32(sum[:]) != cr.crc {
+		return &CorruptionError{Field: field, Offset: cr.begin}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+// checksummedStream encodes a scalar and three strings with checksums
+func checksummedStream(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	tm := NewTestMessage()
+	tm.B = proto.String("pbs")
+	err := StreamEncode(buf, tm, Checksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"cat", "dog", "emu"} {
+		if err := tm.Repstring.Send(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm.Close()
+	<-tm.Closed()
+	return buf.Bytes()
+}
+
+func decodeChecksummed(t *testing.T, data []byte, policy CorruptionPolicy, opts ...DecodeOption) (*TestMessage, []string) {
+	out := NewTestMessage()
+	err := StreamDecode(bytes.NewReader(data), out, append(opts, VerifyChecksums(policy))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	<-out.Closed()
+	return out, strs
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	out, strs := decodeChecksummed(t, checksummedStream(t), CorruptAbort)
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.B == nil || *out.B != "pbs" {
+		t.Fatal("got wrong scalar: ", out.B)
+	}
+	if len(strs) != 3 || strs[2] != "emu" {
+		t.Fatal("got wrong values: ", strs)
+	}
+}
+
+func TestChecksumCorruption(t *testing.T) {
+	data := checksummedStream(t)
+
+	// every value takes 9 bytes, corrupt the contents of the second string
+	data[18+3] ^= 0xff
+
+	out, strs := decodeChecksummed(t, data, CorruptAbort)
+	cerr, ok := out.Err().(*CorruptionError)
+	if !ok {
+		t.Fatal("expected a CorruptionError, got: ", out.Err())
+	}
+	if cerr.Field != 9 || cerr.Offset != 18 {
+		t.Fatalf("got wrong field or offset: %d at %d", cerr.Field, cerr.Offset)
+	}
+	if len(strs) != 1 || strs[0] != "cat" {
+		t.Fatal("expected only the value before the corruption, got: ", strs)
+	}
+
+	out, strs = decodeChecksummed(t, data, CorruptSkip)
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 2 || strs[0] != "cat" || strs[1] != "emu" {
+		t.Fatal("expected the corrupt value to be skipped, got: ", strs)
+	}
+}
+
+func TestChecksumCorruptLength(t *testing.T) {
+	data := checksummedStream(t)
+
+	// a flipped bit makes the length of the second string run into its
+	// contents, far past the size limit
+	data[18+1] ^= 0x80
+
+	for _, policy := range []CorruptionPolicy{CorruptAbort, CorruptSkip} {
+		out, strs := decodeChecksummed(t, data, policy, MaxValueSize(1024))
+		cerr, ok := out.Err().(*CorruptionError)
+		if !ok {
+			t.Fatal("expected a CorruptionError, got: ", out.Err())
+		}
+		if cerr.Field != 9 || cerr.Offset != 18 {
+			t.Fatalf("got wrong field or offset: %d at %d", cerr.Field, cerr.Offset)
+		}
+		if len(strs) != 1 || strs[0] != "cat" {
+			t.Fatal("expected only the value before the corruption, got: ", strs)
+		}
+	}
+}
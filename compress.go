@@ -0,0 +1,182 @@
+package pbs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses a stream. A compressed stream starts with a header byte
+// holding the codec's ID, which the decoder uses to pick the codec. IDs
+// range from 1 to 7, so they can not be mistaken for the tag of a field.
+type Codec interface {
+	// ID returns the header byte identifying the codec
+	ID() byte
+
+	// NewWriter returns a writer compressing to w. Flush must make
+	// everything written so far decodable by the reader.
+	NewWriter(w io.Writer) (FlushWriteCloser, error)
+
+	// NewReader returns a reader decompressing from r
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// FlushWriteCloser is a writer that can flush what has been written so far
+// to the underlying writer
+type FlushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// IDs of the built in codecs
+const (
+	FlateID = 1
+	GzipID  = 2
+)
+
+var codecs = struct {
+	sync.RWMutex
+	m map[byte]Codec
+}{
+	m: map[byte]Codec{
+		FlateID: Flate(flate.DefaultCompression),
+		GzipID:  Gzip(gzip.DefaultCompression),
+	},
+}
+
+// RegisterCodec makes c available to decoders. It replaces any codec
+// registered with the same ID.
+func RegisterCodec(c Codec) error {
+	id := c.ID()
+	if id < 1 || id > 7 {
+		return fmt.Errorf("pbs: codec ID %d out of range", id)
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[id] = c
+	return nil
+}
+
+// UnknownCodecError is the error a stream fails with when its header names
+// a codec that has not been registered
+type UnknownCodecError struct {
+	ID byte
+}
+
+func (e *UnknownCodecError) Error() string {
+	return fmt.Sprintf("pbs: unknown codec %d", e.ID)
+}
+
+// RejectedCodecError is the error a stream fails with when its header names
+// a codec that the decoder does not accept (see AcceptCodecs)
+type RejectedCodecError struct {
+	ID byte
+}
+
+func (e *RejectedCodecError) Error() string {
+	return fmt.Sprintf("pbs: codec %d is not accepted", e.ID)
+}
+
+// Flate returns a codec compressing with compress/flate at the given level.
+// Since the stream is flushed after every value, small values only
+// compress well at flate.BestCompression; at lower levels the compressor
+// tends to store them as they are.
+func Flate(level int) Codec {
+	return flateCodec{level: level}
+}
+
+type flateCodec struct {
+	level int
+}
+
+func (c flateCodec) ID() byte {
+	return FlateID
+}
+
+func (c flateCodec) NewWriter(w io.Writer) (FlushWriteCloser, error) {
+	return flate.NewWriter(w, c.level)
+}
+
+func (c flateCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+// Gzip returns a codec compressing with compress/gzip at the given level.
+// The same advice about levels as for Flate applies.
+func Gzip(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (c gzipCodec) ID() byte {
+	return GzipID
+}
+
+func (c gzipCodec) NewWriter(w io.Writer) (FlushWriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (c gzipCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// compressWriter writes the header of a stream compressed with c to w, and
+// returns the writer the stream is written to
+func compressWriter(w io.Writer, c Codec) (FlushWriteCloser, error) {
+	_, err := w.Write([]byte{c.ID()})
+	if err != nil {
+		return nil, err
+	}
+	return c.NewWriter(w)
+}
+
+// registeredCodecs returns the IDs of the registered codecs, in order
+func registeredCodecs() []byte {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	var ids []byte
+	for id := byte(1); id <= 7; id++ {
+		if _, ok := codecs.m[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// decompressReader returns the reader a stream's values are read from. If
+// the stream starts with a codec header, it is consumed and the rest of the
+// stream is decompressed. If accept is not nil, only the codecs it holds
+// may be used.
+func decompressReader(r *bufio.Reader, accept []byte) (*bufio.Reader, error) {
+	b, err := r.Peek(1)
+	if err != nil || b[0] == 0 || b[0] > 7 {
+		// errors show up again when reading the first value
+		return r, nil
+	}
+	id, _ := r.ReadByte()
+	if accept != nil && bytes.IndexByte(accept, id) < 0 {
+		return nil, &RejectedCodecError{ID: id}
+	}
+
+	codecs.RLock()
+	c, ok := codecs.m[id]
+	codecs.RUnlock()
+	if !ok {
+		return nil, &UnknownCodecError{ID: id}
+	}
+
+	cr, err := c.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(cr), nil
+}
@@ -0,0 +1,169 @@
+package pbs_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func testCompressedStream(t *testing.T, c Codec) {
+	r, w := io.Pipe()
+
+	out := NewTestMessage()
+	err := StreamDecode(r, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	err = StreamEncode(w, tm, Compress(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every value is decodable as soon as it has been sent
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, s := range []string{"cat", "dog", "fish"} {
+		if err := tm.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := out.Repstring.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Fatalf("expected %q, got %q", s, got)
+		}
+	}
+
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressFlate(t *testing.T) {
+	testCompressedStream(t, Flate(flate.BestSpeed))
+}
+
+func TestCompressGzip(t *testing.T) {
+	testCompressedStream(t, Gzip(flate.DefaultCompression))
+}
+
+func TestCompressRatio(t *testing.T) {
+	encode := func(opts ...EncodeOption) int {
+		buf := new(bytes.Buffer)
+		tm := NewTestMessage()
+		err := StreamEncode(buf, tm, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			tm.Repstring.Send(context.Background(), strings.Repeat("meow ", 10))
+		}
+		tm.Close()
+		<-tm.Closed()
+		return buf.Len()
+	}
+
+	plain := encode()
+	compressed := encode(Compress(Flate(flate.BestCompression)))
+	if compressed*2 > plain {
+		t.Fatalf("expected compression, got %d bytes from %d", compressed, plain)
+	}
+}
+
+// nopCodec is a codec that does not compress anything
+type nopCodec struct{}
+
+type nopWriter struct {
+	io.Writer
+}
+
+func (nopWriter) Flush() error { return nil }
+func (nopWriter) Close() error { return nil }
+
+func (nopCodec) ID() byte { return 7 }
+
+func (nopCodec) NewWriter(w io.Writer) (FlushWriteCloser, error) {
+	return nopWriter{w}, nil
+}
+
+func (nopCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+func TestCustomCodec(t *testing.T) {
+	tm := NewTestMessage()
+	buf := new(bytes.Buffer)
+	err := StreamEncode(buf, tm, Compress(nopCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Repstring.Send(context.Background(), "cat")
+	tm.Close()
+	<-tm.Closed()
+
+	if err := RegisterCodec(nopCodec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := NewTestMessage()
+	StreamDecode(bytes.NewReader(buf.Bytes()), out)
+	s, err := out.Repstring.Recv(context.Background())
+	if err != nil || s != "cat" {
+		t.Fatal("failed to decode custom codec: ", s, err)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	out := NewTestMessage()
+	StreamDecode(bytes.NewReader([]byte{6, 0x4a, 3, 'c', 'a', 't'}), out)
+	<-out.Closed()
+
+	if cerr, ok := out.Err().(*UnknownCodecError); !ok || cerr.ID != 6 {
+		t.Fatal("expected an UnknownCodecError, got: ", out.Err())
+	}
+}
+
+func TestAcceptCodecs(t *testing.T) {
+	tm := NewTestMessage()
+	buf := new(bytes.Buffer)
+	err := StreamEncode(buf, tm, Compress(Gzip(flate.BestSpeed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Repstring.Send(context.Background(), "cat")
+	tm.Close()
+	<-tm.Closed()
+
+	out := NewTestMessage()
+	StreamDecode(bytes.NewReader(buf.Bytes()), out, AcceptCodecs(GzipID))
+	s, err := out.Repstring.Recv(context.Background())
+	if err != nil || s != "cat" {
+		t.Fatal("failed to decode an accepted codec: ", s, err)
+	}
+
+	out = NewTestMessage()
+	StreamDecode(bytes.NewReader(buf.Bytes()), out, AcceptCodecs(FlateID))
+	<-out.Closed()
+	if cerr, ok := out.Err().(*RejectedCodecError); !ok || cerr.ID != GzipID {
+		t.Fatal("expected a RejectedCodecError, got: ", out.Err())
+	}
+}
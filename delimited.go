@@ -0,0 +1,194 @@
+package pbs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// DefaultMaxMessageSize is the size limit of a DelimitedReader created
+// without one
+const DefaultMaxMessageSize = 4 << 20
+
+// ErrMessageTooLarge is returned when reading a delimited message larger
+// than the reader's size limit
+var ErrMessageTooLarge = errors.New("pbs: delimited message exceeds size limit")
+
+// DelimitedWriter writes a sequence of complete messages, each prefixed
+// with its length as a varint. This is the same framing as Java's
+// writeDelimitedTo, and as the values of a repeated submessage field
+// without their tags.
+type DelimitedWriter struct {
+	w   io.Writer
+	buf *proto.Buffer
+}
+
+// NewDelimitedWriter returns a DelimitedWriter writing to w
+func NewDelimitedWriter(w io.Writer) *DelimitedWriter {
+	return &DelimitedWriter{
+		w:   w,
+		buf: proto.NewBuffer(nil),
+	}
+}
+
+// WriteMsg writes m with a single write to the underlying writer
+func (dw *DelimitedWriter) WriteMsg(m proto.Message) error {
+	dw.buf.Reset()
+	err := dw.buf.EncodeMessage(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = dw.w.Write(dw.buf.Bytes())
+	return err
+}
+
+// DelimitedReader reads a sequence of messages written by a DelimitedWriter
+type DelimitedReader struct {
+	r       *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+// NewDelimitedReader returns a DelimitedReader reading from r, that refuses
+// messages larger than maxSize bytes. A maxSize of zero means
+// DefaultMaxMessageSize.
+func NewDelimitedReader(r io.Reader, maxSize int) *DelimitedReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &DelimitedReader{
+		r:       bufio.NewReader(r),
+		maxSize: maxSize,
+	}
+}
+
+// ReadMsg reads the next message into m, which is reset first so the same
+// instance can be reused for every message. It returns io.EOF when the
+// input ends between messages, and io.ErrUnexpectedEOF when it ends in the
+// middle of one.
+func (dr *DelimitedReader) ReadMsg(m proto.Message) error {
+	_, err := dr.r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	// the input may only end before the length, not partway through it
+	l, err := readVarint(dr.r)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if l < 0 || l > dr.maxSize {
+		return ErrMessageTooLarge
+	}
+
+	if cap(dr.buf) < l {
+		dr.buf = make([]byte, l)
+	}
+	dr.buf = dr.buf[:l]
+
+	_, err = io.ReadFull(dr.r, dr.buf)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	m.Reset()
+	return proto.Unmarshal(dr.buf, m)
+}
+
+// Messages returns an iterator over the remaining messages, each read into
+// m. Like a bufio.Scanner, it is used as
+//
+//	it := dr.Messages(m)
+//	for it.Next() {
+//		// use it.Msg()
+//	}
+//	if it.Err() != nil {
+//		// handle the error
+//	}
+func (dr *DelimitedReader) Messages(m proto.Message) *MessageIterator {
+	return &MessageIterator{dr: dr, msg: m}
+}
+
+// MessageIterator iterates over the messages of a DelimitedReader
+type MessageIterator struct {
+	dr  *DelimitedReader
+	msg proto.Message
+	err error
+}
+
+// Next reads the next message, returning false at the end of the input or
+// on an error
+func (it *MessageIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.err = it.dr.ReadMsg(it.msg)
+	return it.err == nil
+}
+
+// Msg returns the message read by the last call to Next. It is the same
+// instance every time, overwritten by each call to Next.
+func (it *MessageIterator) Msg() proto.Message {
+	return it.msg
+}
+
+// Err returns the error that stopped the iteration, or nil if the input
+// ended cleanly
+func (it *MessageIterator) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+// SendDelimited reads every message of dr into a new instance from newMsg,
+// and sends it on s, which is usually a submessage field of a producer. It
+// returns nil when the input ends.
+func SendDelimited[T proto.Message](ctx context.Context, dr *DelimitedReader, s Sender[T], newMsg func() T) error {
+	for {
+		m := newMsg()
+		err := dr.ReadMsg(m)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = s.Send(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RecvDelimited writes every message received from r, which is usually a
+// submessage field of a consumer, to dw. It returns nil once the field has
+// been closed and drained.
+func RecvDelimited[T proto.Message](ctx context.Context, dw *DelimitedWriter, r Receiver[T]) error {
+	for {
+		m, err := r.Recv(ctx)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = dw.WriteMsg(m)
+		if err != nil {
+			return err
+		}
+	}
+}
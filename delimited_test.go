@@ -0,0 +1,121 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func TestDelimitedRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	dw := NewDelimitedWriter(buf)
+	for _, s := range []string{"cat", "dog", "fish"} {
+		err := dw.WriteMsg(&tpb.TestMessage{B: proto.String(s), Repint: []int32{1, 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the framing is the same as the values of a repeated submessage field
+	whole, err := proto.Marshal(&tpb.TestMessage{B: proto.String("cat"), Repint: []int32{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes()[1:1+len(whole)], whole) || int(buf.Bytes()[0]) != len(whole) {
+		t.Fatal("message was not length prefixed")
+	}
+
+	m := new(tpb.TestMessage)
+	it := NewDelimitedReader(buf, 0).Messages(m)
+
+	var out []string
+	for it.Next() {
+		if it.Msg() != m {
+			t.Fatal("iterator did not reuse the message")
+		}
+		if len(m.Repint) != 2 {
+			t.Fatal("message was not reset between reads: ", m.Repint)
+		}
+		out = append(out, m.GetB())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 3 || out[0] != "cat" || out[2] != "fish" {
+		t.Fatal("got wrong messages: ", out)
+	}
+}
+
+func TestDelimitedLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := NewDelimitedWriter(buf).WriteMsg(&tpb.TestMessage{B: proto.String("pbs is fun")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	dr := NewDelimitedReader(bytes.NewReader(data), 4)
+	if err := dr.ReadMsg(new(tpb.TestMessage)); err != ErrMessageTooLarge {
+		t.Fatal("expected ErrMessageTooLarge, got: ", err)
+	}
+
+	dr = NewDelimitedReader(bytes.NewReader(data[:len(data)-1]), 0)
+	if err := dr.ReadMsg(new(tpb.TestMessage)); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got: ", err)
+	}
+
+	// cut off in the middle of the varint length
+	dr = NewDelimitedReader(bytes.NewReader([]byte{0x80, 0x80}), 0)
+	if err := dr.ReadMsg(new(tpb.TestMessage)); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got: ", err)
+	}
+
+	dr = NewDelimitedReader(bytes.NewReader(nil), 0)
+	if err := dr.ReadMsg(new(tpb.TestMessage)); err != io.EOF {
+		t.Fatal("expected io.EOF, got: ", err)
+	}
+}
+
+func TestDelimitedFields(t *testing.T) {
+	ctx := context.Background()
+
+	buf := new(bytes.Buffer)
+	dw := NewDelimitedWriter(buf)
+	for i := uint32(0); i < 3; i++ {
+		if err := dw.WriteMsg(&tpb.TestMessage_TestSubMessage{Y: []uint32{i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := NewField[*tpb.TestMessage_TestSubMessage]()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- SendDelimited(ctx, NewDelimitedReader(buf, 0), in, func() *tpb.TestMessage_TestSubMessage {
+			return new(tpb.TestMessage_TestSubMessage)
+		})
+		in.Close()
+	}()
+
+	out := new(bytes.Buffer)
+	if err := RecvDelimited(ctx, NewDelimitedWriter(out), in); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint32
+	it := NewDelimitedReader(out, 0).Messages(new(tpb.TestMessage_TestSubMessage))
+	for it.Next() {
+		got = append(got, it.Msg().(*tpb.TestMessage_TestSubMessage).GetY()...)
+	}
+	if it.Err() != nil || len(got) != 3 || got[2] != 2 {
+		t.Fatal("got wrong submessages: ", got, it.Err())
+	}
+}
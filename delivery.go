@@ -0,0 +1,213 @@
+package pbs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DeliveryPolicy decides what the decoder does with the values of a
+// repeated field when its consumer is not keeping up
+type DeliveryPolicy int
+
+const (
+	// DeliverBlock waits for the consumer, stalling every other field
+	// of the stream until it catches up. This is the default.
+	DeliverBlock DeliveryPolicy = iota
+
+	// DeliverDropOldest discards the oldest buffered value to make room
+	DeliverDropOldest
+
+	// DeliverDropNewest discards the value that does not fit
+	DeliverDropNewest
+
+	// DeliverFail fails the stream with a *SlowConsumerError
+	DeliverFail
+)
+
+var deliveryNames = map[DeliveryPolicy]string{
+	DeliverBlock:      "block",
+	DeliverDropOldest: "drop_oldest",
+	DeliverDropNewest: "drop_newest",
+	DeliverFail:       "fail",
+}
+
+func (p DeliveryPolicy) String() string {
+	name, ok := deliveryNames[p]
+	if !ok {
+		return fmt.Sprintf("DeliveryPolicy(%d)", int(p))
+	}
+	return name
+}
+
+// ParseDeliveryPolicy returns the policy with the given name, as used in
+// the pbs struct tag and proto-gen's (pbs.delivery) field option
+func ParseDeliveryPolicy(name string) (DeliveryPolicy, error) {
+	for p, n := range deliveryNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("pbs: unknown delivery policy %q", name)
+}
+
+// SlowConsumerError is the error a stream fails with when the consumer of
+// a field with the DeliverFail policy falls behind
+type SlowConsumerError struct {
+	Field int
+}
+
+func (e *SlowConsumerError) Error() string {
+	return fmt.Sprintf("pbs: consumer of field %d fell behind", e.Field)
+}
+
+// parseDeliveryTag parses the pbs struct tag of a repeated field, for
+// example `pbs:"delivery=drop_oldest,buffer=16"`
+func parseDeliveryTag(tag string, finfo *FieldInfo) error {
+	for _, opt := range strings.Split(tag, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("pbs: malformed option %q in pbs field tag", opt)
+		}
+
+		switch kv[0] {
+		case "delivery":
+			p, err := ParseDeliveryPolicy(kv[1])
+			if err != nil {
+				return err
+			}
+			finfo.Delivery = p
+		case "buffer":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return err
+			}
+			finfo.Buffer = n
+		default:
+			return fmt.Errorf("pbs: unknown option %q in pbs field tag", kv[0])
+		}
+	}
+	return nil
+}
+
+// deliveryQueue buffers the decoded values of a single repeated field, and
+// delivers them to the consumer from its own goroutine so that a slow
+// consumer only holds up its own field.
+type deliveryQueue struct {
+	field  byte
+	policy DeliveryPolicy
+	rf     repeatedField
+	st     *Stream
+	q      chan queuedValue
+
+	// consumed is called for every value that leaves the queue, whether
+	// it was delivered or dropped
+	consumed func(field byte, size int)
+
+	// ended is set when the producer ended the field, which is closed
+	// once the queue has been delivered
+	ended bool
+}
+
+// queuedValue is a decoded value waiting in a delivery queue, along with
+// the number of bytes it took on the wire
+type queuedValue struct {
+	v    reflect.Value
+	size int
+}
+
+// push queues v for delivery according to the queue's policy
+func (dq *deliveryQueue) push(ctx context.Context, v queuedValue) error {
+	switch dq.policy {
+	case DeliverDropOldest:
+		for {
+			select {
+			case dq.q <- v:
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-dq.q:
+				dq.dropped(old)
+			default:
+			}
+		}
+	case DeliverDropNewest:
+		select {
+		case dq.q <- v:
+		default:
+			dq.dropped(v)
+		}
+		return nil
+	case DeliverFail:
+		select {
+		case dq.q <- v:
+			return nil
+		default:
+			return &SlowConsumerError{Field: int(dq.field)}
+		}
+	default:
+		select {
+		case dq.q <- v:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (dq *deliveryQueue) dropped(v queuedValue) {
+	if dq.st != nil {
+		dq.st.drop(dq.field)
+	}
+	dq.done(v)
+}
+
+func (dq *deliveryQueue) done(v queuedValue) {
+	if dq.consumed != nil {
+		dq.consumed(dq.field, v.size)
+	}
+}
+
+// run delivers queued values to the consumer until the queue is closed.
+// Once a delivery fails, the rest of the queue is discarded.
+func (dq *deliveryQueue) run(ctx context.Context) {
+	var failed bool
+	for v := range dq.q {
+		if failed {
+			continue
+		}
+		if dq.rf.sendValue(ctx, v.v) != nil {
+			failed = true
+			continue
+		}
+		dq.done(v)
+	}
+
+	if dq.ended {
+		dq.rf.closeField()
+	}
+}
+
+// drop counts a value of field that was discarded because its consumer
+// fell behind
+func (s *Stream) drop(field byte) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.dropped == nil {
+		s.dropped = make(map[byte]uint64)
+	}
+	s.dropped[field]++
+}
+
+// Dropped returns how many decoded values of the given repeated field have
+// been discarded by its delivery policy
+func (s *Stream) Dropped(field int) uint64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.dropped[byte(field)]
+}
@@ -0,0 +1,153 @@
+package pbs_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+// slowStream returns an encoded stream of n repstring values, followed by
+// a single repint value
+func slowStream(n int) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	for i := 0; i < n; i++ {
+		buf.Write([]byte{0x4a, 2, 's', byte('0' + i)})
+	}
+	buf.Write([]byte{0x10, 42})
+	return buf
+}
+
+// decodeSlow decodes a slow stream, only reading the strings once the
+// decoder has moved past them
+func decodeSlow(t *testing.T, n int, opts ...DecodeOption) (*TestMessage, []string) {
+	tm := NewTestMessage()
+	err := StreamDecode(slowStream(n), tm, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case i := <-tm.Repint.C():
+		if i != 42 {
+			t.Fatal("expected 42, got: ", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer of repstring held up repint")
+	}
+
+	var out []string
+	for s := range tm.Repstring.C() {
+		out = append(out, s)
+	}
+	return tm, out
+}
+
+func TestDeliverDropNewest(t *testing.T) {
+	tm, out := decodeSlow(t, 6, FieldDelivery(9, DeliverDropNewest, 2))
+
+	if len(out) < 2 || len(out) > 3 {
+		t.Fatal("expected the buffered values to be delivered, got: ", out)
+	}
+	for i, s := range out {
+		if s != string([]byte{'s', byte('0' + i)}) {
+			t.Fatal("expected the oldest values to be kept, got: ", out)
+		}
+	}
+
+	if tm.Dropped(9) != uint64(6-len(out)) {
+		t.Fatalf("expected %d dropped values, got %d", 6-len(out), tm.Dropped(9))
+	}
+}
+
+func TestDeliverDropOldest(t *testing.T) {
+	tm, out := decodeSlow(t, 6, FieldDelivery(9, DeliverDropOldest, 2))
+
+	if len(out) < 2 || out[len(out)-1] != "s5" || out[len(out)-2] != "s4" {
+		t.Fatal("expected the newest values to be kept, got: ", out)
+	}
+
+	if tm.Dropped(9) != uint64(6-len(out)) {
+		t.Fatalf("expected %d dropped values, got %d", 6-len(out), tm.Dropped(9))
+	}
+}
+
+func TestDeliverUnbuffered(t *testing.T) {
+	// a queue of at least one value is kept, so the decoder neither stalls
+	// nor drops a value while the consumer is idle
+	tm, out := decodeSlow(t, 6, FieldDelivery(9, DeliverDropOldest, 0))
+	if len(out) < 1 || out[len(out)-1] != "s5" {
+		t.Fatal("expected the newest value to be kept, got: ", out)
+	}
+	if tm.Dropped(9) != uint64(6-len(out)) {
+		t.Fatalf("expected %d dropped values, got %d", 6-len(out), tm.Dropped(9))
+	}
+
+	tm, out = decodeSlow(t, 6, FieldDelivery(9, DeliverDropNewest, 0))
+	if len(out) < 1 || out[0] != "s0" {
+		t.Fatal("expected the oldest value to be kept, got: ", out)
+	}
+	if tm.Dropped(9) != uint64(6-len(out)) {
+		t.Fatalf("expected %d dropped values, got %d", 6-len(out), tm.Dropped(9))
+	}
+}
+
+func TestDeliverBuffered(t *testing.T) {
+	tm, out := decodeSlow(t, 6, FieldDelivery(9, DeliverBlock, 8))
+
+	if len(out) != 6 {
+		t.Fatal("expected every value to be delivered, got: ", out)
+	}
+	if tm.Dropped(9) != 0 {
+		t.Fatal("expected no dropped values, got: ", tm.Dropped(9))
+	}
+}
+
+func TestDeliverFail(t *testing.T) {
+	tm := NewTestMessage()
+	err := StreamDecode(slowStream(6), tm, FieldDelivery(9, DeliverFail, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-tm.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("stream was never closed")
+	}
+
+	serr, ok := tm.Err().(*SlowConsumerError)
+	if !ok {
+		t.Fatal("expected a SlowConsumerError, got: ", tm.Err())
+	}
+	if serr.Field != 9 {
+		t.Fatal("expected error for field 9, got: ", serr.Field)
+	}
+}
+
+type taggedMessage struct {
+	Names chan string `protobuf:"bytes,1,rep,name=names" pbs:"delivery=drop_newest,buffer=1"`
+	*Stream
+}
+
+func (m *taggedMessage) ProtoMessage()  {}
+func (m *taggedMessage) String() string { return "taggedMessage" }
+func (m *taggedMessage) Reset()         {}
+
+func TestDeliveryTag(t *testing.T) {
+	props, err := GetProperties(new(taggedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finfo := props.FieldMapping[1]
+	if finfo.Delivery != DeliverDropNewest || finfo.Buffer != 1 {
+		t.Fatal("pbs tag was not parsed: ", finfo)
+	}
+
+	p, err := ParseDeliveryPolicy("drop_oldest")
+	if err != nil || p != DeliverDropOldest {
+		t.Fatal("failed to parse delivery policy: ", err)
+	}
+}
@@ -0,0 +1,292 @@
+package pbs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// DefaultRekeyInterval is how many frames are sealed with a key before it
+// is replaced, unless configured otherwise
+const DefaultRekeyInterval = 1 << 20
+
+const (
+	saltSize = 16
+
+	// maxFrameSize bounds the allocation for a single encrypted frame
+	maxFrameSize = 1 << 24
+
+	// the first byte of a frame's plaintext says whether it ends the
+	// stream
+	sealedData = 0
+	sealedEnd  = 1
+)
+
+// ErrDecrypt is the error a stream fails with when a frame does not
+// authenticate, because it was tampered with, replayed or reordered, or
+// the wrong key was used
+var ErrDecrypt = errors.New("pbs: encrypted frame failed authentication")
+
+// AEADFunc returns the AEAD to seal or open frames with under the given
+// key, such as AESGCM or ChaCha20Poly1305
+type AEADFunc func(key []byte) (cipher.AEAD, error)
+
+// AESGCM returns AES-GCM with the given 16, 24 or 32 byte key
+func AESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ChaCha20Poly1305 returns ChaCha20-Poly1305 with the given 32 byte key
+func ChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// encryption is the configuration of an encrypted stream
+type encryption struct {
+	key   []byte
+	aead  AEADFunc
+	rekey uint64
+
+	// err is set when the key cannot be used with the AEAD, and is
+	// returned by StreamEncode or StreamDecode
+	err error
+}
+
+func newEncryption(key []byte, aead AEADFunc, rekey uint64) *encryption {
+	if rekey == 0 {
+		rekey = DefaultRekeyInterval
+	}
+	enc := &encryption{key: key, aead: aead, rekey: rekey}
+
+	// stream keys are derived with HMAC-SHA256, and are as long as the
+	// configured key
+	if len(key) > sha256.Size {
+		enc.err = fmt.Errorf("pbs: encryption key is %d bytes, at most %d are supported", len(key), sha256.Size)
+	} else if _, err := aead(key); err != nil {
+		enc.err = fmt.Errorf("pbs: invalid encryption key: %w", err)
+	}
+	return enc
+}
+
+// frameKeys produces the sequence of keys and nonces frames are sealed
+// with. Both ends of a stream step through the same sequence, so a frame
+// opens only at its own position in the stream.
+type frameKeys struct {
+	enc  *encryption
+	key  []byte
+	aead cipher.AEAD
+	seq  uint64
+}
+
+// newFrameKeys derives the first key of a stream from the configured key
+// and the stream's salt, so no two streams share keys even when they are
+// configured with the same one
+func newFrameKeys(enc *encryption, salt []byte) (*frameKeys, error) {
+	fk := &frameKeys{enc: enc}
+	err := fk.setKey(deriveKey(enc.key, "pbs stream", salt))
+	if err != nil {
+		return nil, err
+	}
+	return fk, nil
+}
+
+func deriveKey(key []byte, label string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	return mac.Sum(nil)[:len(key)]
+}
+
+func (fk *frameKeys) setKey(key []byte) error {
+	aead, err := fk.enc.aead(key)
+	if err != nil {
+		return err
+	}
+
+	fk.key = key
+	fk.aead = aead
+	fk.seq = 0
+	return nil
+}
+
+// next returns the AEAD and nonce for the next frame
+func (fk *frameKeys) next() (cipher.AEAD, []byte, error) {
+	if fk.seq == fk.enc.rekey {
+		err := fk.setKey(deriveKey(fk.key, "pbs rekey", nil))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	nonce := make([]byte, fk.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], fk.seq)
+	fk.seq++
+	return fk.aead, nonce, nil
+}
+
+// encryptWriter seals everything written to it between flushes into a
+// single frame
+type encryptWriter struct {
+	w    io.Writer
+	keys *frameKeys
+	buf  bytes.Buffer
+}
+
+func newEncryptWriter(w io.Writer, enc *encryption) (*encryptWriter, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := newFrameKeys(enc, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, keys: keys}, nil
+}
+
+func (ew *encryptWriter) Write(b []byte) (int, error) {
+	return ew.buf.Write(b)
+}
+
+// Flush seals what has been written since the last flush, in as many
+// frames as it takes to keep each of them within maxFrameSize
+func (ew *encryptWriter) Flush() error {
+	for ew.buf.Len() > 0 {
+		err := ew.seal(sealedData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close seals the rest of the stream, followed by the frame marking its
+// end, which tells the decoder the stream was not truncated
+func (ew *encryptWriter) Close() error {
+	err := ew.Flush()
+	if err != nil {
+		return err
+	}
+	return ew.seal(sealedEnd)
+}
+
+func (ew *encryptWriter) seal(kind byte) error {
+	aead, nonce, err := ew.keys.next()
+	if err != nil {
+		return err
+	}
+
+	// the frame holds as much of the buffer as fits
+	plain := append([]byte{kind}, ew.buf.Next(maxFrameSize-1-aead.Overhead())...)
+
+	sealed := aead.Seal(nil, nonce, plain, nil)
+	frame := append(proto.EncodeVarint(uint64(len(sealed))), sealed...)
+	_, err = ew.w.Write(frame)
+	return err
+}
+
+// decryptReader opens the frames written by an encryptWriter
+type decryptReader struct {
+	r    *bufio.Reader
+	enc  *encryption
+	keys *frameKeys
+
+	// plain is what is left of the last frame opened
+	plain []byte
+	ended bool
+}
+
+func (dr *decryptReader) Read(b []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.ended {
+			return 0, io.EOF
+		}
+
+		err := dr.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) open() error {
+	if dr.keys == nil {
+		salt := make([]byte, saltSize)
+		_, err := io.ReadFull(dr.r, salt)
+		if err != nil {
+			return err
+		}
+
+		dr.keys, err = newFrameKeys(dr.enc, salt)
+		if err != nil {
+			return err
+		}
+	}
+
+	l, err := readVarint(dr.r)
+	if err != nil {
+		if err == io.EOF {
+			// the stream ended without its end frame
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if l < 0 || l > maxFrameSize {
+		return ErrDecrypt
+	}
+
+	sealed := make([]byte, l)
+	_, err = io.ReadFull(dr.r, sealed)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	aead, nonce, err := dr.keys.next()
+	if err != nil {
+		return err
+	}
+
+	plain, err := aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil || len(plain) == 0 {
+		return ErrDecrypt
+	}
+
+	dr.ended = plain[0] == sealedEnd
+	dr.plain = plain[1:]
+	return nil
+}
+
+// newDecryptReader returns the reader the plaintext of an encrypted stream
+// is read from
+func newDecryptReader(r *bufio.Reader, enc *encryption) *bufio.Reader {
+	return bufio.NewReader(&decryptReader{r: r, enc: enc})
+}
@@ -0,0 +1,209 @@
+package pbs_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testEncryptedStream(t *testing.T, aead AEADFunc, opts ...EncodeOption) {
+	r, w := io.Pipe()
+
+	out := NewTestMessage()
+	err := StreamDecode(r, out, Decrypt(testKey, aead, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	err = StreamEncode(w, tm, append(opts, Encrypt(testKey, aead, 2))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every value is decodable as soon as it has been sent, across rekeys
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, s := range []string{"cat", "dog", "fish", "emu", "yak"} {
+		if err := tm.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := out.Repstring.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Fatalf("expected %q, got %q", s, got)
+		}
+	}
+
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptAESGCM(t *testing.T) {
+	testEncryptedStream(t, AESGCM)
+}
+
+func TestEncryptChaCha20Poly1305(t *testing.T) {
+	testEncryptedStream(t, ChaCha20Poly1305)
+}
+
+func TestEncryptCompressed(t *testing.T) {
+	testEncryptedStream(t, AESGCM, Compress(Flate(flate.BestCompression)))
+}
+
+// encryptedFrames encodes three strings, and splits the encrypted stream
+// into its salt and frames
+func encryptedFrames(t *testing.T) ([]byte, [][]byte) {
+	buf := new(bytes.Buffer)
+	tm := NewTestMessage()
+	err := StreamEncode(buf, tm, Encrypt(testKey, AESGCM, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"cat", "dog", "emu"} {
+		tm.Repstring.Send(context.Background(), s)
+	}
+	tm.Close()
+	<-tm.Closed()
+
+	data := buf.Bytes()
+	salt, data := data[:16], data[16:]
+
+	var frames [][]byte
+	for len(data) > 0 {
+		l := int(data[0]) + 1
+		frames = append(frames, data[:l])
+		data = data[l:]
+	}
+	return salt, frames
+}
+
+func decryptFrames(salt []byte, frames ...[]byte) (*TestMessage, []string) {
+	in := append([]byte(nil), salt...)
+	for _, f := range frames {
+		in = append(in, f...)
+	}
+
+	out := NewTestMessage()
+	StreamDecode(bytes.NewReader(in), out, Decrypt(testKey, AESGCM, 0))
+
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	<-out.Closed()
+	return out, strs
+}
+
+func TestEncryptRejects(t *testing.T) {
+	salt, frames := encryptedFrames(t)
+	if len(frames) != 4 {
+		t.Fatal("expected three values and the end frame, got frames: ", len(frames))
+	}
+
+	out, strs := decryptFrames(salt, frames...)
+	if out.Err() != nil || len(strs) != 3 {
+		t.Fatal("failed to decrypt stream: ", strs, out.Err())
+	}
+
+	tampered := append([]byte(nil), frames[1]...)
+	tampered[3] ^= 1
+	out, strs = decryptFrames(salt, frames[0], tampered, frames[2], frames[3])
+	if out.Err() != ErrDecrypt || len(strs) != 1 {
+		t.Fatal("expected a tampered frame to be rejected, got: ", strs, out.Err())
+	}
+
+	out, strs = decryptFrames(salt, frames[0], frames[2], frames[1], frames[3])
+	if out.Err() != ErrDecrypt || len(strs) != 1 {
+		t.Fatal("expected reordered frames to be rejected, got: ", strs, out.Err())
+	}
+
+	out, strs = decryptFrames(salt, frames[0], frames[0], frames[1], frames[2], frames[3])
+	if out.Err() != ErrDecrypt || len(strs) != 1 {
+		t.Fatal("expected a replayed frame to be rejected, got: ", strs, out.Err())
+	}
+
+	out, strs = decryptFrames(salt, frames[:3]...)
+	if out.Err() != io.ErrUnexpectedEOF || len(strs) != 3 {
+		t.Fatal("expected a truncated stream to fail, got: ", strs, out.Err())
+	}
+}
+
+func TestEncryptKeySize(t *testing.T) {
+	long := append(append([]byte(nil), testKey...), testKey...)
+	for _, c := range []struct {
+		key  []byte
+		aead AEADFunc
+	}{
+		{long, AESGCM},
+		{testKey[:16], ChaCha20Poly1305},
+		{testKey[:5], AESGCM},
+	} {
+		err := StreamEncode(new(bytes.Buffer), NewTestMessage(), Encrypt(c.key, c.aead, 0))
+		if err == nil {
+			t.Fatalf("expected a %d byte key to be rejected by the encoder", len(c.key))
+		}
+
+		err = StreamDecode(new(bytes.Buffer), NewTestMessage(), Decrypt(c.key, c.aead, 0))
+		if err == nil {
+			t.Fatalf("expected a %d byte key to be rejected by the decoder", len(c.key))
+		}
+	}
+}
+
+func TestEncryptLargeValue(t *testing.T) {
+	// larger than a single frame may be
+	big := make([]byte, 17<<20)
+	big[len(big)-1] = 1
+
+	buf := new(bytes.Buffer)
+	tm := NewTestMessage()
+	err := StreamEncode(buf, tm, Encrypt(testKey, AESGCM, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Repbytes.Send(context.Background(), big); err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := NewTestMessage()
+	err = StreamDecode(buf, out, Decrypt(testKey, AESGCM, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals [][]byte
+	for v := range out.Repbytes.C() {
+		vals = append(vals, v)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || !bytes.Equal(vals[0], big) {
+		t.Fatal("got wrong values: ", len(vals))
+	}
+}
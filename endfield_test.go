@@ -0,0 +1,167 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func testEndField(t *testing.T, dopts []DecodeOption, eopts ...EncodeOption) {
+	r, w := io.Pipe()
+
+	out := NewTestMessage()
+	err := StreamDecode(r, out, dopts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	err = StreamEncode(w, tm, eopts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, s := range []string{"cat", "dog"} {
+		if err := tm.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm.Repstring.Close()
+
+	// the field ends on its own, while the stream stays open
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	if len(strs) != 2 || strs[1] != "dog" {
+		t.Fatal("got wrong values: ", strs)
+	}
+	select {
+	case <-out.Closed():
+		t.Fatal("stream closed along with the field: ", out.Err())
+	default:
+	}
+
+	if err := tm.Repint.Send(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := out.Repint.Recv(ctx); err != nil || v != 7 {
+		t.Fatal("failed to receive on the open field: ", v, err)
+	}
+
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEndField(t *testing.T) {
+	testEndField(t, nil)
+}
+
+func TestEndFieldSelectEncoder(t *testing.T) {
+	testEndField(t, nil, SelectEncoder())
+}
+
+func TestEndFieldQueued(t *testing.T) {
+	testEndField(t, []DecodeOption{FieldDelivery(9, DeliverDropNewest, 4)})
+}
+
+func TestEndFieldChecksums(t *testing.T) {
+	testEndField(t, []DecodeOption{VerifyChecksums(CorruptAbort)}, Checksums())
+}
+
+func TestEndFieldPlainDecoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tm := NewTestMessage()
+	tm.A = proto.Int32(5)
+	err := StreamEncode(buf, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm.Repstring.Send(context.Background(), "cat")
+	tm.Repstring.Close()
+	tm.Repint.Send(context.Background(), 7)
+	tm.Close()
+	<-tm.Closed()
+
+	outm := new(tpb.TestMessage)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outm.GetA() != 5 || len(outm.Repstring) != 1 || len(outm.Repint) != 1 || outm.Repint[0] != 7 {
+		t.Fatal("plain decoder got wrong message: ", outm)
+	}
+}
+
+func TestEndFieldClose(t *testing.T) {
+	// fields closing along with the message are not ended on their own,
+	// so closing writes the same bytes however the encoder is scheduled
+	expected := []byte{
+		3<<3 | Varint, 5,
+		9<<3 | LengthDelim, 3, 'c', 'a', 't',
+		9<<3 | LengthDelim, 3, 'd', 'o', 'g',
+	}
+	for _, opts := range [][]EncodeOption{nil, {SelectEncoder()}} {
+		for i := 0; i < 50; i++ {
+			buf := new(bytes.Buffer)
+			tm := NewTestMessage()
+			tm.A = proto.Int32(5)
+			err := StreamEncode(buf, tm, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tm.Repstring.Send(context.Background(), "cat")
+			tm.Repstring.Send(context.Background(), "dog")
+			tm.Close()
+			<-tm.Closed()
+			if err := tm.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Fatalf("expected %x, got %x", expected, buf.Bytes())
+			}
+		}
+	}
+
+	// the same goes for nested stream messages
+	for i := 0; i < 50; i++ {
+		buf := new(bytes.Buffer)
+		env := NewTestEnvelope()
+		env.Name = proto.String("x")
+		err := StreamEncode(buf, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env.Close()
+		<-env.Closed()
+		if err := env.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes(), []byte{1<<3 | LengthDelim, 1, 'x'}) {
+			t.Fatalf("expected only the name, got %x", buf.Bytes())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func encodeEnumEnvelope(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	env := NewTestEnvelope()
+	env.Priority = TestEnvelope_URGENT.Enum()
+	err := StreamEncode(buf, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values the enum does not declare are kept
+	for _, m := range []Mood{Mood_ANGRY, Mood(7)} {
+		if err := env.Moods.Send(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEnum(t *testing.T) {
+	out := NewTestEnvelope()
+	err := StreamDecode(bytes.NewReader(encodeEnumEnvelope(t)), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var moods []Mood
+	for m := range out.Moods.C() {
+		moods = append(moods, m)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Priority == nil || *out.Priority != TestEnvelope_URGENT {
+		t.Fatal("got wrong priority: ", out.Priority)
+	}
+	if len(moods) != 2 || moods[0] != Mood_ANGRY || moods[1] != 7 {
+		t.Fatal("got wrong moods: ", moods)
+	}
+	if moods[0].String() != "ANGRY" || moods[1].String() != "7" {
+		t.Fatalf("got wrong names: %s, %s", moods[0], moods[1])
+	}
+}
+
+func TestEnumPlainDecoder(t *testing.T) {
+	outm := new(tpb.TestEnvelope)
+	err := proto.Unmarshal(encodeEnumEnvelope(t), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if outm.GetPriority() != tpb.TestEnvelope_URGENT {
+		t.Fatal("plain decoder got wrong priority: ", outm.GetPriority())
+	}
+	if len(outm.Moods) != 2 || outm.Moods[0] != tpb.Mood_ANGRY || outm.Moods[1] != 7 {
+		t.Fatal("plain decoder got wrong moods: ", outm.Moods)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gogo/protobuf/proto"
 	pbs "github.com/whyrusleeping/go-pbs"
@@ -8,43 +9,30 @@ import (
 )
 
 type StreamCompany struct {
-	Name      *string                `protobuf:"bytes,1,req,name=name"`
-	Employees chan *Company_Employee `protobuf:"bytes,2,rep,name=employees"`
-	Country   *string                `protobuf:"bytes,3,opt,name=country"`
+	Name      *string                       `protobuf:"bytes,1,req,name=name"`
+	Employees *pbs.Field[*Company_Employee] `protobuf:"bytes,2,rep,name=employees"`
+	Country   *string                       `protobuf:"bytes,3,opt,name=country"`
 
-	errors  chan error
-	closeCh chan struct{}
+	*pbs.Stream
 }
 
 func NewStreamCompany() *StreamCompany {
 	return &StreamCompany{
-		Employees: make(chan *Company_Employee),
-		errors:    make(chan error, 1),
-		closeCh:   make(chan struct{}),
+		Employees: pbs.NewField[*Company_Employee](),
+		Stream:    pbs.NewStream(),
 	}
 }
 
 func (sc *StreamCompany) ProtoMessage()  {}
 func (sc *StreamCompany) String() string { return "TODO" }
 func (sc *StreamCompany) Reset() {
-	sc.Name = nil
-	sc.Country = nil
-	sc.Employees = make(chan *Company_Employee)
+	*sc = *NewStreamCompany()
 }
 
 func (sc *StreamCompany) Close() error {
-	close(sc.Employees)
-	close(sc.closeCh)
-	close(sc.errors)
-	return nil
-}
-
-func (sc *StreamCompany) Closed() <-chan struct{} {
-	return sc.closeCh
-}
-
-func (sc *StreamCompany) Errors() chan error {
-	return sc.errors
+	err := sc.Stream.Close()
+	sc.Employees.Close()
+	return err
 }
 
 func makeEmployee(name string, age uint32) *Company_Employee {
@@ -55,12 +43,9 @@ func makeEmployee(name string, age uint32) *Company_Employee {
 }
 
 func testDataPB() *StreamCompany {
-	sc := new(StreamCompany)
+	sc := NewStreamCompany()
 	sc.Country = proto.String("AMERICA")
 	sc.Name = proto.String("Corp Inc")
-	sc.closeCh = make(chan struct{})
-	sc.errors = make(chan error, 1)
-	sc.Employees = make(chan *Company_Employee)
 
 	go func() {
 		for _, e := range []*Company_Employee{
@@ -71,7 +56,9 @@ func testDataPB() *StreamCompany {
 			makeEmployee("carol", 40),
 			makeEmployee("steven", 9),
 		} {
-			sc.Employees <- e
+			if err := sc.Employees.Send(context.Background(), e); err != nil {
+				break
+			}
 		}
 		sc.Close()
 	}()
@@ -98,7 +85,7 @@ func main() {
 		panic(err)
 	}
 
-	for e := range sc.Employees {
+	for e := range sc.Employees.C() {
 		fmt.Println(e)
 	}
 }
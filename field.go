@@ -0,0 +1,251 @@
+package pbs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFieldClosed is returned when sending on a Field that has been closed
+var ErrFieldClosed = errors.New("pbs: send on closed field")
+
+// ErrReceiveOnly is returned when sending on a Field that is being fed by
+// StreamDecode. Only the decoder may send on the fields of a consumer.
+var ErrReceiveOnly = errors.New("pbs: send on receive-only field")
+
+// Sender is the producer's view of a repeated field
+type Sender[T any] interface {
+	Send(ctx context.Context, v T) error
+}
+
+// Receiver is the consumer's view of a repeated field
+type Receiver[T any] interface {
+	Recv(ctx context.Context) (T, error)
+	C() <-chan T
+}
+
+// Field is a typed channel for the values of a repeated field in a
+// StreamMessage. Unlike a bare channel, sending on a closed Field returns
+// ErrFieldClosed instead of panicking, and closing it more than once is safe.
+type Field[T any] struct {
+	ch     chan T
+	closed chan struct{}
+	once   sync.Once
+
+	// lk is held for reading by senders and for writing while the
+	// underlying channel is closed, so a send can never race the close
+	lk sync.RWMutex
+
+	// decoding is set once StreamDecode feeds the field, after which only
+	// the decoder may send on it
+	decoding atomic.Bool
+}
+
+// NewField returns a new, open Field
+func NewField[T any]() *Field[T] {
+	return &Field[T]{
+		ch:     make(chan T),
+		closed: make(chan struct{}),
+	}
+}
+
+// Send delivers v to the receiving side of the field. It blocks until the
+// value is received, the field is closed or ctx is done. A nil error means
+// the value was handed to a receiver. Sending on a field that is being
+// decoded into returns ErrReceiveOnly.
+func (f *Field[T]) Send(ctx context.Context, v T) error {
+	if f.decoding.Load() {
+		return ErrReceiveOnly
+	}
+	return f.send(ctx, v)
+}
+
+func (f *Field[T]) send(ctx context.Context, v T) error {
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+
+	select {
+	case <-f.closed:
+		return ErrFieldClosed
+	default:
+	}
+
+	select {
+	case f.ch <- v:
+		return nil
+	case <-f.closed:
+		return ErrFieldClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Recv returns the next value sent on the field. Once the field has been
+// closed it returns io.EOF.
+func (f *Field[T]) Recv(ctx context.Context) (T, error) {
+	select {
+	case v, ok := <-f.ch:
+		if !ok {
+			var zero T
+			return zero, io.EOF
+		}
+		return v, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// C returns the receive side of the field, for use in select statements
+// and range loops. The channel is closed when the field is closed.
+func (f *Field[T]) C() <-chan T {
+	return f.ch
+}
+
+// Closed returns a channel that is closed once Close has been called
+func (f *Field[T]) Closed() <-chan struct{} {
+	return f.closed
+}
+
+// Close closes the field. Pending and future sends return ErrFieldClosed,
+// and receivers see the end of the field once it has been drained.
+// It is safe to call Close more than once.
+func (f *Field[T]) Close() error {
+	f.once.Do(func() {
+		// wake up any blocked senders first so they release the read lock
+		close(f.closed)
+
+		f.lk.Lock()
+		close(f.ch)
+		f.lk.Unlock()
+	})
+	return nil
+}
+
+func (f *Field[T]) elemType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+func (f *Field[T]) sendValue(ctx context.Context, v reflect.Value) error {
+	return f.send(ctx, v.Interface().(T))
+}
+
+func (f *Field[T]) recvValue(done <-chan struct{}) (reflect.Value, bool) {
+	var v T
+	var ok bool
+	select {
+	case v, ok = <-f.ch:
+	case <-done:
+		select {
+		case v, ok = <-f.ch:
+		default:
+		}
+	}
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(&v).Elem(), true
+}
+
+func (f *Field[T]) selectChan() reflect.Value {
+	return reflect.ValueOf(f.ch)
+}
+
+func (f *Field[T]) closeField() {
+	f.Close()
+}
+
+func (f *Field[T]) setDecoding() {
+	f.decoding.Store(true)
+}
+
+// repeatedField gives uniform access to a repeated field of a StreamMessage,
+// whether it is declared as a bare channel or as a *Field. Every
+// instantiation of Field implements it, which lets the reflection based
+// encoder and decoder use a Field without knowing its type parameter.
+//
+// recvValue returns false once the field has been closed. After done is
+// closed it only returns values that are immediately available, so the
+// field can be drained without blocking.
+type repeatedField interface {
+	elemType() reflect.Type
+	sendValue(ctx context.Context, v reflect.Value) error
+	recvValue(done <-chan struct{}) (reflect.Value, bool)
+	closeField()
+
+	// selectChan returns the channel values are received from, for use
+	// with reflect.Select
+	selectChan() reflect.Value
+
+	// setDecoding marks the field as owned by the decoder
+	setDecoding()
+}
+
+// chanField adapts a bare channel to the repeatedField interface
+type chanField struct {
+	ch reflect.Value
+}
+
+func (c chanField) elemType() reflect.Type {
+	return c.ch.Type().Elem()
+}
+
+func (c chanField) sendValue(ctx context.Context, v reflect.Value) error {
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: c.ch, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	})
+	if chosen == 1 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (c chanField) recvValue(done <-chan struct{}) (reflect.Value, bool) {
+	if done == nil {
+		return c.ch.Recv()
+	}
+
+	chosen, v, ok := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: c.ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	})
+	if chosen == 1 {
+		return c.ch.TryRecv()
+	}
+	return v, ok
+}
+
+func (c chanField) selectChan() reflect.Value {
+	return c.ch
+}
+
+func (c chanField) closeField() {
+	c.ch.Close()
+}
+
+// a bare channel has no way of restricting its senders
+func (c chanField) setDecoding() {}
+
+// getRepeatedField returns an accessor for the repeated struct field v
+func getRepeatedField(v reflect.Value) (repeatedField, error) {
+	switch {
+	case v.Kind() == reflect.Chan:
+		if v.IsNil() {
+			return nil, errors.New("repeated field channel was nil")
+		}
+		return chanField{ch: v}, nil
+	case v.Type().Implements(repeatedFieldType):
+		if v.IsNil() {
+			return nil, errors.New("repeated field was nil")
+		}
+		return v.Interface().(repeatedField), nil
+	default:
+		return nil, errors.New("repeated field was not a channel or a Field")
+	}
+}
+
+var repeatedFieldType = reflect.TypeOf((*repeatedField)(nil)).Elem()
@@ -0,0 +1,109 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func TestFieldSendRecv(t *testing.T) {
+	f := NewField[string]()
+	ctx := context.Background()
+
+	go func() {
+		for _, s := range []string{"a", "b", "c"} {
+			if err := f.Send(ctx, s); err != nil {
+				t.Error(err)
+			}
+		}
+		f.Close()
+	}()
+
+	var out []string
+	for {
+		s, err := f.Recv(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, s)
+	}
+
+	if len(out) != 3 || out[0] != "a" || out[1] != "b" || out[2] != "c" {
+		t.Fatal("got wrong values from field: ", out)
+	}
+}
+
+func TestFieldSendAfterClose(t *testing.T) {
+	f := NewField[int32]()
+	f.Close()
+	f.Close()
+
+	err := f.Send(context.Background(), 5)
+	if err != ErrFieldClosed {
+		t.Fatal("expected ErrFieldClosed, got: ", err)
+	}
+
+	_, ok := <-f.C()
+	if ok {
+		t.Fatal("expected field channel to be closed")
+	}
+}
+
+func TestFieldCloseWakesSender(t *testing.T) {
+	f := NewField[[]byte]()
+
+	errs := make(chan error)
+	go func() {
+		errs <- f.Send(context.Background(), []byte("nobody is listening"))
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+	f.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrFieldClosed {
+			t.Fatal("expected ErrFieldClosed, got: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked sender was not woken by Close")
+	}
+}
+
+func TestFieldSendContext(t *testing.T) {
+	f := NewField[string]()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := f.Send(ctx, "hello")
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got: ", err)
+	}
+}
+
+func TestFieldDecode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{0x4a, 3, 'c', 'a', 't', 0x4a, 3, 'd', 'o', 'g'})
+
+	tm := NewTestMessage()
+	err := StreamDecode(buf, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []string
+	for s := range tm.Repstring.C() {
+		out = append(out, s)
+	}
+
+	if len(out) != 2 || out[0] != "cat" || out[1] != "dog" {
+		t.Fatal("got wrong values from decoded field: ", out)
+	}
+}
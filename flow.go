@@ -0,0 +1,325 @@
+package pbs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Control frames sent by the consumer of a flow controlled stream. See the
+// wire format description next to the wire types.
+const (
+	windowFrame = 1
+	creditFrame = 2
+)
+
+// ErrFlowClosed is the error a flow controlled stream fails with when the
+// consumer stops sending control frames while the producer waits for credit
+var ErrFlowClosed = errors.New("pbs: flow control channel closed")
+
+// creditGate keeps track of the credit granted to the encoder of a flow
+// controlled stream. Writers of repeated values wait at the gate until the
+// consumer has granted enough credit.
+type creditGate struct {
+	lk sync.Mutex
+
+	// started is set once the consumer's window frame has arrived
+	started bool
+	values  uint64
+	limited bool
+
+	fields map[byte]int64
+	bytes  int64
+	err    error
+
+	// changed is closed and replaced whenever credit arrives
+	changed chan struct{}
+}
+
+func newCreditGate(r io.Reader) *creditGate {
+	g := &creditGate{
+		fields:  make(map[byte]int64),
+		changed: make(chan struct{}),
+	}
+	go g.readFrames(bufio.NewReader(r))
+	return g
+}
+
+// readFrames reads control frames until r fails
+func (g *creditGate) readFrames(r *bufio.Reader) {
+	for {
+		f, err := readControlFrame(r)
+		if err != nil {
+			g.abort(ErrFlowClosed)
+			return
+		}
+
+		g.lk.Lock()
+		switch f.kind {
+		case windowFrame:
+			g.started = true
+			g.values = f.ints[1]
+			g.limited = f.ints[2] > 0
+			g.bytes = int64(f.ints[2])
+		case creditFrame:
+			g.fields[byte(f.ints[1])] += int64(f.ints[2])
+			g.bytes += int64(f.ints[3])
+		}
+		g.notify()
+		g.lk.Unlock()
+	}
+}
+
+// notify wakes up everything waiting on the gate. It must be called with
+// g.lk held.
+func (g *creditGate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// ready returns whether a value of field may currently be written. It must
+// be called with g.lk held.
+func (g *creditGate) ready(field byte) bool {
+	if !g.started {
+		return false
+	}
+	if g.values > 0 && int64(g.values)+g.fields[field] <= 0 {
+		return false
+	}
+	if g.limited && g.bytes <= 0 {
+		return false
+	}
+	return true
+}
+
+// blocked returns whether a value of field has to wait for credit. Once
+// the gate has failed nothing is blocked, so writers find out about the
+// error.
+func (g *creditGate) blocked(field byte) bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return g.err == nil && !g.ready(field)
+}
+
+// changes returns a channel that is closed the next time credit arrives
+func (g *creditGate) changes() <-chan struct{} {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return g.changed
+}
+
+// abort fails the gate, releasing every writer waiting for credit
+func (g *creditGate) abort(err error) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	if g.err == nil {
+		g.err = err
+		g.notify()
+	}
+}
+
+// acquire waits until a value of field that encodes to size bytes may be
+// written, and takes the credit for it. A value may be written as long as
+// any byte credit is left, so that a value larger than the whole window
+// does not stall the stream forever.
+func (g *creditGate) acquire(field byte, size int) error {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	for !g.ready(field) {
+		if g.err != nil {
+			return g.err
+		}
+
+		changed := g.changed
+		g.lk.Unlock()
+		<-changed
+		g.lk.Lock()
+	}
+
+	// field credit is kept relative to the window, so credit can arrive
+	// for a field before its first value is written
+	g.fields[field]--
+	g.bytes -= int64(size)
+	return nil
+}
+
+// creditGranter returns credit to the producer of a flow controlled stream
+// as the consumer takes values off the stream
+type creditGranter struct {
+	lk     sync.Mutex
+	w      io.Writer
+	values int
+	bytes  int
+
+	pending      map[byte]int
+	pendingBytes int
+}
+
+func newCreditGranter(w io.Writer, values, bytes int) *creditGranter {
+	return &creditGranter{
+		w:       w,
+		values:  values,
+		bytes:   bytes,
+		pending: make(map[byte]int),
+	}
+}
+
+// start sends the initial window to the producer
+func (cg *creditGranter) start() error {
+	cg.lk.Lock()
+	defer cg.lk.Unlock()
+	return writeControlFrame(cg.w, windowFrame, uint64(cg.values), uint64(cg.bytes))
+}
+
+// consumed records that a value of field, which was size bytes on the
+// wire, has been taken off the stream. Credit is returned in batches of
+// half a window.
+func (cg *creditGranter) consumed(field byte, size int) error {
+	cg.lk.Lock()
+	defer cg.lk.Unlock()
+
+	cg.pending[field]++
+	cg.pendingBytes += size
+
+	if cg.values > 0 && cg.pending[field] >= halfWindow(cg.values) {
+		err := writeControlFrame(cg.w, creditFrame, uint64(field), uint64(cg.pending[field]), uint64(cg.pendingBytes))
+		cg.pending[field] = 0
+		cg.pendingBytes = 0
+		return err
+	}
+
+	if cg.bytes > 0 && cg.pendingBytes >= halfWindow(cg.bytes) {
+		err := writeControlFrame(cg.w, creditFrame, uint64(0), uint64(0), uint64(cg.pendingBytes))
+		cg.pendingBytes = 0
+		return err
+	}
+	return nil
+}
+
+func halfWindow(n int) int {
+	if n < 2 {
+		return 1
+	}
+	return n / 2
+}
+
+const (
+	// maxControlFrameSize bounds the allocation for a single control frame
+	maxControlFrameSize = 1 << 20
+
+	// maxFrameData is the most stream data a control frame carries, so
+	// that a frame with it stays under maxControlFrameSize
+	maxFrameData = maxControlFrameSize / 2
+)
+
+// controlFrame is a frame of one of the protocols layered on top of pbs
+// streams, such as flow control credit or session framing
+type controlFrame struct {
+	kind byte
+
+	// ints and data hold the varint and length delimited fields of the
+	// frame, indexed by field number
+	ints map[byte]uint64
+	data map[byte][]byte
+}
+
+// writeControlFrame writes a control frame whose body holds the given
+// values, numbered from one. Integers are written as varints, strings and
+// byte slices as length delimited fields.
+func writeControlFrame(w io.Writer, kind byte, vals ...interface{}) error {
+	body := new(bytes.Buffer)
+	for i, v := range vals {
+		var err error
+		switch v := v.(type) {
+		case uint64:
+			err = writeVarint(body, byte(i+1), v)
+		case string:
+			err = writeLengthDelimited(body, byte(i+1), []byte(v))
+		case []byte:
+			err = writeLengthDelimited(body, byte(i+1), v)
+		default:
+			err = fmt.Errorf("pbs: unsupported control frame value %T", v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := writeLengthDelimited(buf, kind, body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+var errMalformedFrame = errors.New("pbs: malformed control frame")
+
+// readControlFrame reads a single control frame
+func readControlFrame(r *bufio.Reader) (*controlFrame, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	typ, kind := splitTypeAndField(b)
+	if typ != LengthDelim {
+		return nil, errMalformedFrame
+	}
+
+	data, err := readLengthDelim(r, maxControlFrameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &controlFrame{
+		kind: kind,
+		ints: make(map[byte]uint64),
+		data: make(map[byte][]byte),
+	}
+	for len(data) > 0 {
+		typ, field := splitTypeAndField(data[0])
+
+		v, n := proto.DecodeVarint(data[1:])
+		if n == 0 {
+			return nil, errMalformedFrame
+		}
+		data = data[1+n:]
+
+		switch typ {
+		case Varint:
+			f.ints[field] = v
+		case LengthDelim:
+			if uint64(len(data)) < v {
+				return nil, errMalformedFrame
+			}
+			f.data[field] = data[:v]
+			data = data[v:]
+		default:
+			return nil, errMalformedFrame
+		}
+	}
+	return f, nil
+}
+
+// valueSize returns the number of bytes a value took on the wire, given
+// its payload: a varint, or the length of a length delimited value. The
+// payload of a fixed width value is not needed.
+func valueSize(typ byte, payload int) int {
+	switch typ {
+	case LengthDelim:
+		return 1 + proto.SizeVarint(uint64(payload)) + payload
+	case Bit32, Int64:
+		return 1 + fixedSize(typ)
+	}
+	return 1 + proto.SizeVarint(uint64(payload))
+}
@@ -0,0 +1,185 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+// lockedBuffer is a bytes.Buffer that can be read while being written to
+type lockedBuffer struct {
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// waitForFields waits until buf holds n values, then makes sure no more
+// show up
+func waitForFields(t *testing.T, buf *lockedBuffer, n int) {
+	deadline := time.Now().Add(time.Second)
+	for len(readFields(t, buf.Bytes())) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d values, got: %d", n, len(readFields(t, buf.Bytes())))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := len(readFields(t, buf.Bytes())); got != n {
+		t.Fatalf("expected flow control to stop at %d values, got: %d", n, got)
+	}
+}
+
+func TestFlowControlCredit(t *testing.T) {
+	cr, cw := io.Pipe()
+	defer cw.Close()
+
+	buf := new(lockedBuffer)
+	tm := NewTestMessage()
+	err := StreamEncode(buf, tm, FlowControl(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			tm.Repstring.Send(context.Background(), "cat")
+		}
+	}()
+
+	// nothing is written before the window arrives
+	waitForFields(t, buf, 0)
+
+	// Window{values: 2}
+	cw.Write([]byte{0x0a, 2, 0x08, 2})
+	waitForFields(t, buf, 2)
+
+	// Credit{field: 9, values: 1}
+	cw.Write([]byte{0x12, 4, 0x08, 9, 0x10, 1})
+	waitForFields(t, buf, 3)
+
+	// credit for another field does not help
+	cw.Write([]byte{0x12, 4, 0x08, 2, 0x10, 1})
+	waitForFields(t, buf, 3)
+
+	cw.Write([]byte{0x12, 4, 0x08, 9, 0x10, 1})
+	waitForFields(t, buf, 4)
+
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFlowRoundTrip(t *testing.T, values, bytes int, opts ...EncodeOption) {
+	dr, dw := io.Pipe()
+	cr, cw := io.Pipe()
+	defer cw.Close()
+
+	out := NewTestMessage()
+	err := StreamDecode(dr, out, FlowWindow(cw, values, bytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	tm.A = proto.Int32(-195)
+	tm.B = proto.String("pbs is fun")
+	err = StreamEncode(dw, tm, append(opts, FlowControl(cr))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		for i := 0; i < 20; i++ {
+			tm.Repstring.Send(ctx, fmt.Sprint("value ", i))
+			tm.Repint.Send(ctx, int32(i))
+		}
+		tm.Close()
+		<-tm.Closed()
+		dw.Close()
+	}()
+
+	var ints []int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range out.Repint.C() {
+			ints = append(ints, i)
+		}
+	}()
+
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	<-done
+
+	if len(strs) != 20 || strs[19] != "value 19" {
+		t.Fatal("got wrong repeated strings: ", strs)
+	}
+	if len(ints) != 20 || ints[19] != 19 {
+		t.Fatal("got wrong repeated ints: ", ints)
+	}
+	if *out.A != -195 {
+		t.Fatal("got wrong scalar: ", *out.A)
+	}
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlowControlRoundTrip(t *testing.T) {
+	testFlowRoundTrip(t, 2, 0)
+}
+
+func TestFlowControlBytes(t *testing.T) {
+	testFlowRoundTrip(t, 0, 16)
+}
+
+func TestFlowControlSelect(t *testing.T) {
+	testFlowRoundTrip(t, 3, 64, SelectEncoder())
+}
+
+func TestFlowControlClosed(t *testing.T) {
+	cr, cw := io.Pipe()
+
+	tm := NewTestMessage()
+	err := StreamEncode(io.Discard, tm, FlowControl(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go tm.Repstring.Send(context.Background(), "cat")
+	cw.Close()
+
+	select {
+	case <-tm.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("stream was never closed")
+	}
+
+	if tm.Err() != ErrFlowClosed {
+		t.Fatal("expected ErrFlowClosed, got: ", tm.Err())
+	}
+}
@@ -0,0 +1,143 @@
+package pbs
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// heartbeatTag is written on its own as a heartbeat. A tag of zero is not
+// valid in the protobuf encoding, so it never starts a value.
+const heartbeatTag = 0
+
+// IdleTimeoutError is the error a stream fails with when nothing arrives
+// for longer than its idle timeout (see IdleTimeout)
+type IdleTimeoutError struct {
+	Idle time.Duration
+}
+
+func (e *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("pbs: nothing received for %v", e.Idle)
+}
+
+// Timeout reports that the error is a timeout, like a net.Error
+func (e *IdleTimeoutError) Timeout() bool { return true }
+
+// heartbeat writes a heartbeat whenever nothing has been written for the
+// interval, until the stream starts closing
+func (se *streamEncoder) heartbeat(interval time.Duration) {
+	done := se.sm.Closed()
+	if se.st != nil {
+		defer se.st.detach()
+		done = se.st.Closing()
+	}
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+
+		se.lk.Lock()
+		wait := interval - time.Since(se.last)
+		if wait <= 0 && !se.failed {
+			_, err := se.out.Write([]byte{heartbeatTag})
+			if err == nil {
+				err = se.flush()
+			}
+			if err != nil {
+				se.fail(err)
+			}
+			se.last = time.Now()
+			wait = interval
+		}
+		se.lk.Unlock()
+
+		t.Reset(wait)
+	}
+}
+
+// idleReader fails a read that waits for data longer than the idle
+// timeout. Data is read from the underlying reader by a separate
+// goroutine, one chunk at a time, so a read blocked on it can be given up.
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+
+	chunks  chan []byte
+	err     error
+	stopped chan struct{}
+
+	// buf is what is left of the last chunk
+	buf []byte
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration) *idleReader {
+	ir := &idleReader{
+		r:       r,
+		timeout: timeout,
+		chunks:  make(chan []byte),
+		stopped: make(chan struct{}),
+	}
+	go ir.pump()
+	return ir
+}
+
+func (ir *idleReader) pump() {
+	defer close(ir.chunks)
+	for {
+		buf := make([]byte, 4096)
+		n, err := ir.r.Read(buf)
+		if n > 0 {
+			select {
+			case ir.chunks <- buf[:n]:
+			case <-ir.stopped:
+				return
+			}
+		}
+		if err != nil {
+			ir.err = err
+			return
+		}
+	}
+}
+
+func (ir *idleReader) Read(b []byte) (int, error) {
+	if len(ir.buf) == 0 {
+		t := time.NewTimer(ir.timeout)
+		defer t.Stop()
+
+		select {
+		case chunk, ok := <-ir.chunks:
+			if !ok {
+				return 0, ir.err
+			}
+			ir.buf = chunk
+		case <-t.C:
+			ir.stop()
+			return 0, &IdleTimeoutError{Idle: ir.timeout}
+		}
+	}
+
+	n := copy(b, ir.buf)
+	ir.buf = ir.buf[n:]
+	return n, nil
+}
+
+// stop ends the pump once its current read returns, and interrupts that
+// read if the underlying reader has a deadline, like a net.Conn
+func (ir *idleReader) stop() {
+	select {
+	case <-ir.stopped:
+		return
+	default:
+		close(ir.stopped)
+	}
+
+	if dr, ok := ir.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		dr.SetReadDeadline(time.Now())
+	}
+}
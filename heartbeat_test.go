@@ -0,0 +1,87 @@
+package pbs_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func TestHeartbeat(t *testing.T) {
+	r, w := io.Pipe()
+
+	out := NewTestMessage()
+	err := StreamDecode(r, out, IdleTimeout(time.Millisecond*100), VerifyChecksums(CorruptAbort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	err = StreamEncode(w, tm, Heartbeat(time.Millisecond*10), Checksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the heartbeats keep the silent stream from timing out
+	time.Sleep(time.Millisecond * 300)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tm.Repstring.Send(ctx, "cat"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := out.Repstring.Recv(ctx)
+	if err != nil || got != "cat" {
+		t.Fatal("failed to receive value after heartbeats: ", got, err)
+	}
+
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	out := NewTestMessage()
+	err := StreamDecode(b, out, IdleTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTestMessage()
+	err = StreamEncode(a, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Repstring.Send(context.Background(), "cat"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the repeated fields are closed once the stream times out
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	if len(strs) != 1 {
+		t.Fatal("expected the value sent before the timeout, got: ", strs)
+	}
+
+	<-out.Closed()
+	terr, ok := out.Err().(*IdleTimeoutError)
+	if !ok || !terr.Timeout() || terr.Idle != time.Millisecond*50 {
+		t.Fatal("expected an IdleTimeoutError, got: ", out.Err())
+	}
+}
@@ -0,0 +1,267 @@
+package pbs
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of a stream served over HTTP
+const ContentType = "application/x-pbs"
+
+// Headers negotiating the codec of a stream served over HTTP. The client
+// lists the IDs of the codecs it accepts, most preferred first, like
+// "2, 1", and the server names the one it compressed the stream with.
+const (
+	AcceptCodecsHeader = "Pbs-Accept-Codecs"
+	CodecHeader        = "Pbs-Codec"
+)
+
+// HTTPError is returned by HTTPDecode when the server did not respond with
+// a stream
+type HTTPError struct {
+	StatusCode  int
+	ContentType string
+}
+
+func (e *HTTPError) Error() string {
+	if e.StatusCode != http.StatusOK {
+		return fmt.Sprintf("pbs: unexpected http status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("pbs: unexpected content type %q", e.ContentType)
+}
+
+// HTTPHandler returns a handler that streams a message in response to each
+// request. open is called with the request and returns the message to
+// encode; its producer should stop when the request's context is done. If
+// open fails, or the message cannot be encoded with opts, the client gets
+// a 500 with the error.
+//
+// Every value is flushed to the client as soon as it has been encoded. If
+// encoding fails partway through, the response is aborted rather than ended
+// cleanly, so the client does not mistake it for a complete stream. With
+// OfferCodecs, the response is compressed with a codec the client accepts.
+func HTTPHandler(open func(r *http.Request) (StreamMessage, error), opts ...EncodeOption) http.Handler {
+	cfg := new(encodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsStream(r.Header.Get("Accept")) {
+			http.Error(w, "pbs: client does not accept "+ContentType, http.StatusNotAcceptable)
+			return
+		}
+
+		sm, err := open(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		opts := opts
+		if cfg.offers != nil {
+			c := pickCodec(cfg.offers, r.Header.Get(AcceptCodecsHeader))
+			opts = append(opts[:len(opts):len(opts)], Compress(c))
+
+			w.Header().Add("Vary", AcceptCodecsHeader)
+			if c != nil {
+				w.Header().Set(CodecHeader, strconv.Itoa(int(c.ID())))
+			}
+		}
+
+		w.Header().Set("Content-Type", ContentType)
+
+		// the status is only sent once the encoder is set up, so a message
+		// or options it rejects still get an error response
+		fw := &flushWriter{w: w}
+		fw.f, _ = w.(http.Flusher)
+
+		err = StreamEncode(fw, sm, opts...)
+		if err != nil {
+			if err != ErrNilStream {
+				// a message with a nil Stream has nil Fields as well,
+				// which its Close would trip over
+				sm.Close()
+			}
+			if fw.started() {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del(CodecHeader)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fw.flush()
+
+		// the response writer must not be used once the handler returns,
+		// so wait for the encoder even when the client went away
+		ctx := r.Context()
+		select {
+		case <-sm.Closed():
+		case <-ctx.Done():
+			reportError(sm, ctx.Err())
+			<-sm.Closed()
+		}
+
+		if sm.Err() != nil && ctx.Err() == nil {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// acceptsStream reports whether a client sending the given Accept header
+// accepts a stream in response
+func acceptsStream(accept string) bool {
+	if accept == "" {
+		return true
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			w, err := strconv.ParseFloat(q, 64)
+			if err != nil || w <= 0 {
+				continue
+			}
+		}
+		switch mt {
+		case ContentType, "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// pickCodec returns the first codec listed in an AcceptCodecsHeader that is
+// offered, or nil if there is none
+func pickCodec(offers []Codec, accept string) Codec {
+	for _, part := range strings.Split(accept, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for _, c := range offers {
+			if int(c.ID()) == id {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// formatCodecs returns the AcceptCodecsHeader listing the given codec IDs
+func formatCodecs(ids []byte) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(int(id))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// flushWriter flushes every write through to the client
+type flushWriter struct {
+	lk      sync.Mutex
+	w       io.Writer
+	f       http.Flusher
+	written bool
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+
+	fw.written = true
+	n, err := fw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	fw.flushLocked()
+	return n, nil
+}
+
+// flush sends the response headers, and anything written, to the client
+func (fw *flushWriter) flush() {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+	fw.flushLocked()
+}
+
+func (fw *flushWriter) flushLocked() {
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+}
+
+// started reports whether anything has been written to the response
+func (fw *flushWriter) started() bool {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+	return fw.written
+}
+
+// HTTPDecode sends req with client, or http.DefaultClient if client is
+// nil, and decodes the streamed response into sm. It returns once the
+// response headers have arrived; decoding carries on in the background
+// until the stream ends, like StreamDecode.
+//
+// The request lists the codecs the stream may be compressed with, those
+// given with AcceptCodecs or else every registered codec, so a server
+// using OfferCodecs can pick one.
+//
+// Canceling the request's context closes the stream with the context's
+// error. The response body is closed once the stream is closed.
+func HTTPDecode(client *http.Client, req *http.Request, sm StreamMessage, opts ...DecodeOption) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req.Header.Set("Accept", ContentType)
+
+	cfg := new(decodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+	accept := cfg.codecs
+	if accept == nil {
+		accept = registeredCodecs()
+	}
+	if len(accept) > 0 {
+		req.Header.Set(AcceptCodecsHeader, formatCodecs(accept))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	mt, _, _ := mime.ParseMediaType(ct)
+	if resp.StatusCode != http.StatusOK || mt != ContentType {
+		resp.Body.Close()
+		return &HTTPError{StatusCode: resp.StatusCode, ContentType: ct}
+	}
+
+	err = StreamDecode(resp.Body, sm, opts...)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	go func() {
+		defer resp.Body.Close()
+
+		ctx := req.Context()
+		select {
+		case <-sm.Closed():
+		case <-ctx.Done():
+			reportError(sm, ctx.Err())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,250 @@
+package pbs_test
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func TestHTTPStream(t *testing.T) {
+	received := make(chan struct{})
+	srv := httptest.NewServer(HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+		tm := NewTestMessage()
+		tm.B = proto.String("pbs")
+		go func() {
+			defer tm.Close()
+			for _, s := range []string{"cat", "dog", "fish"} {
+				if err := tm.Repstring.Send(r.Context(), s); err != nil {
+					return
+				}
+
+				// the next value is only sent once the client has this
+				// one, so every value must be flushed on its own
+				select {
+				case <-received:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}()
+		return tm, nil
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+
+	out := NewTestMessage()
+	err := HTTPDecode(srv.Client(), req, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"cat", "dog", "fish"} {
+		got, err := out.Repstring.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Fatalf("expected %q, got %q", s, got)
+		}
+		received <- struct{}{}
+	}
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.B == nil || *out.B != "pbs" {
+		t.Fatal("got wrong scalar: ", out.B)
+	}
+}
+
+func TestHTTPNegotiation(t *testing.T) {
+	srv := httptest.NewServer(HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+		tm := NewTestMessage()
+		tm.Close()
+		return tm, nil
+	}))
+	defer srv.Close()
+
+	for _, accept := range []string{
+		"application/json",
+		// a weight of zero refuses the type, however it is written
+		"application/x-pbs;q=0",
+		"application/x-pbs;q=0.0, text/plain",
+		"*/*;q=0.000",
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Fatalf("accepting %q: expected a 406, got: %d", accept, resp.StatusCode)
+		}
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("meow"))
+	}))
+	defer plain.Close()
+
+	req, _ := http.NewRequest("GET", plain.URL, nil)
+	err := HTTPDecode(plain.Client(), req, NewTestMessage())
+	herr, ok := err.(*HTTPError)
+	if !ok || herr.ContentType != "text/plain" {
+		t.Fatal("expected an HTTPError for the content type, got: ", err)
+	}
+}
+
+func TestHTTPSetupError(t *testing.T) {
+	// a message or options the encoder rejects get an error response, not
+	// an empty stream
+	for _, h := range []http.Handler{
+		HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+			return &TestMessage{}, nil
+		}),
+		HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+			return NewTestMessage(), nil
+		}, Encrypt([]byte("too short"), AESGCM, 0)),
+	} {
+		srv := httptest.NewServer(h)
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		err := HTTPDecode(srv.Client(), req, NewTestMessage())
+		srv.Close()
+
+		herr, ok := err.(*HTTPError)
+		if !ok || herr.StatusCode != http.StatusInternalServerError {
+			t.Fatal("expected an HTTPError with a 500, got: ", err)
+		}
+	}
+}
+
+func TestHTTPCodecNegotiation(t *testing.T) {
+	srv := httptest.NewServer(HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+		tm := NewTestMessage()
+		go func() {
+			defer tm.Close()
+			tm.Repstring.Send(r.Context(), "cat")
+		}()
+		return tm, nil
+	}, OfferCodecs(Gzip(flate.BestSpeed), Flate(flate.BestSpeed))))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		accept string
+		codec  string
+	}{
+		// the client's preference wins
+		{"1, 2", "1"},
+		{"2,1", "2"},
+		{"6, 2", "2"},
+		// nothing in common, or an old client
+		{"6", ""},
+		{"", ""},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if c.accept != "" {
+			req.Header.Set(AcceptCodecsHeader, c.accept)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := resp.Header.Get(CodecHeader); got != c.codec {
+			t.Fatalf("accepting %q: expected codec %q, got %q", c.accept, c.codec, got)
+		}
+		if c.codec == "" && body[0] != 9<<3|LengthDelim {
+			t.Fatalf("accepting %q: expected an uncompressed stream, got %x", c.accept, body)
+		}
+		if c.codec != "" && strconv.Itoa(int(body[0])) != c.codec {
+			t.Fatalf("accepting %q: stream header does not match the codec: %x", c.accept, body)
+		}
+	}
+
+	// HTTPDecode offers the codecs it accepts
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	out := NewTestMessage()
+	err := HTTPDecode(srv.Client(), req, out, AcceptCodecs(FlateID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := out.Repstring.Recv(ctx)
+	if err != nil || s != "cat" {
+		t.Fatal("failed to decode a negotiated stream: ", s, err)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPCancel(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(HTTPHandler(func(r *http.Request) (StreamMessage, error) {
+		tm := NewTestMessage()
+		go func() {
+			<-tm.Closed()
+			close(done)
+		}()
+		go func() {
+			for {
+				if err := tm.Repstring.Send(r.Context(), "cat"); err != nil {
+					return
+				}
+			}
+		}()
+		return tm, nil
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+
+	out := NewTestMessage()
+	err := HTTPDecode(srv.Client(), req, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := out.Repstring.Recv(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case <-out.Closed():
+	case <-time.After(time.Second * 5):
+		t.Fatal("client stream was not closed")
+	}
+	if out.Err() == nil {
+		t.Fatal("expected the client stream to fail")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("server stream was not closed")
+	}
+}
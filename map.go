@@ -0,0 +1,85 @@
+package pbs
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// MapEntry is an entry of a map field. A map field of a stream message is
+// a Field of its entries, each encoded as the standard map entry message
+// with the key as field 1 and the value as field 2, so the other end may
+// decode the stream into a Go map with proto.Unmarshal. The encodings of
+// the key and value are given by the protobuf_key and protobuf_val struct
+// tags of the field.
+type MapEntry[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// mapEntry is implemented by every MapEntry
+type mapEntry interface {
+	marshalEntry(key, value Encoding) ([]byte, error)
+}
+
+// mapEntryPtr is implemented by a pointer to every MapEntry
+type mapEntryPtr interface {
+	unmarshalEntry(data []byte, key, value Encoding) error
+}
+
+func (e MapEntry[K, V]) marshalEntry(key, value Encoding) ([]byte, error) {
+	b, err := appendWireVal(proto.EncodeVarint(1<<3|uint64(key.wireType())), key, e.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	b = append(b, proto.EncodeVarint(2<<3|uint64(value.wireType()))...)
+	return appendWireVal(b, value, e.Value)
+}
+
+func (e *MapEntry[K, V]) unmarshalEntry(data []byte, key, value Encoding) error {
+	val := reflect.ValueOf(e).Elem()
+	buf := proto.NewBuffer(data)
+	for len(buf.Unread()) > 0 {
+		tag, err := buf.DecodeVarint()
+		if err != nil {
+			return err
+		}
+
+		typ, field := byte(tag&0x7), tag>>3
+		var x uint64
+		var b []byte
+		switch typ {
+		case Varint:
+			x, err = buf.DecodeVarint()
+		case Bit32:
+			x, err = buf.DecodeFixed32()
+		case Int64:
+			x, err = buf.DecodeFixed64()
+		case LengthDelim:
+			b, err = buf.DecodeRawBytes(true)
+		default:
+			err = fmt.Errorf("pbs: unsupported wire type %d in map entry", typ)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch field {
+		case 1:
+			err = setWireVal(val.Field(0), key, typ, x, b)
+		case 2:
+			err = setWireVal(val.Field(1), value, typ, x, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a message value is never nil, even when the entry omits it
+	if v := val.Field(1); v.Kind() == reflect.Ptr && v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+var testCounts = map[string]int32{"cats": 2, "dogs": 0, "debt": -3}
+
+func encodeMapEnvelope(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	env := NewTestEnvelope()
+	err := StreamEncode(buf, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for k, v := range testCounts {
+		if err := env.Counts.Send(ctx, MapEntry[string, int32]{Key: k, Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	att := &TestEnvelope_Attachment{Headers: map[string]string{"type": "text/plain"}}
+	if err := env.Attachments.Send(ctx, att); err != nil {
+		t.Fatal(err)
+	}
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMapField(t *testing.T) {
+	data := encodeMapEnvelope(t)
+
+	out := NewTestEnvelope()
+	err := StreamDecode(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atts := make(chan *TestEnvelope_Attachment, 1)
+	go func() {
+		for att := range out.Attachments.C() {
+			atts <- att
+		}
+	}()
+
+	counts := make(map[string]int32)
+	for e := range out.Counts.C() {
+		counts[e.Key] = e.Value
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != len(testCounts) {
+		t.Fatal("got wrong entries: ", counts)
+	}
+	for k, v := range testCounts {
+		if counts[k] != v {
+			t.Fatalf("expected %s=%d, got %d", k, v, counts[k])
+		}
+	}
+	if att := <-atts; att.Headers["type"] != "text/plain" {
+		t.Fatal("got wrong attachment: ", att.Headers)
+	}
+}
+
+func TestMapFieldPlainDecoder(t *testing.T) {
+	data := encodeMapEnvelope(t)
+
+	outm := new(tpb.TestEnvelope)
+	err := proto.Unmarshal(data, outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outm.Counts) != len(testCounts) || outm.Counts["debt"] != -3 {
+		t.Fatal("plain decoder got wrong map: ", outm.Counts)
+	}
+	if len(outm.Attachments) != 1 || outm.Attachments[0].Headers["type"] != "text/plain" {
+		t.Fatal("plain decoder got wrong attachments: ", outm.Attachments)
+	}
+}
@@ -0,0 +1,175 @@
+package pbs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+var streamMessageType = reflect.TypeOf((*StreamMessage)(nil)).Elem()
+
+// chunkWriter writes the encoding of a nested stream message as values of
+// its field in the enclosing stream
+type chunkWriter struct {
+	se    *streamEncoder
+	field byte
+}
+
+func (cw *chunkWriter) Write(b []byte) (int, error) {
+	buf, err := cw.se.encode(cw.field, b)
+	err = cw.se.put(buf, err)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// handleNested encodes a nested stream message into its field, in chunks
+// as it is produced, or whole once it closes if materialize is set. A
+// nested message that closes before the stream is followed by an end
+// marker; one that is still open when the stream starts closing is closed
+// along with it.
+func (se *streamEncoder) handleNested(field byte, sub StreamMessage, materialize bool) {
+	var done <-chan struct{}
+	if se.st != nil {
+		defer se.st.detach()
+		done = se.st.Closing()
+	}
+
+	var w io.Writer = &chunkWriter{se: se, field: field}
+	var opts []EncodeOption
+	var whole *bytes.Buffer
+	if materialize {
+		whole = new(bytes.Buffer)
+		w = whole
+		opts = append(opts, MaterializeNested())
+	}
+
+	err := StreamEncode(w, sub, opts...)
+	if err != nil {
+		se.put(nil, err)
+		return
+	}
+
+	ended := true
+	select {
+	case <-sub.Closed():
+		// a nested message closed along with the stream is not ended on
+		// its own, even if the select noticed it first
+		select {
+		case <-done:
+			ended = false
+		default:
+		}
+	case <-done:
+		ended = false
+		sub.Close()
+		<-sub.Closed()
+	}
+
+	if err := sub.Err(); err != nil {
+		se.put(nil, err)
+		return
+	}
+
+	if materialize {
+		buf, err := se.encode(field, whole.Bytes())
+		if se.put(buf, err) != nil {
+			return
+		}
+	}
+	if ended {
+		se.end(field)
+	}
+}
+
+// decodeNested writes a chunk of a nested stream message to its decoder.
+// Chunks of a nested message that its consumer has closed are dropped.
+func (db *decBuffer) decodeNested(field byte, f reflect.Value, data []byte) error {
+	if db.ended[field] {
+		return fmt.Errorf("pbs: value of field %d after the end of the field", field)
+	}
+
+	pw, err := db.nestedInput(field, f)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		pw.Write(data)
+	}
+	return nil
+}
+
+// nestedInput returns the input of the nested stream message in f,
+// starting its decoder on the first call. The message must have been set
+// on the field, typically by the constructor of the enclosing message.
+func (db *decBuffer) nestedInput(field byte, f reflect.Value) (*io.PipeWriter, error) {
+	if pw, ok := db.nested[field]; ok {
+		return pw, nil
+	}
+	if f.IsNil() {
+		return nil, fmt.Errorf("pbs: no message to decode field %d into", field)
+	}
+
+	sub := f.Interface().(StreamMessage)
+	pr, pw := io.Pipe()
+	err := StreamDecode(pr, sub)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-sub.Closed():
+		case <-db.ctx.Done():
+		}
+		// stop writing chunks nothing reads anymore, and end the nested
+		// message along with a stream that failed or was closed
+		pw.CloseWithError(db.val.Err())
+	}()
+
+	if db.nested == nil {
+		db.nested = make(map[byte]*io.PipeWriter)
+	}
+	db.nested[field] = pw
+	return pw, nil
+}
+
+// endNested ends the input of a nested stream message whose producer
+// closed it, starting its decoder first if none of its chunks arrived
+func (db *decBuffer) endNested(field byte) error {
+	finfo := db.props.FieldMapping[field]
+	pw, err := db.nestedInput(field, reflect.ValueOf(db.val).Elem().Field(finfo.GoField))
+	if err != nil {
+		return err
+	}
+
+	db.markEnded(field)
+	return pw.Close()
+}
+
+// endAllNested ends the input of every nested stream message that is
+// still open when the stream ends, failing them with the stream's error
+// if it has one. Nested messages that were never sent are closed too.
+func (db *decBuffer) endAllNested() {
+	err := db.val.Err()
+
+	val := reflect.ValueOf(db.val).Elem()
+	for field, finfo := range db.props.FieldMapping {
+		if !finfo.Stream || db.ended[field] {
+			continue
+		}
+
+		f := val.Field(finfo.GoField)
+		if f.IsNil() {
+			continue
+		}
+		pw, perr := db.nestedInput(field, f)
+		if perr != nil {
+			continue
+		}
+		db.markEnded(field)
+		pw.CloseWithError(err)
+	}
+}
@@ -0,0 +1,196 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func testNested(t *testing.T, dopts []DecodeOption, eopts ...EncodeOption) {
+	r, w := io.Pipe()
+
+	out := NewTestEnvelope()
+	err := StreamDecode(r, out, dopts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewTestEnvelope()
+	env.Name = proto.String("letter")
+	env.Body.B = proto.String("hello")
+	err = StreamEncode(w, env, eopts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// values of the nested message arrive as they are produced
+	for _, s := range []string{"cat", "dog"} {
+		if err := env.Body.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		v, err := out.Body.Repstring.Recv(ctx)
+		if err != nil || v != s {
+			t.Fatalf("expected %q, got %q: %v", s, v, err)
+		}
+	}
+	if out.Body.B == nil || *out.Body.B != "hello" {
+		t.Fatal("nested scalar was not decoded")
+	}
+
+	// the nested message ends on its own, while the stream stays open
+	env.Body.Close()
+	select {
+	case <-out.Body.Closed():
+	case <-ctx.Done():
+		t.Fatal("nested message was not closed")
+	}
+	if err := out.Body.Err(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out.Closed():
+		t.Fatal("stream closed along with the nested message: ", out.Err())
+	default:
+	}
+
+	if err := env.Notes.Send(ctx, "ps"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := out.Notes.Recv(ctx); err != nil || v != "ps" {
+		t.Fatal("failed to receive on the open field: ", v, err)
+	}
+
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name == nil || *out.Name != "letter" {
+		t.Fatal("scalar was not decoded")
+	}
+}
+
+func TestNested(t *testing.T) {
+	testNested(t, nil)
+}
+
+func TestNestedChecksums(t *testing.T) {
+	testNested(t, []DecodeOption{VerifyChecksums(CorruptAbort)}, Checksums())
+}
+
+func TestNestedCloseWithStream(t *testing.T) {
+	r, w := io.Pipe()
+
+	out := NewTestEnvelope()
+	err := StreamDecode(r, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewTestEnvelope()
+	err = StreamEncode(w, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := env.Body.Repint.Send(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := out.Body.Repint.Recv(ctx); err != nil || v != 3 {
+		t.Fatal("failed to receive nested value: ", v, err)
+	}
+
+	// closing the stream closes the nested message on both ends
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	for _, sm := range []StreamMessage{out.Body, out} {
+		select {
+		case <-sm.Closed():
+		case <-ctx.Done():
+			t.Fatal("decoded message was not closed")
+		}
+		if err := sm.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNestedPlainDecoder(t *testing.T) {
+	for _, materialize := range []bool{false, true} {
+		var opts []EncodeOption
+		if materialize {
+			opts = append(opts, MaterializeNested())
+		}
+
+		buf := new(bytes.Buffer)
+		env := NewTestEnvelope()
+		env.Body.A = proto.Int32(5)
+		err := StreamEncode(buf, env, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		env.Body.Repstring.Send(ctx, "cat")
+		env.Notes.Send(ctx, "ps")
+		env.Body.Repstring.Send(ctx, "dog")
+		env.Body.Close()
+		env.Close()
+		<-env.Closed()
+		if err := env.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		outm := new(tpb.TestEnvelope)
+		err = proto.Unmarshal(buf.Bytes(), outm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := outm.GetBody()
+		if body.GetA() != 5 || len(body.Repstring) != 2 || body.Repstring[1] != "dog" || len(outm.Notes) != 1 {
+			t.Fatal("plain decoder got wrong message: ", outm)
+		}
+
+		// a pbs decoder reads the materialized form as well
+		out := NewTestEnvelope()
+		err = StreamDecode(bytes.NewReader(buf.Bytes()), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for range out.Notes.C() {
+			}
+		}()
+		var strs []string
+		for s := range out.Body.Repstring.C() {
+			strs = append(strs, s)
+		}
+		<-out.Closed()
+		if len(strs) != 2 || strs[0] != "cat" {
+			t.Fatal("got wrong nested values: ", strs)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package pbs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// getOneofs adds the members of the oneofs of m to props. The oneofs are
+// given by name with the index of the interface field holding their case,
+// and changes gives the index of the Field their changes are streamed on.
+// The members are the wrapper types listed by XXX_OneofWrappers, which
+// protoc-gen-go and proto-gen generate for every message with a oneof.
+func getOneofs(m proto.Message, props *Props, oneofs, changes map[string]int) error {
+	ow, ok := m.(interface{ XXX_OneofWrappers() []interface{} })
+	if !ok {
+		return errors.New("pbs: message with a oneof has no XXX_OneofWrappers method")
+	}
+
+	t := reflect.TypeOf(m).Elem()
+	for _, w := range ow.XXX_OneofWrappers() {
+		wt := reflect.TypeOf(w)
+		if wt.Kind() != reflect.Ptr || wt.Elem().Kind() != reflect.Struct || wt.Elem().NumField() != 1 {
+			return fmt.Errorf("pbs: invalid oneof wrapper %s", wt)
+		}
+
+		tag, err := parseTag(wt.Elem().Field(0).Tag.Get("protobuf"))
+		if err != nil {
+			return fmt.Errorf("pbs: oneof wrapper %s: %w", wt, err)
+		}
+
+		goField := -1
+		for _, i := range oneofs {
+			if wt.Implements(t.Field(i).Type) {
+				goField = i
+			}
+		}
+		if goField < 0 {
+			return fmt.Errorf("pbs: oneof wrapper %s is not a case of any oneof", wt)
+		}
+
+		finfo := FieldInfo{GoField: goField, Oneof: wt}
+		finfo.setTag(tag)
+		props.FieldMapping[byte(tag.number)] = finfo
+	}
+
+	for name, i := range changes {
+		of, ok := oneofs[name]
+		if !ok {
+			return fmt.Errorf("pbs: changes field of unknown oneof %q", name)
+		}
+
+		if props.OneofChanges == nil {
+			props.OneofChanges = make(map[int]int)
+		}
+		props.OneofChanges[of] = i
+	}
+	return nil
+}
+
+// oneofMembers returns the field numbers of the members of the oneof held
+// in the given field, by their wrapper types
+func (p *Props) oneofMembers(goField int) map[reflect.Type]byte {
+	members := make(map[reflect.Type]byte)
+	for n, finfo := range p.FieldMapping {
+		if finfo.Oneof != nil && finfo.GoField == goField {
+			members[finfo.Oneof] = n
+		}
+	}
+	return members
+}
+
+// handleChanges encodes the cases a producer sends on the changes Field of
+// a oneof, each as a value of its member
+func (se *streamEncoder) handleChanges(rf repeatedField, members map[reflect.Type]byte) {
+	var done <-chan struct{}
+	if se.st != nil {
+		defer se.st.detach()
+		done = se.st.Closing()
+	}
+
+	for {
+		val, ok := rf.recvValue(done)
+		if !ok {
+			return
+		}
+
+		var field byte
+		var member bool
+		if !val.IsNil() {
+			field, member = members[val.Elem().Type()]
+		}
+		if !member {
+			se.put(nil, fmt.Errorf("pbs: %v is not a case of the oneof", val.Interface()))
+			return
+		}
+
+		buf, err := se.encode(field, val.Elem().Elem().Field(0).Interface())
+		se.put(buf, err)
+	}
+}
+
+// decodeOneof sets the case of a oneof from a value of one of its members,
+// replacing the case set before, and queues it for the oneof's changes
+// Field if it has one
+func (db *decBuffer) decodeOneof(finfo FieldInfo, typ byte, x uint64, data []byte) error {
+	w := reflect.New(finfo.Oneof.Elem())
+	err := setWireVal(w.Elem().Field(0), finfo.Encoding, typ, x, data)
+	if err != nil {
+		return err
+	}
+
+	reflect.ValueOf(db.val).Elem().Field(finfo.GoField).Set(w)
+
+	dq, ok := db.changes[finfo.GoField]
+	if !ok {
+		return nil
+	}
+	return dq.push(db.ctx, queuedValue{v: w})
+}
@@ -0,0 +1,174 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func TestOneof(t *testing.T) {
+	r, w := io.Pipe()
+
+	out := NewTestEnvelope()
+	err := StreamDecode(r, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewTestEnvelope()
+	env.Event = &TestEnvelope_Text{Text: "hi"}
+	err = StreamEncode(w, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// the consumer is told about the initial case, then every change
+	ev, err := out.EventChanges.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt, ok := ev.(*TestEnvelope_Text); !ok || txt.Text != "hi" {
+		t.Fatal("got wrong initial case: ", ev)
+	}
+
+	if err := env.EventChanges.Send(ctx, &TestEnvelope_Code{Code: -4}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err = out.EventChanges.Recv(ctx)
+	if code, ok := ev.(*TestEnvelope_Code); err != nil || !ok || code.Code != -4 {
+		t.Fatal("got wrong change: ", ev, err)
+	}
+
+	file := &TestEnvelope_Attachment{Body: &TestEnvelope_Attachment_Content{Content: "notes"}}
+	if err := env.EventChanges.Send(ctx, &TestEnvelope_File{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err = out.EventChanges.Recv(ctx)
+	if _, ok := ev.(*TestEnvelope_File); err != nil || !ok {
+		t.Fatal("got wrong change: ", ev, err)
+	}
+
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last case wins
+	if out.GetFile().GetContent() != "notes" || out.GetText() != "" {
+		t.Fatal("got wrong final case: ", out.Event)
+	}
+}
+
+func TestOneofUndrainedChanges(t *testing.T) {
+	r, w := io.Pipe()
+
+	out := NewTestEnvelope()
+	err := StreamDecode(r, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewTestEnvelope()
+	err = StreamEncode(w, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// the consumer never receives the changes, which must not hold up
+	// the other fields
+	for i := int32(0); i < 10; i++ {
+		if err := env.EventChanges.Send(ctx, &TestEnvelope_Code{Code: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := env.Notes.Send(ctx, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	note, err := out.Notes.Recv(ctx)
+	if err != nil || note != "still here" {
+		t.Fatal("got wrong note: ", note, err)
+	}
+
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	select {
+	case <-out.Closed():
+	case <-ctx.Done():
+		t.Fatal("stream did not end")
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetCode() != 9 {
+		t.Fatal("got wrong final case: ", out.Event)
+	}
+}
+
+func TestOneofInvalidCase(t *testing.T) {
+	env := NewTestEnvelope()
+	err := StreamEncode(io.Discard, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.EventChanges.Send(context.Background(), nil)
+	<-env.Closed()
+	if env.Err() == nil {
+		t.Fatal("expected sending no case to fail the stream")
+	}
+}
+
+func TestOneofPlainDecoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	env := NewTestEnvelope()
+	env.Event = &TestEnvelope_Text{Text: "hi"}
+	err := StreamEncode(buf, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	env.EventChanges.Send(ctx, &TestEnvelope_Code{Code: 9})
+	env.Attachments.Send(ctx, &TestEnvelope_Attachment{Body: &TestEnvelope_Attachment_Data{Data: []byte{1, 2}}})
+	env.Close()
+	<-env.Closed()
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	outm := new(tpb.TestEnvelope)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outm.GetCode() != 9 {
+		t.Fatal("plain decoder got wrong case: ", outm.Event)
+	}
+	if len(outm.Attachments) != 1 || !bytes.Equal(outm.Attachments[0].GetData(), []byte{1, 2}) {
+		t.Fatal("plain decoder got wrong attachments: ", outm.Attachments)
+	}
+}
@@ -0,0 +1,285 @@
+package pbs
+
+import (
+	"io"
+	"time"
+)
+
+// EncodeOption configures how StreamEncode encodes a stream
+type EncodeOption func(*encodeConfig)
+
+type encodeConfig struct {
+	// selectEncoder multiplexes every repeated field in one goroutine
+	selectEncoder bool
+
+	priorities map[byte]int
+	weights    map[byte]int
+
+	// credits is where the consumer's flow control frames are read from
+	credits io.Reader
+
+	// replay is the number of unacknowledged records a resumable stream
+	// keeps for replay
+	replay int
+
+	// codec compresses the stream
+	codec Codec
+
+	// offers holds the codecs an HTTP handler may compress with, in
+	// case the client accepts one of them
+	offers []Codec
+
+	// checksums adds a CRC32C trailer to every value
+	checksums bool
+
+	// encryption seals the stream in authenticated frames
+	encryption *encryption
+
+	// heartbeat is how long the encoder stays silent before writing a
+	// heartbeat
+	heartbeat time.Duration
+
+	// materialize writes nested stream messages as single values
+	materialize bool
+}
+
+// SelectEncoder makes StreamEncode encode every repeated field from a single
+// goroutine that selects over all of them, instead of starting a goroutine
+// per field that contends for the writer.
+func SelectEncoder() EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.selectEncoder = true
+	}
+}
+
+// FieldPriority sets the priority of a repeated field, and enables the
+// select encoder. Whenever a field with a higher priority has a value ready
+// it is encoded before any value of a lower priority field. Fields default
+// to priority zero.
+func FieldPriority(field, priority int) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.selectEncoder = true
+		if cfg.priorities == nil {
+			cfg.priorities = make(map[byte]int)
+		}
+		cfg.priorities[byte(field)] = priority
+	}
+}
+
+// FieldWeight sets the fairness weight of a repeated field, and enables the
+// select encoder. When several fields of the same priority have values
+// ready, each is served in proportion to its weight. Fields default to a
+// weight of one.
+func FieldWeight(field, weight int) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.selectEncoder = true
+		if cfg.weights == nil {
+			cfg.weights = make(map[byte]int)
+		}
+		cfg.weights[byte(field)] = weight
+	}
+}
+
+// FlowControl makes the stream flow controlled by its consumer, which
+// grants credit by writing control frames to the other end of r, usually
+// the read side of the connection the stream is written to. Repeated values
+// are held back until the consumer has granted credit for them; scalar
+// fields are always written straight away. If r ends while the encoder is
+// waiting for credit, the stream fails with ErrFlowClosed.
+func FlowControl(r io.Reader) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.credits = r
+	}
+}
+
+// ReplayBuffer sets how many records a resumable stream keeps until the
+// consumer acknowledges them, for replay after a reconnect. Writes block
+// while the buffer is full. It has no effect on StreamEncode.
+func ReplayBuffer(records int) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.replay = records
+	}
+}
+
+// Compress compresses the stream with c. The encoder flushes the
+// compressor after every value, so the decoder can decode each value as
+// soon as it arrives. The encoder picks the codec, and decoders detect
+// compressed streams by their header and decompress them with any
+// registered codec, unless limited with AcceptCodecs. Use OfferCodecs to
+// compress with a codec the client accepts instead.
+func Compress(c Codec) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.codec = c
+	}
+}
+
+// OfferCodecs makes HTTPHandler negotiate the codec of each response with
+// the client: the stream is compressed with the first codec the client
+// accepts that is among cs, and is not compressed if there is none. It
+// overrides Compress, and has no effect on StreamEncode.
+func OfferCodecs(cs ...Codec) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.offers = cs
+	}
+}
+
+// Checksums follows every value, scalars included, with a CRC32C trailer.
+// Streams encoded with checksums can only be decoded with VerifyChecksums.
+func Checksums() EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.checksums = true
+	}
+}
+
+// Encrypt seals the stream in frames authenticated with the AEAD returned
+// by aead, such as AESGCM or ChaCha20Poly1305. Every flush of the encoder,
+// which happens after each value, seals a frame. The key is replaced after
+// rekey frames, or DefaultRekeyInterval if rekey is zero. Compression and
+// checksums apply to the plaintext. StreamEncode fails if the key is longer
+// than 32 bytes or does not suit the AEAD.
+func Encrypt(key []byte, aead AEADFunc, rekey uint64) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.encryption = newEncryption(key, aead, rekey)
+	}
+}
+
+// Heartbeat makes the encoder write a heartbeat whenever nothing has been
+// written for the interval, so the consumer can tell a silent stream from
+// a dead one with IdleTimeout. Every decoder skips heartbeats, but plain
+// protobuf decoders cannot read a stream that has them.
+func Heartbeat(interval time.Duration) EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.heartbeat = interval
+	}
+}
+
+// MaterializeNested makes the encoder write each nested stream message as
+// a single value once it closes, instead of in chunks as it is produced.
+// Use it when the stream is read by decoders that cannot merge the chunks,
+// or need the whole submessage at once.
+func MaterializeNested() EncodeOption {
+	return func(cfg *encodeConfig) {
+		cfg.materialize = true
+	}
+}
+
+// DecodeOption configures how StreamDecode decodes a stream
+type DecodeOption func(*decodeConfig)
+
+type decodeConfig struct {
+	delivery map[byte]FieldInfo
+
+	// grants is where flow control frames are written to the producer
+	grants      io.Writer
+	window      int
+	windowBytes int
+
+	// checkpoint is how many records a resumable decoder receives between
+	// checkpoints
+	checkpoint int
+
+	// checksums verifies the CRC32C trailer of every value
+	checksums  bool
+	corruption CorruptionPolicy
+
+	// encryption opens the frames of an encrypted stream
+	encryption *encryption
+
+	// idleTimeout is how long the decoder waits for data before failing
+	idleTimeout time.Duration
+
+	// maxValueSize is the size limit of a length delimited value
+	maxValueSize int
+
+	// codecs holds the IDs of the codecs the stream may be compressed
+	// with, most preferred first, or is nil to accept any registered codec
+	codecs []byte
+}
+
+// FieldDelivery sets the delivery policy of a repeated field, overriding the
+// one given in its pbs struct tag. Up to buffer decoded values are queued for
+// the consumer of the field, on top of the one being delivered; the policy
+// decides what happens when the queue is full. Policies other than
+// DeliverBlock always queue at least one value. A field with a buffer or a
+// policy other than DeliverBlock is delivered from its own goroutine, so a
+// slow consumer of the field does not hold up the others.
+func FieldDelivery(field int, policy DeliveryPolicy, buffer int) DecodeOption {
+	return func(cfg *decodeConfig) {
+		if cfg.delivery == nil {
+			cfg.delivery = make(map[byte]FieldInfo)
+		}
+		cfg.delivery[byte(field)] = FieldInfo{Delivery: policy, Buffer: buffer}
+	}
+}
+
+// FlowWindow makes the decoder grant flow control credit to an encoder using
+// FlowControl, by writing control frames to w. The producer may have up to
+// values values of each repeated field, and bytes bytes of repeated values
+// in total, in flight before it has to wait for the consumer. Credit is
+// returned as values are handed to the consumer or dropped. A limit of zero
+// means no limit.
+func FlowWindow(w io.Writer, values, bytes int) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.grants = w
+		cfg.window = values
+		cfg.windowBytes = bytes
+	}
+}
+
+// CheckpointEvery makes a resumable decoder acknowledge the records it has
+// received every time another n have arrived. It has no effect on
+// StreamDecode.
+func CheckpointEvery(n int) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.checkpoint = n
+	}
+}
+
+// AcceptCodecs limits the codecs a stream may be compressed with to those
+// with the given IDs. A stream compressed with any other codec fails with a
+// *RejectedCodecError. Without IDs, only uncompressed streams are accepted.
+// HTTPDecode offers the codecs to the server, most preferred first.
+func AcceptCodecs(ids ...byte) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.codecs = append([]byte{}, ids...)
+	}
+}
+
+// VerifyChecksums decodes a stream encoded with Checksums, verifying the
+// checksum of every value before it is set or delivered. The policy
+// decides what happens to a value that does not match.
+func VerifyChecksums(policy CorruptionPolicy) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.checksums = true
+		cfg.corruption = policy
+	}
+}
+
+// Decrypt decodes a stream encrypted with Encrypt, using the same key, AEAD
+// and rekey interval. The stream fails with ErrDecrypt when a frame does
+// not authenticate, and with io.ErrUnexpectedEOF if it was truncated.
+func Decrypt(key []byte, aead AEADFunc, rekey uint64) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.encryption = newEncryption(key, aead, rekey)
+	}
+}
+
+// MaxValueSize sets the size limit of a length delimited value, such as a
+// string or a submessage. The stream fails with ErrValueTooLarge when a
+// value is longer, before anything is allocated for it. Zero means
+// DefaultMaxValueSize.
+func MaxValueSize(n int) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.maxValueSize = n
+	}
+}
+
+// IdleTimeout fails the stream with an *IdleTimeoutError when the decoder
+// waits for data for longer than d. Use it with a producer that sends
+// heartbeats more often than d. If the reader has a SetReadDeadline
+// method, like a net.Conn, the read blocked on it is interrupted.
+func IdleTimeout(d time.Duration) DecodeOption {
+	return func(cfg *decodeConfig) {
+		cfg.idleTimeout = d
+	}
+}
@@ -2,16 +2,124 @@ package pbs
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"io"
 	"reflect"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Wire types of the protobuf encoding.
+//
+// A flow controlled stream (see FlowControl and FlowWindow) also carries
+// control frames in the other direction, from the consumer to the producer.
+// They are encoded like the fields of a message:
+//
+//	1: Window {1: values, 2: bytes}
+//	2: Credit {1: field, 2: values, 3: bytes}
+//
+// Each frame is length delimited and its fields are varints. The consumer
+// first sends a Window, giving the number of values of each repeated field
+// and the number of bytes the producer may have in flight, zero meaning no
+// limit. No repeated values are written before it arrives. Every Credit
+// then returns values of one field and bytes of the window as the consumer
+// takes values off the stream. A Credit for field zero returns bytes only.
+//
+// A Session carries its streams in frames of the same encoding:
+//
+//	1: Open   {1: stream, 2: type}
+//	2: Data   {1: stream, 2: bytes}
+//	3: Close  {1: stream, 2: error}
+//	4: Credit {1: stream, 2: bytes}
+//	5: Reset  {1: stream}
+//
+// Open starts a stream of the named type, Data carries a chunk of its
+// encoding, and Close ends it, with the encoder's error if it failed.
+// Streams opened by the initiator of a session have odd ids, the others
+// even ones. The encoder of a stream may send SessionWindow bytes of Data
+// before the decoder returns them with Credit as it reads them. The end
+// that already has MaxPendingStreams streams waiting to be accepted
+// answers an Open with a Reset.
+//
+// A resumable stream (see ResumableEncode) is carried in numbered records,
+// so it can continue over a new connection after one drops:
+//
+//	1: Hello      {1: token}
+//	2: Record     {1: seq, 2: bytes, 3: end}
+//	3: Checkpoint {1: seq}
+//
+// The encoder opens every connection with a Hello naming the stream, and
+// the decoder answers with a Checkpoint holding the last sequence number
+// it received. The encoder then replays the records after it, and carries
+// on with new ones. The decoder acknowledges records with further
+// Checkpoints, and drops records it has already seen. The last record has
+// end set.
+//
+// A connection to a Server starts with a handshake before the stream:
+//
+//	1: Connect {1: type}
+//	2: Accept  {}
+//	3: Reject  {}
+//
+// The client sends Connect naming the type of the stream, and the server
+// answers with Accept if it has a handler for the type, or Reject before
+// closing the connection. After an Accept, the rest of the connection is
+// the stream.
+//
+// A call made with NewCall is a connection to a Server whose handshake
+// names the method. The rest of the connection is a Session, in which the
+// client opens a stream of type "request" and the server one of type
+// "response". The Close frame of the response carries the error of the
+// call, if it failed.
+//
+// A compressed stream (see Compress) starts with a single byte holding the
+// ID of its Codec, from 1 to 7. The first byte of an uncompressed stream is
+// the tag of a field, which is at least 8, so decoders can tell them apart.
+//
+// An encrypted stream (see Encrypt) starts with a random 16 byte salt,
+// followed by frames each holding a varint length and a sealed AEAD
+// payload. The first byte of the plaintext is 1 for the frame ending the
+// stream, and 0 otherwise; the rest is the plaintext stream, including
+// any codec header. Frames are sealed with nonces counting up from zero,
+// under a key derived from the configured key and the salt with
+// HMAC-SHA256, which is replaced by HMAC-SHA256(key, "pbs rekey") every
+// rekey interval.
+//
+// When the producer closes a repeated field before the rest of the stream,
+// the encoder writes an end marker: a varint field numbered 19000, whose
+// value is the number of the field that ended. Numbers from 19000 to 19999
+// are reserved for protobuf implementations, so no message declares it,
+// and plain protobuf decoders skip it as an unknown field.
+//
+// A singular field holding a StreamMessage is written as a series of length
+// delimited values of the field, each carrying the next chunk of the nested
+// message's encoding, followed by an end marker for the field once the
+// nested message closes. Protobuf merges the values of a singular message
+// field, so plain decoders read the chunks as one submessage. With
+// MaterializeNested, the whole encoding is written as a single value.
+//
+// A oneof is written as a value of the member it is set to. The cases sent
+// on the changes Field of a oneof are written the same way as the stream
+// goes on, and decoders keep the last one, as protobuf does when a message
+// holds more than one member of a oneof.
+//
+// Each value of a packed repeated field is written as a length delimited
+// record of the field holding that value alone. Decoders accept records
+// holding any number of values, as well as unpacked values.
+//
+// In a stream with checksums (see Checksums), every value is followed by
+// the CRC32C (Castagnoli) of its tag, length and contents, as four little
+// endian bytes. The checksum is not a field of its own, so only decoders
+// expecting it can read such a stream.
+//
+// A stream with heartbeats (see Heartbeat) carries single zero bytes
+// between values whenever the encoder has been idle. Zero is not a valid
+// tag, so decoders skip them wherever a tag is expected.
 const (
 	Varint      = 0
 	Int64       = 1
@@ -24,19 +132,57 @@ const (
 type StreamMessage interface {
 	proto.Message
 	io.Closer
-	Errors() chan error
+
+	// Err returns the first error encountered while encoding or decoding
+	// the message, or nil if there was none
+	Err() error
 	Closed() <-chan struct{}
 }
 
+// reportError records err as the error of the stream sm
+func reportError(sm StreamMessage, err error) {
+	if st := getStream(sm); st != nil {
+		st.fail(err)
+		return
+	}
+
+	// messages that do not embed a Stream may still have an error channel
+	if ec, ok := sm.(interface{ Errors() chan error }); ok {
+		select {
+		case ec.Errors() <- err:
+		default:
+		}
+	}
+}
+
 func splitTypeAndField(b byte) (Type, Field byte) {
 	return (b & 0x7), b >> 3
 }
 
-func readLengthDelim(r *bufio.Reader) ([]byte, error) {
+// byteReader is what values are read from
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// DefaultMaxValueSize is the size limit of a length delimited value read
+// by StreamDecode, unless configured otherwise with MaxValueSize
+const DefaultMaxValueSize = 64 << 20
+
+// ErrValueTooLarge is the error a stream fails with when a length delimited
+// value, or a frame, is longer than the reader's size limit
+var ErrValueTooLarge = errors.New("pbs: length delimited value exceeds size limit")
+
+// readLengthDelim reads a length delimited value of at most max bytes. The
+// length is checked before anything is allocated for the value.
+func readLengthDelim(r byteReader, max int) ([]byte, error) {
 	l, err := readVarint(r)
 	if err != nil {
 		return nil, err
 	}
+	if l < 0 || l > max {
+		return nil, ErrValueTooLarge
+	}
 
 	buf := make([]byte, l)
 	_, err = io.ReadFull(r, buf)
@@ -46,9 +192,9 @@ func readLengthDelim(r *bufio.Reader) ([]byte, error) {
 	return buf, nil
 }
 
-func readVarint(r *bufio.Reader) (int, error) {
+func readVarint(r io.ByteReader) (int, error) {
 	var sum int
-	for i := uint(0); i < 4; i++ {
+	for i := uint(0); i < 10; i++ {
 		b, err := r.ReadByte()
 		if err != nil {
 			return 0, err
@@ -57,7 +203,7 @@ func readVarint(r *bufio.Reader) (int, error) {
 		cont := b & 128
 		val := b & 127
 
-		sum += int(val << (7 * i))
+		sum |= int(val) << (7 * i)
 		if cont == 0 {
 			break
 		}
@@ -65,48 +211,147 @@ func readVarint(r *bufio.Reader) (int, error) {
 	return sum, nil
 }
 
+// skipGroup reads past the values of a group of field, up to and including
+// the end of the group. Groups nested in it are skipped along with it.
+func skipGroup(r byteReader, field uint64, max int) error {
+	open := []uint64{field}
+	for len(open) > 0 {
+		tag, err := readVarint(r)
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch typ, f := byte(tag&0x7), uint64(tag)>>3; typ {
+		case Varint:
+			_, err = readVarint(r)
+		case Bit32, Int64:
+			_, err = readFixed(r, typ)
+		case LengthDelim:
+			_, err = readLengthDelim(r, max)
+		case StartGroup:
+			open = append(open, f)
+		case EndGroup:
+			if open[len(open)-1] != f {
+				return fmt.Errorf("pbs: group of field %d ended by field %d", open[len(open)-1], f)
+			}
+			open = open[:len(open)-1]
+		default:
+			return fmt.Errorf("pbs: unsupported wire type %d of field %d", typ, f)
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeScalar sets or delivers a varint or fixed width value of a field.
+// Values of fields the message does not have are skipped.
+func (db *decBuffer) decodeScalar(f, typ byte, x uint64) error {
+	finfo, ok := db.props.FieldMapping[f]
+	if !ok {
+		return nil
+	}
+	if finfo.Oneof != nil {
+		return db.decodeOneof(finfo, typ, x, nil)
+	}
+	field := reflect.ValueOf(db.val).Elem().Field(finfo.GoField)
+
+	if finfo.Repeated {
+		rf, err := getRepeatedField(field)
+		if err != nil {
+			return err
+		}
+
+		nval := reflect.New(rf.elemType()).Elem()
+		err = setWireVal(nval, finfo.Encoding, typ, x, nil)
+		if err != nil {
+			return err
+		}
+		return db.deliver(f, rf, nval, valueSize(typ, int(x)))
+	}
+
+	return setWireVal(field, finfo.Encoding, typ, x, nil)
+}
+
 func (db *decBuffer) decodeField(field byte, data []byte) error {
-	finfo := db.props.FieldMapping[field]
+	size := valueSize(LengthDelim, len(data))
+	finfo, ok := db.props.FieldMapping[field]
+	if !ok {
+		return nil
+	}
 
 	val := reflect.ValueOf(db.val).Elem()
 
 	f := val.Field(finfo.GoField)
 	switch {
-	case f.Type().Kind() == reflect.Chan:
+	case finfo.Stream:
+		return db.decodeNested(field, f, data)
+	case finfo.Oneof != nil:
+		return db.decodeOneof(finfo, LengthDelim, 0, data)
+	case finfo.Repeated:
 		// This is a 'repeated' field
-		// we just encode this value and send it along
+		// we just decode this value and send it along
+		rf, err := getRepeatedField(f)
+		if err != nil {
+			return err
+		}
+		if finfo.Encoding != EncodeBytes {
+			return db.decodePacked(field, finfo, rf, data, size)
+		}
 
-		e := f.Type().Elem()
-		if e.Kind() == reflect.Ptr {
-			e = e.Elem()
+		nval := reflect.New(rf.elemType())
+		if pv, ok := nval.Interface().(mapEntryPtr); ok {
+			err = pv.unmarshalEntry(data, finfo.KeyEncoding, finfo.ValueEncoding)
+		} else {
+			err = setWireVal(nval.Elem(), EncodeBytes, LengthDelim, 0, data)
+		}
+		if err != nil {
+			return err
 		}
+		return db.deliver(field, rf, nval.Elem(), size)
+	default:
+		return setWireVal(f, finfo.Encoding, LengthDelim, 0, data)
+	}
+}
 
-		newVal := reflect.New(e)
-		switch pv := newVal.Interface().(type) {
-		case proto.Message:
-			err := proto.Unmarshal(data, pv)
-			if err != nil {
-				return err
-			}
-			f.Send(newVal)
-		case *string:
-			*pv = string(data)
-			f.Send(newVal.Elem())
-		case *[]byte:
-			*pv = data
-			f.Send(newVal.Elem())
+// decodePacked delivers the values of a record of a packed repeated field,
+// which took size bytes on the wire. The size is credited with the first
+// value of the record.
+func (db *decBuffer) decodePacked(field byte, finfo FieldInfo, rf repeatedField, data []byte, size int) error {
+	typ := finfo.Encoding.wireType()
+	buf := proto.NewBuffer(data)
+	for len(buf.Unread()) > 0 {
+		var x uint64
+		var err error
+		switch typ {
+		case Varint:
+			x, err = buf.DecodeVarint()
+		case Bit32:
+			x, err = buf.DecodeFixed32()
 		default:
-			fmt.Println(reflect.TypeOf(pv))
-			fmt.Println(data)
-			return fmt.Errorf("Unrecognized type in protobuf field decode")
+			x, err = buf.DecodeFixed64()
 		}
-	case f.Type().Elem().Kind() == reflect.String:
-		f.Set(reflect.New(f.Type().Elem()))
-		f.Elem().SetString(string(data))
-	default:
-		fmt.Println("UNKNOWN")
-		fmt.Println(f)
-		return errors.New("TODO: fix this unsupported type")
+		if err != nil {
+			return err
+		}
+
+		nval := reflect.New(rf.elemType()).Elem()
+		err = setWireVal(nval, finfo.Encoding, typ, x, nil)
+		if err != nil {
+			return err
+		}
+		err = db.deliver(field, rf, nval, size)
+		if err != nil {
+			return err
+		}
+		size = 0
 	}
 	return nil
 }
@@ -114,75 +359,470 @@ func (db *decBuffer) decodeField(field byte, data []byte) error {
 type decBuffer struct {
 	props *Props
 	val   StreamMessage
+	ctx   context.Context
+
+	// queues holds the fields with a delivery policy that needs one
+	queues     map[byte]*deliveryQueue
+	deliveries sync.WaitGroup
+
+	// changes holds the queues of the changes Fields of the oneofs, by
+	// the Go field of the oneof
+	changes map[int]*deliveryQueue
+
+	// grants returns flow control credit to the producer, if enabled
+	grants *creditGranter
+
+	// ended holds the repeated fields whose end marker was received
+	ended map[byte]bool
+
+	// nested holds the inputs of the nested stream messages being decoded
+	nested map[byte]*io.PipeWriter
+}
+
+// startDelivery sets up a delivery queue for every repeated field whose
+// policy asks for one
+func (db *decBuffer) startDelivery(cfg *decodeConfig, st *Stream) error {
+	val := reflect.ValueOf(db.val).Elem()
+	for protoField, finfo := range db.props.FieldMapping {
+		if !finfo.Repeated {
+			continue
+		}
+
+		if d, ok := cfg.delivery[protoField]; ok {
+			finfo.Delivery = d.Delivery
+			finfo.Buffer = d.Buffer
+		}
+		if finfo.Delivery == DeliverBlock && finfo.Buffer <= 0 {
+			continue
+		}
+		if finfo.Buffer < 1 {
+			// the other policies need room for the value they drop or
+			// fail on, as the one being delivered cannot be taken back
+			finfo.Buffer = 1
+		}
+
+		rf, err := getRepeatedField(val.Field(finfo.GoField))
+		if err != nil {
+			return err
+		}
+
+		if db.queues == nil {
+			db.queues = make(map[byte]*deliveryQueue)
+		}
+		dq := &deliveryQueue{
+			field:    protoField,
+			policy:   finfo.Delivery,
+			rf:       rf,
+			st:       st,
+			q:        make(chan queuedValue, finfo.Buffer),
+			consumed: db.consumed,
+		}
+		db.queues[protoField] = dq
+
+		db.deliveries.Add(1)
+		go func() {
+			defer db.deliveries.Done()
+			dq.run(db.ctx)
+		}()
+	}
+
+	// a consumer only needs the latest case of a oneof, so its changes
+	// never hold up the stream, and those not yet received when the
+	// stream ends are discarded
+	for of, changes := range db.props.OneofChanges {
+		rf, err := getRepeatedField(val.Field(changes))
+		if err != nil {
+			return err
+		}
+
+		if db.changes == nil {
+			db.changes = make(map[int]*deliveryQueue)
+		}
+
+		dq := &deliveryQueue{
+			policy: DeliverDropOldest,
+			rf:     rf,
+			q:      make(chan queuedValue, 1),
+		}
+		db.changes[of] = dq
+		go dq.run(db.ctx)
+	}
+	return nil
 }
 
-func StreamDecode(r io.Reader, sm StreamMessage) error {
+// deliver hands a decoded value of a repeated field, which took size bytes
+// on the wire, to its consumer
+func (db *decBuffer) deliver(field byte, rf repeatedField, v reflect.Value, size int) error {
+	if db.ended[field] {
+		return fmt.Errorf("pbs: value of field %d after the end of the field", field)
+	}
+
+	if dq, ok := db.queues[field]; ok {
+		return dq.push(db.ctx, queuedValue{v: v, size: size})
+	}
+
+	err := rf.sendValue(db.ctx, v)
+	if err != nil {
+		return err
+	}
+	db.consumed(field, size)
+	return nil
+}
+
+// endField closes a repeated field, or ends a nested stream message, that
+// the producer ended before the rest of the stream. Values queued for the
+// field are delivered first.
+func (db *decBuffer) endField(field byte) error {
+	finfo, ok := db.props.FieldMapping[field]
+	if !ok || db.ended[field] {
+		return nil
+	}
+	if finfo.Stream {
+		return db.endNested(field)
+	}
+	if !finfo.Repeated {
+		return nil
+	}
+
+	rf, err := getRepeatedField(reflect.ValueOf(db.val).Elem().Field(finfo.GoField))
+	if err != nil {
+		return err
+	}
+	if _, bare := rf.(chanField); bare && getStream(db.val) == nil {
+		// the message's own Close closes its channels, and a channel
+		// cannot be closed twice
+		return nil
+	}
+
+	db.markEnded(field)
+
+	if dq, ok := db.queues[field]; ok {
+		delete(db.queues, field)
+		dq.ended = true
+		close(dq.q)
+		return nil
+	}
+	rf.closeField()
+	return nil
+}
+
+// markEnded records that the input of a field has ended
+func (db *decBuffer) markEnded(field byte) {
+	if db.ended == nil {
+		db.ended = make(map[byte]bool)
+	}
+	db.ended[field] = true
+}
+
+// consumed returns the credit for a value that is off the stream, when
+// the stream is flow controlled
+func (db *decBuffer) consumed(field byte, size int) {
+	if db.grants == nil {
+		return
+	}
+
+	err := db.grants.consumed(field, size)
+	if err != nil {
+		db.fail(err)
+	}
+}
+
+// finish waits for every queued value to be delivered, then ends the stream
+func (db *decBuffer) finish(st *Stream) {
+	for _, dq := range db.queues {
+		close(dq.q)
+	}
+	db.deliveries.Wait()
+	for _, dq := range db.changes {
+		close(dq.q)
+	}
+	db.endAllNested()
+
+	if st != nil {
+		db.endInput(st)
+	} else {
+		db.val.Close()
+	}
+}
+
+// fail reports err on the stream being decoded, unless the error was caused
+// by the consumer closing the stream
+func (db *decBuffer) fail(err error) {
+	if err == ErrFieldClosed || db.ctx.Err() != nil {
+		return
+	}
+	if st := getStream(db.val); st != nil {
+		// the context is cancelled asynchronously, after the stream is
+		// already closing
+		select {
+		case <-st.Closing():
+			return
+		default:
+		}
+	}
+	reportError(db.val, err)
+}
+
+// endInput is called when the decoder has no more values to deliver. It
+// closes the repeated fields the decoder was sending on and closes the
+// stream, without calling the message's own Close method.
+func (db *decBuffer) endInput(st *Stream) {
+	val := reflect.ValueOf(db.val).Elem()
+	for field, finfo := range db.props.FieldMapping {
+		if !finfo.Repeated || db.ended[field] {
+			continue
+		}
+
+		rf, err := getRepeatedField(val.Field(finfo.GoField))
+		if err != nil {
+			continue
+		}
+		rf.closeField()
+	}
+	for _, changes := range db.props.OneofChanges {
+		rf, err := getRepeatedField(val.Field(changes))
+		if err != nil {
+			continue
+		}
+		rf.closeField()
+	}
+	st.Close()
+}
+
+// StreamDecode starts decoding the stream read from r into sm. Scalar fields
+// are set on sm as they arrive, and the values of repeated fields are sent on
+// their channels. Once the input ends, the repeated fields are closed.
+// If sm embeds a *Stream, its repeated fields become receive-only.
+func StreamDecode(r io.Reader, sm StreamMessage, opts ...DecodeOption) error {
+	cfg := new(decodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.maxValueSize <= 0 {
+		cfg.maxValueSize = DefaultMaxValueSize
+	}
+
 	props, err := GetProperties(sm)
 	if err != nil {
 		return err
 	}
+	if cfg.encryption != nil && cfg.encryption.err != nil {
+		return cfg.encryption.err
+	}
+	if err := checkStream(sm); err != nil {
+		return err
+	}
+
+	st := getStream(sm)
+	if st != nil {
+		err := st.bind(roleDecoder)
+		if err != nil {
+			return err
+		}
+
+		// the decoder is now the only sender on the repeated fields
+		val := reflect.ValueOf(sm).Elem()
+		for _, finfo := range props.FieldMapping {
+			if !finfo.Repeated {
+				continue
+			}
+
+			rf, err := getRepeatedField(val.Field(finfo.GoField))
+			if err != nil {
+				return err
+			}
+			rf.setDecoding()
+		}
+		for _, changes := range props.OneofChanges {
+			rf, err := getRepeatedField(val.Field(changes))
+			if err != nil {
+				return err
+			}
+			rf.setDecoding()
+		}
+	}
+
+	db := &decBuffer{
+		props: props,
+		val:   sm,
+		ctx:   context.Background(),
+	}
+	if cfg.grants != nil {
+		db.grants = newCreditGranter(cfg.grants, cfg.window, cfg.windowBytes)
+	}
+
+	var cancel context.CancelFunc
+	if st != nil {
+		// stop sending to the consumer as soon as it closes the stream
+		db.ctx, cancel = st.context()
+	}
+
+	err = db.startDelivery(cfg, st)
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return err
+	}
 
 	go func() {
-		defer sm.Close()
+		if cfg.idleTimeout > 0 {
+			ir := newIdleReader(r, cfg.idleTimeout)
+			defer ir.stop()
+			r = ir
+		}
 		read := bufio.NewReader(r)
 
-		db := decBuffer{
-			props: props,
-			val:   sm,
+		if cancel != nil {
+			defer cancel()
+		}
+		defer db.finish(st)
+
+		if db.grants != nil {
+			err := db.grants.start()
+			if err != nil {
+				db.fail(err)
+				return
+			}
+		}
+
+		// plain is the decrypted stream, which is read to its end frame
+		// even when a compressed stream inside it has already ended
+		var plain *bufio.Reader
+		if cfg.encryption != nil {
+			plain = newDecryptReader(read, cfg.encryption)
+			read = plain
+		}
+		end := func() {
+			if plain == nil {
+				return
+			}
+			_, err := io.Copy(io.Discard, plain)
+			if err != nil {
+				db.fail(err)
+			}
+		}
+
+		read, err := decompressReader(read, cfg.codecs)
+		if err != nil {
+			db.fail(err)
+			return
 		}
+
+		var src byteReader = read
+		var cr *checksumReader
+		if cfg.checksums {
+			cr = &checksumReader{r: read}
+			src = cr
+		}
+
 		for {
-			b, err := read.ReadByte()
+			if cr != nil {
+				cr.start()
+			}
+
+			b, err := src.ReadByte()
 			if err != nil {
 				if err == io.EOF {
+					end()
 					return
 				}
-				sm.Errors() <- err
+				db.fail(err)
 				return
 			}
 
-			typ, f := splitTypeAndField(b)
-			switch typ {
-			case Varint:
-				i, err := readVarint(read)
+			if b == heartbeatTag {
+				continue
+			}
+
+			tag := uint64(b)
+			if b&0x80 != 0 {
+				rest, err := readVarint(src)
 				if err != nil {
-					sm.Errors() <- err
+					db.fail(err)
 					return
 				}
+				tag = uint64(b&0x7f) | uint64(rest)<<7
+			}
 
-				field := reflect.ValueOf(sm).Elem().Field(props.FieldMapping[f].GoField)
+			ending := tag == endFieldTag
+			if !ending && tag>>3 > maxFieldNumber {
+				db.fail(fmt.Errorf("pbs: unsupported field number %d", tag>>3))
+				return
+			}
+			typ, f := byte(tag&0x7), byte(tag>>3)
 
-				fmt.Println("proto field: ", f)
-				fmt.Println("FIELD: ", field)
-				elemType := field.Type()
-				if elemType.Kind() == reflect.Chan {
-					elemType = elemType.Elem()
+			var x uint64
+			var val []byte
+			switch typ {
+			case Varint:
+				i, err := readVarint(src)
+				if err != nil {
+					db.fail(err)
+					return
 				}
-				fmt.Println("elemtype: ", elemType)
-
-				nval := reflect.New(elemType.Elem())
-				nval.Elem().SetInt(int64(i))
-
-				if props.FieldMapping[f].Repeated {
-					field.Send(nval.Elem())
-				} else {
-					field.Set(nval)
+				x = uint64(i)
+			case Bit32, Int64:
+				x, err = readFixed(src, typ)
+				if err != nil {
+					db.fail(err)
+					return
 				}
 			case LengthDelim:
-				val, err := readLengthDelim(read)
+				val, err = readLengthDelim(src, cfg.maxValueSize)
 				if err != nil {
 					if err == io.EOF {
+						end()
 						return
 					}
-					sm.Errors() <- err
+					if err == ErrValueTooLarge && cr != nil {
+						// the length is corrupt, so there is no telling
+						// where the next value starts
+						err = &CorruptionError{Field: int(f), Offset: cr.begin}
+					}
+					db.fail(err)
 					return
 				}
-				err = db.decodeField(f, val)
+			case StartGroup:
+				// groups are not supported, and are skipped whatever
+				// their field
+				err = skipGroup(src, tag>>3, cfg.maxValueSize)
 				if err != nil {
-					sm.Errors() <- err
+					db.fail(err)
 					return
 				}
 			default:
-				fmt.Println("unrecognized type: ", typ)
+				db.fail(fmt.Errorf("pbs: unsupported wire type %d of field %d", typ, tag>>3))
+				return
+			}
+
+			if cr != nil {
+				field := int(f)
+				if ending {
+					field = endFieldNumber
+				}
+
+				err := cr.verify(field)
+				if err != nil {
+					if _, ok := err.(*CorruptionError); ok && cfg.corruption == CorruptSkip {
+						continue
+					}
+					db.fail(err)
+					return
+				}
+			}
+
+			switch {
+			case ending:
+				err = db.endField(byte(x))
+			case typ == StartGroup:
+			case typ == LengthDelim:
+				err = db.decodeField(f, val)
+			default:
+				err = db.decodeScalar(f, typ, x)
+			}
+			if err != nil {
+				db.fail(err)
 				return
 			}
 		}
@@ -190,8 +830,18 @@ func StreamDecode(r io.Reader, sm StreamMessage) error {
 	return nil
 }
 
-func combineTypeAndField(typ, field byte) byte {
-	return (field << 3) | (typ & 0x7)
+// endFieldNumber is the field number of the end of field marker
+const endFieldNumber = 19000
+
+// endFieldTag is the tag of the end of field marker
+const endFieldTag = endFieldNumber<<3 | Varint
+
+// maxFieldNumber is the largest field number a message may use
+const maxFieldNumber = 255
+
+// combineTypeAndField returns the varint encoded tag of a value of field
+func combineTypeAndField(typ, field byte) []byte {
+	return proto.EncodeVarint(uint64(field)<<3 | uint64(typ&0x7))
 }
 
 func writeLengthDelimited(w io.Writer, field byte, data []byte) error {
@@ -220,12 +870,12 @@ func writeLengthDelimited(w io.Writer, field byte, data []byte) error {
 	return nil
 }
 
-func writeTag(w io.Writer, tag byte) error {
-	n, err := w.Write([]byte{tag})
+func writeTag(w io.Writer, tag []byte) error {
+	n, err := w.Write(tag)
 	if err != nil {
 		return err
 	}
-	if n != 1 {
+	if n != len(tag) {
 		return errors.New("failed to write tag")
 	}
 	return nil
@@ -249,54 +899,33 @@ func writeVarint(w io.Writer, field byte, v uint64) error {
 	return nil
 }
 
-func writeProtoVal(w io.Writer, sm StreamMessage, field byte, val interface{}) error {
-	switch val := val.(type) {
-	case proto.Message:
-		data, err := proto.Marshal(val)
-		if err != nil {
-			return err
-		}
-
-		err = writeLengthDelimited(w, field, data)
-		if err != nil {
-			return err
-		}
-	case string:
-		err := writeLengthDelimited(w, field, []byte(val))
-		if err != nil {
-			return err
-		}
-	case []byte:
-		err := writeLengthDelimited(w, field, val)
+// writeProtoVal writes a single value of a field, encoded as the field's
+// struct tag says. A value of a packed field is written as a record
+// holding that value alone.
+func writeProtoVal(w io.Writer, field byte, finfo FieldInfo, val interface{}) error {
+	if e, ok := val.(mapEntry); ok {
+		data, err := e.marshalEntry(finfo.KeyEncoding, finfo.ValueEncoding)
 		if err != nil {
 			return err
 		}
-	case int32:
-		err := writeVarint(w, field, uint64(val))
-		if err != nil {
-			return err
-		}
-	case int64:
-		err := writeVarint(w, field, uint64(val))
-		if err != nil {
-			return err
-		}
-	case bool:
-		var boolval uint64
-		if val {
-			boolval = 1
-		}
+		return writeLengthDelimited(w, field, data)
+	}
 
-		err := writeVarint(w, field, boolval)
+	if finfo.Packed {
+		data, err := appendWireVal(nil, finfo.Encoding, val)
 		if err != nil {
 			return err
 		}
-	default:
-		fmt.Println("UNRECOGNIZED REPEATED FIELD TYPE", reflect.TypeOf(val))
-		return errors.New("unrecognized repeated field type")
+		return writeLengthDelimited(w, field, data)
 	}
 
-	return nil
+	tag := combineTypeAndField(finfo.Encoding.wireType(), field)
+	data, err := appendWireVal(tag, finfo.Encoding, val)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 // StreamEncode will perform a streaming encode of the given protobuf
@@ -304,60 +933,344 @@ func writeProtoVal(w io.Writer, sm StreamMessage, field byte, val interface{}) e
 // return when all non-channel fields have been encoded, and goroutines
 // will be spawned for the encoding of the channeled values. Those goroutines
 // will receive on the channels and send values along as they get them until
-// the StreamMessage is closed
-func StreamEncode(w io.Writer, sm StreamMessage) error {
+// the StreamMessage is closed. If the message embeds a *Stream, its Closed
+// channel is not closed until every value has been written out.
+func StreamEncode(w io.Writer, sm StreamMessage, opts ...EncodeOption) error {
+	cfg := new(encodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+
 	// Parse out the protobuf struct tags
 	props, err := GetProperties(sm)
 	if err != nil {
 		return err
 	}
+	if cfg.encryption != nil && cfg.encryption.err != nil {
+		return cfg.encryption.err
+	}
+	if err := checkStream(sm); err != nil {
+		return err
+	}
 
 	val := reflect.ValueOf(sm).Elem()
 
-	se := &streamEncoder{out: w, sm: sm}
+	se := &streamEncoder{out: w, sm: sm, st: getStream(sm), props: props, checksums: cfg.checksums}
+	if cfg.credits != nil {
+		se.gate = newCreditGate(cfg.credits)
+	}
+	if se.st != nil {
+		err := se.st.bind(roleEncoder)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.encryption != nil {
+		ew, err := newEncryptWriter(se.out, cfg.encryption)
+		if err != nil {
+			return err
+		}
+		se.push(ew)
+	}
+	if cfg.codec != nil {
+		cw, err := compressWriter(se.out, cfg.codec)
+		if err != nil {
+			return err
+		}
+		se.push(cw)
+	}
 
+	repeated := make(map[byte]repeatedField)
+	nested := make(map[byte]StreamMessage)
 	for protoField, fprop := range props.FieldMapping {
 		field := val.Field(fprop.GoField)
 		if fprop.Repeated {
-			// Sanity check
-			if field.Kind() != reflect.Chan {
-				return errors.New("repeated field was not a channel")
+			rf, err := getRepeatedField(field)
+			if err != nil {
+				return err
 			}
 
-			go se.handleChannelIn(protoField, field)
-
+			repeated[protoField] = rf
+		} else if fprop.Stream {
+			if !field.IsNil() {
+				nested[protoField] = field.Interface().(StreamMessage)
+			}
 		} else {
+			if fprop.Proto3 && fprop.Oneof == nil && isZeroField(field) {
+				// the field is unset, or holds its zero value
+				continue
+			}
+			if fprop.Oneof != nil {
+				if field.IsNil() || field.Elem().Type() != fprop.Oneof {
+					// the oneof is unset, or set to another member
+					continue
+				}
+				field = field.Elem().Elem().Field(0)
+			}
+			if (field.Kind() == reflect.Ptr || field.Kind() == reflect.Slice) && field.IsNil() {
+				// optional field that was never set
+				continue
+			}
 			if field.Kind() == reflect.Ptr {
 				field = field.Elem()
 			}
-			err := writeProtoVal(w, sm, protoField, field.Interface())
+			buf, err := se.encode(protoField, field.Interface())
+			if err != nil {
+				return err
+			}
+			_, err = se.out.Write(buf)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	changes := make(map[repeatedField]map[reflect.Type]byte)
+	for oneof, i := range props.OneofChanges {
+		rf, err := getRepeatedField(val.Field(i))
+		if err != nil {
+			return err
+		}
+		changes[rf] = props.oneofMembers(oneof)
+		se.changes = append(se.changes, rf)
+	}
+
+	err = se.flush()
+	if err != nil {
+		return err
+	}
+	se.last = time.Now()
+
+	se.repeated = repeated
+	if cfg.selectEncoder {
+		se.spawn(func() { se.handleSelect(cfg) })
+	} else {
+		for protoField, rf := range repeated {
+			protoField, rf := protoField, rf
+			se.spawn(func() { se.handleChannelIn(protoField, rf) })
+		}
+	}
+
+	for rf, members := range changes {
+		rf, members := rf, members
+		se.spawn(func() { se.handleChanges(rf, members) })
+	}
+
+	for protoField, sub := range nested {
+		protoField, sub := protoField, sub
+		se.spawn(func() { se.handleNested(protoField, sub, cfg.materialize) })
+	}
+
+	if cfg.heartbeat > 0 {
+		se.spawn(func() { se.heartbeat(cfg.heartbeat) })
+	}
+
+	if len(se.layers) > 0 {
+		// the layers are closed once every value has gone through them
+		if se.st != nil {
+			se.st.attach()
+		}
+		go se.closeLayers()
+	}
 	return nil
 }
 
+// isZeroField returns whether a singular field is nil or holds the zero
+// value of its type, an empty string or slice included
+func isZeroField(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
 // streamEncoder is a helper struct to ensure that concurrent writes
 // dont get intermingled.
 type streamEncoder struct {
-	out io.Writer
-	sm  StreamMessage
-	lk  sync.Mutex
+	out      io.Writer
+	sm       StreamMessage
+	st       *Stream
+	props    *Props
+	repeated map[byte]repeatedField
+	changes  []repeatedField
+	lk       sync.Mutex
+	failed   bool
+
+	// gate holds back repeated values until the consumer grants credit
+	// for them, if the stream is flow controlled
+	gate *creditGate
+
+	// layers are the writers layered on top of the output, such as a
+	// compressor, outermost first. They are flushed after every value, and
+	// closed at the end of the stream.
+	layers  []FlushWriteCloser
+	workers sync.WaitGroup
+
+	// checksums adds a checksum to every value
+	checksums bool
+
+	// last is when a value was last written
+	last time.Time
+}
+
+// spawn starts an encoder goroutine, registering it as a worker of the
+// stream
+func (se *streamEncoder) spawn(f func()) {
+	if se.st != nil {
+		se.st.attach()
+	}
+	se.workers.Add(1)
+	go func() {
+		defer se.workers.Done()
+		f()
+	}()
+}
+
+// push layers l on top of the output
+func (se *streamEncoder) push(l FlushWriteCloser) {
+	se.out = l
+	se.layers = append([]FlushWriteCloser{l}, se.layers...)
+}
+
+// flush flushes the output's layers, if there are any
+func (se *streamEncoder) flush() error {
+	for _, l := range se.layers {
+		err := l.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeLayers closes the output's layers once every encoder goroutine is
+// done
+func (se *streamEncoder) closeLayers() {
+	if se.st != nil {
+		defer se.st.detach()
+	}
+	se.workers.Wait()
+
+	se.lk.Lock()
+	defer se.lk.Unlock()
+
+	if se.failed {
+		return
+	}
+	for _, l := range se.layers {
+		err := l.Close()
+		if err != nil {
+			se.fail(err)
+			return
+		}
+	}
 }
 
-func (se *streamEncoder) handleChannelIn(field byte, ch reflect.Value) {
+func (se *streamEncoder) handleChannelIn(field byte, ch repeatedField) {
+	var done <-chan struct{}
+	if se.st != nil {
+		defer se.st.detach()
+		done = se.st.Closing()
+	}
+
 	for {
-		val, ok := ch.Recv()
+		val, ok := ch.recvValue(done)
 		if !ok {
+			select {
+			case <-done:
+			default:
+				// the producer closed the field, not the whole stream
+				se.end(field)
+			}
 			return
 		}
 
-		se.lk.Lock()
-		writeProtoVal(se.out, se.sm, field, val.Interface())
-		se.lk.Unlock()
+		se.write(field, val)
+	}
+}
+
+// write encodes a single value of a repeated field, unless a previous write
+// has already failed
+func (se *streamEncoder) write(field byte, val reflect.Value) {
+	buf, err := se.encode(field, val.Interface())
+	if err == nil && se.gate != nil {
+		// wait for credit without holding up the other fields
+		err = se.gate.acquire(field, len(buf))
+	}
+
+	se.put(buf, err)
+}
+
+// end writes the marker ending a repeated field whose producer closed it
+func (se *streamEncoder) end(field byte) {
+	buf := append(proto.EncodeVarint(endFieldTag), proto.EncodeVarint(uint64(field))...)
+	if se.checksums {
+		buf = appendChecksum(buf)
+	}
+	se.put(buf, nil)
+}
+
+// errEncoderFailed is returned by put once the encoder has failed
+var errEncoderFailed = errors.New("pbs: stream encoder failed")
+
+// put writes an encoded value, or fails the stream with err if encoding
+// it failed. It returns an error if the value was not written.
+func (se *streamEncoder) put(buf []byte, err error) error {
+	se.lk.Lock()
+	defer se.lk.Unlock()
+
+	if se.failed {
+		return errEncoderFailed
+	}
+
+	if err == nil {
+		_, err = se.out.Write(buf)
+	}
+	if err == nil {
+		err = se.flush()
+	}
+	if err != nil {
+		se.fail(err)
+	}
+	se.last = time.Now()
+	return err
+}
+
+// encode returns the encoding of a single value of a field, with its
+// checksum if the stream has them
+func (se *streamEncoder) encode(field byte, val interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := writeProtoVal(buf, field, se.props.FieldMapping[field], val)
+	if err != nil {
+		return nil, err
+	}
+
+	if se.checksums {
+		return appendChecksum(buf.Bytes()), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// fail reports a write error on the stream. Nothing more is written after
+// a failure, and any Field values are closed so producers stop sending.
+// It must be called with se.lk held.
+func (se *streamEncoder) fail(err error) {
+	se.failed = true
+	reportError(se.sm, err)
+
+	if se.gate != nil {
+		se.gate.abort(err)
+	}
+
+	for _, rf := range se.repeated {
+		// a bare channel belongs to the producer, only it may close it
+		if _, ok := rf.(chanField); !ok {
+			rf.closeField()
+		}
+	}
+	for _, rf := range se.changes {
+		rf.closeField()
 	}
 }
 
@@ -366,41 +1279,126 @@ type FieldInfo struct {
 	GoField  int
 	Repeated bool
 	Type     string
+
+	// Encoding is how the values of the field are written, as its struct
+	// tag says, and KeyEncoding and ValueEncoding those of the keys and
+	// values of a map field
+	Encoding      Encoding
+	KeyEncoding   Encoding
+	ValueEncoding Encoding
+
+	// Packed is set for a repeated scalar field whose values are written
+	// in length delimited records
+	Packed bool
+
+	// Proto3 is set for a field of a proto3 message. Such a field held by
+	// value is not written while it holds its zero value, which decoders
+	// cannot tell apart from an unset field.
+	Proto3 bool
+
+	// Name, JSONName, Enum and Default are the options of the struct tag
+	Name     string
+	JSONName string
+	Enum     string
+	Default  string
+
+	// Delivery and Buffer are set from the pbs struct tag of a repeated
+	// field, and control how decoded values are handed to its consumer
+	Delivery DeliveryPolicy
+	Buffer   int
+
+	// Stream is set for a singular field holding a StreamMessage, which
+	// is streamed along with the message rather than marshalled whole
+	Stream bool
+
+	// Oneof is the wrapper type of a member of a oneof, in which case
+	// GoField is the interface field holding the oneof's case
+	Oneof reflect.Type
+}
+
+// setTag sets the information given by the protobuf struct tag of a field
+func (fi *FieldInfo) setTag(tag *fieldTag) {
+	fi.Repeated = tag.label == "rep"
+	fi.Type = tag.typ
+	fi.Encoding = tag.encoding
+	fi.Packed = tag.packed
+	fi.Proto3 = tag.proto3
+	fi.Name = tag.name
+	fi.JSONName = tag.jsonName
+	fi.Enum = tag.enum
+	fi.Default = tag.def
 }
 
 type Props struct {
 	// A mapping from the protobuf field number to field info
 	FieldMapping map[byte]FieldInfo
+
+	// OneofChanges maps the interface field of a oneof to the Field its
+	// changes are streamed on, for the oneofs that have one
+	OneofChanges map[int]int
 }
 
 func GetProperties(i proto.Message) (*Props, error) {
 	t := reflect.TypeOf(i).Elem()
 
 	props := &Props{FieldMapping: make(map[byte]FieldInfo)}
+	oneofs := make(map[string]int)
+	changes := make(map[string]int)
 	for i := 0; i < t.NumField(); i++ {
 		field := FieldInfo{GoField: i}
 
-		tag := t.Field(i).Tag.Get("protobuf")
-		if len(tag) == 0 {
+		if name := t.Field(i).Tag.Get("protobuf_oneof"); name != "" {
+			oneofs[name] = i
+			continue
+		}
+		if name, ok := strings.CutPrefix(t.Field(i).Tag.Get("pbs"), "oneof="); ok {
+			changes[name] = i
 			continue
 		}
 
-		parts := strings.Split(tag, ",")
-		if len(parts) < 3 {
-			return nil, errors.New("not enough values in protobuf field tag")
+		ptag := t.Field(i).Tag.Get("protobuf")
+		if len(ptag) == 0 {
+			continue
 		}
 
-		n, err := strconv.Atoi(parts[1])
+		tag, err := parseTag(ptag)
 		if err != nil {
 			return nil, err
 		}
+		field.setTag(tag)
 
-		if parts[2] == "rep" {
-			field.Repeated = true
+		// map fields give the encodings of their keys and values
+		for _, kv := range []struct {
+			name string
+			enc  *Encoding
+		}{{"protobuf_key", &field.KeyEncoding}, {"protobuf_val", &field.ValueEncoding}} {
+			if s := t.Field(i).Tag.Get(kv.name); s != "" {
+				ktag, err := parseTag(s)
+				if err != nil {
+					return nil, err
+				}
+				*kv.enc = ktag.encoding
+			}
 		}
 
-		field.Type = parts[0]
-		props.FieldMapping[byte(n)] = field
+		if !field.Repeated && t.Field(i).Type.Implements(streamMessageType) {
+			field.Stream = true
+		}
+
+		if ptag := t.Field(i).Tag.Get("pbs"); ptag != "" {
+			err := parseDeliveryTag(ptag, &field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		props.FieldMapping[byte(tag.number)] = field
+	}
+
+	if len(oneofs) > 0 || len(changes) > 0 {
+		err := getOneofs(i, props, oneofs, changes)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return props, nil
 }
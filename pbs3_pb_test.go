@@ -0,0 +1,115 @@
+package pbs_test
+
+import "github.com/golang/protobuf/proto"
+import "github.com/whyrusleeping/go-pbs"
+
+type TestProto3 struct {
+	Name string `protobuf:"string,1,opt,name=name,proto3"`
+	Count int32 `protobuf:"int32,2,opt,name=count,proto3"`
+	Limit *int32 `protobuf:"int32,3,opt,name=limit,proto3"`
+	Samples *pbs.Field[int64] `protobuf:"sint64,4,rep,packed,name=samples,proto3"`
+	Tags *pbs.Field[string] `protobuf:"string,5,rep,name=tags,proto3"`
+	Done bool `protobuf:"bool,6,opt,name=done,proto3"`
+	Level TestProto3_Level `protobuf:"Level,7,opt,name=level,enum=TestProto3_Level,proto3"`
+	*pbs.Stream
+}
+
+func NewTestProto3() *TestProto3 {
+	return &TestProto3{
+		Stream: pbs.NewStream(),
+		Samples: pbs.NewField[int64](),
+		Tags: pbs.NewField[string](),
+	}
+}
+func (m *TestProto3) Close() error {
+	err := m.Stream.Close()
+	m.Samples.Close()
+	m.Tags.Close()
+	return err
+}
+
+func (*TestProto3) ProtoMessage() {}
+
+func (m *TestProto3) String() string {return proto.CompactTextString(m)}
+
+func (m *TestProto3) Reset() {*m = *NewTestProto3()}
+
+var _ pbs.StreamMessage = (*TestProto3)(nil)
+
+// TestProto3Producer is the producer view of a TestProto3 stream
+type TestProto3Producer struct {
+	Samples pbs.Sender[int64]
+	Tags pbs.Sender[string]
+	m *TestProto3
+}
+
+func (m *TestProto3) Producer() *TestProto3Producer {
+	return &TestProto3Producer{
+		Samples: m.Samples,
+		Tags: m.Tags,
+		m: m,
+	}
+}
+
+func (v *TestProto3Producer) Close() error { return v.m.Close() }
+
+func (v *TestProto3Producer) Err() error { return v.m.Err() }
+
+func (v *TestProto3Producer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestProto3Producer) Source() pbs.StreamMessage { return v.m }
+
+var _ pbs.Producer = (*TestProto3Producer)(nil)
+
+// TestProto3Consumer is the consumer view of a TestProto3 stream
+type TestProto3Consumer struct {
+	Samples pbs.Receiver[int64]
+	Tags pbs.Receiver[string]
+	m *TestProto3
+}
+
+func (m *TestProto3) Consumer() *TestProto3Consumer {
+	return &TestProto3Consumer{
+		Samples: m.Samples,
+		Tags: m.Tags,
+		m: m,
+	}
+}
+
+func (v *TestProto3Consumer) Close() error { return v.m.Close() }
+
+func (v *TestProto3Consumer) Err() error { return v.m.Err() }
+
+func (v *TestProto3Consumer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestProto3Consumer) Sink() pbs.StreamMessage { return v.m }
+
+var _ pbs.Consumer = (*TestProto3Consumer)(nil)
+
+type TestProto3_Level int32
+
+const (
+	TestProto3_NONE TestProto3_Level = 0
+	TestProto3_SOME TestProto3_Level = 1
+)
+
+var TestProto3_Level_name = map[int32]string{
+	0: "NONE",
+	1: "SOME",
+}
+
+var TestProto3_Level_value = map[string]int32{
+	"NONE": 0,
+	"SOME": 1,
+}
+
+func (x TestProto3_Level) Enum() *TestProto3_Level {
+	p := new(TestProto3_Level)
+	*p = x
+	return p
+}
+
+func (x TestProto3_Level) String() string {
+	return proto.EnumName(TestProto3_Level_name, int32(x))
+}
+
@@ -1,44 +1,68 @@
 package pbs_test
 
+import "context"
 import "github.com/golang/protobuf/proto"
 import "github.com/whyrusleeping/go-pbs"
 
+type Mood int32
+
+const (
+	Mood_CALM Mood = 0
+	Mood_ANGRY Mood = 1
+	Mood_SLEEPY Mood = 2
+)
+
+var Mood_name = map[int32]string{
+	0: "CALM",
+	1: "ANGRY",
+	2: "SLEEPY",
+}
+
+var Mood_value = map[string]int32{
+	"CALM": 0,
+	"ANGRY": 1,
+	"SLEEPY": 2,
+}
+
+func (x Mood) Enum() *Mood {
+	p := new(Mood)
+	*p = x
+	return p
+}
+
+func (x Mood) String() string {
+	return proto.EnumName(Mood_name, int32(x))
+}
+
 type TestMessage struct {
-	Tsubm chan *TestMessage_TestSubMessage `protobuf:"TestSubMessage,1,rep,name=tsubm"`
-	Repint chan int32 `protobuf:"int32,2,rep,name=repint"`
-	Repbytes chan []byte `protobuf:"bytes,8,rep,name=repbytes"`
-	Repstring chan string `protobuf:"string,9,rep,name=repstring"`
+	Tsubm *pbs.Field[*TestMessage_TestSubMessage] `protobuf:"TestSubMessage,1,rep,name=tsubm"`
+	Repint *pbs.Field[int32] `protobuf:"int32,2,rep,name=repint"`
+	Repbytes *pbs.Field[[]byte] `protobuf:"bytes,8,rep,name=repbytes"`
+	Repstring *pbs.Field[string] `protobuf:"string,9,rep,name=repstring"`
 	A *int32 `protobuf:"int32,3,opt,name=a"`
 	B *string `protobuf:"string,4,opt,name=b"`
 	C *int64 `protobuf:"int64,5,req,name=c"`
 	D *bool `protobuf:"bool,6,opt,name=d"`
 	E []byte `protobuf:"bytes,7,opt,name=e"`
-	errors chan error
-	closeCh chan struct{}
+	*pbs.Stream
 }
 
 func NewTestMessage() *TestMessage {
 	return &TestMessage{
-		errors: make(chan error, 1),
-		closeCh: make(chan struct{}),
-		Tsubm: make(chan *TestMessage_TestSubMessage),
-		Repint: make(chan int32),
-		Repbytes: make(chan []byte),
-		Repstring: make(chan string),
+		Stream: pbs.NewStream(),
+		Tsubm: pbs.NewField[*TestMessage_TestSubMessage](),
+		Repint: pbs.NewField[int32](),
+		Repbytes: pbs.NewField[[]byte](),
+		Repstring: pbs.NewField[string](),
 	}
 }
-func (m *TestMessage) Errors() chan error { return m.errors }
-
-func (m *TestMessage) Closed() <-chan struct{} { return m.closeCh }
-
 func (m *TestMessage) Close() error {
-	close(m.Tsubm)
-	close(m.Repint)
-	close(m.Repbytes)
-	close(m.Repstring)
-	close(m.errors)
-	close(m.closeCh)
-	return nil
+	err := m.Stream.Close()
+	m.Tsubm.Close()
+	m.Repint.Close()
+	m.Repbytes.Close()
+	m.Repstring.Close()
+	return err
 }
 
 func (*TestMessage) ProtoMessage() {}
@@ -49,6 +73,64 @@ func (m *TestMessage) Reset() {*m = *NewTestMessage()}
 
 var _ pbs.StreamMessage = (*TestMessage)(nil)
 
+// TestMessageProducer is the producer view of a TestMessage stream
+type TestMessageProducer struct {
+	Tsubm pbs.Sender[*TestMessage_TestSubMessage]
+	Repint pbs.Sender[int32]
+	Repbytes pbs.Sender[[]byte]
+	Repstring pbs.Sender[string]
+	m *TestMessage
+}
+
+func (m *TestMessage) Producer() *TestMessageProducer {
+	return &TestMessageProducer{
+		Tsubm: m.Tsubm,
+		Repint: m.Repint,
+		Repbytes: m.Repbytes,
+		Repstring: m.Repstring,
+		m: m,
+	}
+}
+
+func (v *TestMessageProducer) Close() error { return v.m.Close() }
+
+func (v *TestMessageProducer) Err() error { return v.m.Err() }
+
+func (v *TestMessageProducer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestMessageProducer) Source() pbs.StreamMessage { return v.m }
+
+var _ pbs.Producer = (*TestMessageProducer)(nil)
+
+// TestMessageConsumer is the consumer view of a TestMessage stream
+type TestMessageConsumer struct {
+	Tsubm pbs.Receiver[*TestMessage_TestSubMessage]
+	Repint pbs.Receiver[int32]
+	Repbytes pbs.Receiver[[]byte]
+	Repstring pbs.Receiver[string]
+	m *TestMessage
+}
+
+func (m *TestMessage) Consumer() *TestMessageConsumer {
+	return &TestMessageConsumer{
+		Tsubm: m.Tsubm,
+		Repint: m.Repint,
+		Repbytes: m.Repbytes,
+		Repstring: m.Repstring,
+		m: m,
+	}
+}
+
+func (v *TestMessageConsumer) Close() error { return v.m.Close() }
+
+func (v *TestMessageConsumer) Err() error { return v.m.Err() }
+
+func (v *TestMessageConsumer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestMessageConsumer) Sink() pbs.StreamMessage { return v.m }
+
+var _ pbs.Consumer = (*TestMessageConsumer)(nil)
+
 type TestMessage_TestSubMessage struct {
 	X *string `protobuf:"string,1,opt,name=x"`
 	Y []uint32 `protobuf:"uint32,2,rep,name=y"`
@@ -66,3 +148,674 @@ func (m *TestMessage_TestSubMessage) Reset() {*m = *NewTestMessage_TestSubMessag
 
 var _ proto.Message = (*TestMessage_TestSubMessage)(nil)
 
+type TestEnvelope struct {
+	Name *string `protobuf:"string,1,opt,name=name"`
+	Body *TestMessage `protobuf:"TestMessage,2,opt,name=body"`
+	Notes *pbs.Field[string] `protobuf:"string,3,rep,name=notes"`
+	Counts *pbs.Field[pbs.MapEntry[string, int32]] `protobuf:"bytes,4,rep,name=counts" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Attachments *pbs.Field[*TestEnvelope_Attachment] `protobuf:"Attachment,5,rep,name=attachments"`
+	Priority *TestEnvelope_Priority `protobuf:"Priority,9,opt,name=priority,enum=TestEnvelope_Priority"`
+	Moods *pbs.Field[Mood] `protobuf:"Mood,10,rep,name=moods,enum=Mood"`
+	// Types that are valid to be assigned to Event:
+	//	*TestEnvelope_Text
+	//	*TestEnvelope_Code
+	//	*TestEnvelope_File
+	Event isTestEnvelope_Event `protobuf_oneof:"event"`
+	EventChanges *pbs.Field[isTestEnvelope_Event] `pbs:"oneof=event"`
+	*pbs.Stream
+}
+
+func NewTestEnvelope() *TestEnvelope {
+	return &TestEnvelope{
+		Stream: pbs.NewStream(),
+		Body: NewTestMessage(),
+		Notes: pbs.NewField[string](),
+		Counts: pbs.NewField[pbs.MapEntry[string, int32]](),
+		Attachments: pbs.NewField[*TestEnvelope_Attachment](),
+		Moods: pbs.NewField[Mood](),
+		EventChanges: pbs.NewField[isTestEnvelope_Event](),
+	}
+}
+func (m *TestEnvelope) Close() error {
+	err := m.Stream.Close()
+	m.Body.Close()
+	m.Notes.Close()
+	m.Counts.Close()
+	m.Attachments.Close()
+	m.Moods.Close()
+	m.EventChanges.Close()
+	return err
+}
+
+func (*TestEnvelope) ProtoMessage() {}
+
+func (m *TestEnvelope) String() string {return proto.CompactTextString(m)}
+
+func (m *TestEnvelope) Reset() {*m = *NewTestEnvelope()}
+
+var _ pbs.StreamMessage = (*TestEnvelope)(nil)
+
+type isTestEnvelope_Event interface {
+	isTestEnvelope_Event()
+}
+
+type TestEnvelope_Text struct {
+	Text string `protobuf:"bytes,6,opt,name=text,oneof"`
+}
+
+func (*TestEnvelope_Text) isTestEnvelope_Event() {}
+
+type TestEnvelope_Code struct {
+	Code int32 `protobuf:"varint,7,opt,name=code,oneof"`
+}
+
+func (*TestEnvelope_Code) isTestEnvelope_Event() {}
+
+type TestEnvelope_File struct {
+	File *TestEnvelope_Attachment `protobuf:"bytes,8,opt,name=file,oneof"`
+}
+
+func (*TestEnvelope_File) isTestEnvelope_Event() {}
+
+func (m *TestEnvelope) GetEvent() isTestEnvelope_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetText() string {
+	if x, ok := m.GetEvent().(*TestEnvelope_Text); ok {
+		return x.Text
+	}
+	return ""
+}
+
+func (m *TestEnvelope) GetCode() int32 {
+	if x, ok := m.GetEvent().(*TestEnvelope_Code); ok {
+		return x.Code
+	}
+	return 0
+}
+
+func (m *TestEnvelope) GetFile() *TestEnvelope_Attachment {
+	if x, ok := m.GetEvent().(*TestEnvelope_File); ok {
+		return x.File
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*TestEnvelope) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*TestEnvelope_Text)(nil),
+		(*TestEnvelope_Code)(nil),
+		(*TestEnvelope_File)(nil),
+	}
+}
+
+// TestEnvelopeProducer is the producer view of a TestEnvelope stream
+type TestEnvelopeProducer struct {
+	Body *TestMessageProducer
+	Notes pbs.Sender[string]
+	Counts pbs.Sender[pbs.MapEntry[string, int32]]
+	Attachments pbs.Sender[*TestEnvelope_Attachment]
+	Moods pbs.Sender[Mood]
+	EventChanges pbs.Sender[isTestEnvelope_Event]
+	m *TestEnvelope
+}
+
+func (m *TestEnvelope) Producer() *TestEnvelopeProducer {
+	return &TestEnvelopeProducer{
+		Body: m.Body.Producer(),
+		Notes: m.Notes,
+		Counts: m.Counts,
+		Attachments: m.Attachments,
+		Moods: m.Moods,
+		EventChanges: m.EventChanges,
+		m: m,
+	}
+}
+
+func (v *TestEnvelopeProducer) Close() error { return v.m.Close() }
+
+func (v *TestEnvelopeProducer) Err() error { return v.m.Err() }
+
+func (v *TestEnvelopeProducer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestEnvelopeProducer) Source() pbs.StreamMessage { return v.m }
+
+var _ pbs.Producer = (*TestEnvelopeProducer)(nil)
+
+// TestEnvelopeConsumer is the consumer view of a TestEnvelope stream
+type TestEnvelopeConsumer struct {
+	Body *TestMessageConsumer
+	Notes pbs.Receiver[string]
+	Counts pbs.Receiver[pbs.MapEntry[string, int32]]
+	Attachments pbs.Receiver[*TestEnvelope_Attachment]
+	Moods pbs.Receiver[Mood]
+	EventChanges pbs.Receiver[isTestEnvelope_Event]
+	m *TestEnvelope
+}
+
+func (m *TestEnvelope) Consumer() *TestEnvelopeConsumer {
+	return &TestEnvelopeConsumer{
+		Body: m.Body.Consumer(),
+		Notes: m.Notes,
+		Counts: m.Counts,
+		Attachments: m.Attachments,
+		Moods: m.Moods,
+		EventChanges: m.EventChanges,
+		m: m,
+	}
+}
+
+func (v *TestEnvelopeConsumer) Close() error { return v.m.Close() }
+
+func (v *TestEnvelopeConsumer) Err() error { return v.m.Err() }
+
+func (v *TestEnvelopeConsumer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestEnvelopeConsumer) Sink() pbs.StreamMessage { return v.m }
+
+var _ pbs.Consumer = (*TestEnvelopeConsumer)(nil)
+
+type TestEnvelope_Priority int32
+
+const (
+	TestEnvelope_LOW TestEnvelope_Priority = 0
+	TestEnvelope_HIGH TestEnvelope_Priority = 1
+	TestEnvelope_URGENT TestEnvelope_Priority = -1
+)
+
+var TestEnvelope_Priority_name = map[int32]string{
+	0: "LOW",
+	1: "HIGH",
+	-1: "URGENT",
+}
+
+var TestEnvelope_Priority_value = map[string]int32{
+	"LOW": 0,
+	"HIGH": 1,
+	"URGENT": -1,
+}
+
+func (x TestEnvelope_Priority) Enum() *TestEnvelope_Priority {
+	p := new(TestEnvelope_Priority)
+	*p = x
+	return p
+}
+
+func (x TestEnvelope_Priority) String() string {
+	return proto.EnumName(TestEnvelope_Priority_name, int32(x))
+}
+
+type TestEnvelope_Attachment struct {
+	Headers map[string]string `protobuf:"bytes,1,rep,name=headers" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Types that are valid to be assigned to Body:
+	//	*TestEnvelope_Attachment_Content
+	//	*TestEnvelope_Attachment_Data
+	Body isTestEnvelope_Attachment_Body `protobuf_oneof:"body"`
+}
+
+func NewTestEnvelope_Attachment() *TestEnvelope_Attachment {
+	return &TestEnvelope_Attachment{
+	}
+}
+func (*TestEnvelope_Attachment) ProtoMessage() {}
+
+func (m *TestEnvelope_Attachment) String() string {return proto.CompactTextString(m)}
+
+func (m *TestEnvelope_Attachment) Reset() {*m = *NewTestEnvelope_Attachment()}
+
+var _ proto.Message = (*TestEnvelope_Attachment)(nil)
+
+type isTestEnvelope_Attachment_Body interface {
+	isTestEnvelope_Attachment_Body()
+}
+
+type TestEnvelope_Attachment_Content struct {
+	Content string `protobuf:"bytes,2,opt,name=content,oneof"`
+}
+
+func (*TestEnvelope_Attachment_Content) isTestEnvelope_Attachment_Body() {}
+
+type TestEnvelope_Attachment_Data struct {
+	Data []byte `protobuf:"bytes,3,opt,name=data,oneof"`
+}
+
+func (*TestEnvelope_Attachment_Data) isTestEnvelope_Attachment_Body() {}
+
+func (m *TestEnvelope_Attachment) GetBody() isTestEnvelope_Attachment_Body {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *TestEnvelope_Attachment) GetContent() string {
+	if x, ok := m.GetBody().(*TestEnvelope_Attachment_Content); ok {
+		return x.Content
+	}
+	return ""
+}
+
+func (m *TestEnvelope_Attachment) GetData() []byte {
+	if x, ok := m.GetBody().(*TestEnvelope_Attachment_Data); ok {
+		return x.Data
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*TestEnvelope_Attachment) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*TestEnvelope_Attachment_Content)(nil),
+		(*TestEnvelope_Attachment_Data)(nil),
+	}
+}
+
+type TestScalars struct {
+	I32 *int32 `protobuf:"int32,1,opt,name=i32"`
+	I64 *int64 `protobuf:"int64,2,opt,name=i64"`
+	U32 *uint32 `protobuf:"uint32,3,opt,name=u32"`
+	U64 *uint64 `protobuf:"uint64,4,opt,name=u64"`
+	Si32 *int32 `protobuf:"sint32,5,opt,name=si32"`
+	Si64 *int64 `protobuf:"sint64,6,opt,name=si64"`
+	Fx32 *uint32 `protobuf:"fixed32,7,opt,name=fx32"`
+	Fx64 *uint64 `protobuf:"fixed64,8,opt,name=fx64"`
+	Sfx32 *int32 `protobuf:"sfixed32,9,opt,name=sfx32"`
+	Sfx64 *int64 `protobuf:"sfixed64,10,opt,name=sfx64"`
+	B *bool `protobuf:"bool,11,opt,name=b"`
+	F *float32 `protobuf:"float,12,opt,name=f"`
+	D *float64 `protobuf:"double,13,opt,name=d"`
+	S *string `protobuf:"string,14,opt,name=s"`
+	Bs []byte `protobuf:"bytes,15,opt,name=bs"`
+	*pbs.Stream
+}
+
+func NewTestScalars() *TestScalars {
+	return &TestScalars{
+		Stream: pbs.NewStream(),
+	}
+}
+func (m *TestScalars) Close() error {
+	err := m.Stream.Close()
+	return err
+}
+
+func (*TestScalars) ProtoMessage() {}
+
+func (m *TestScalars) String() string {return proto.CompactTextString(m)}
+
+func (m *TestScalars) Reset() {*m = *NewTestScalars()}
+
+var _ pbs.StreamMessage = (*TestScalars)(nil)
+
+// TestScalarsProducer is the producer view of a TestScalars stream
+type TestScalarsProducer struct {
+	m *TestScalars
+}
+
+func (m *TestScalars) Producer() *TestScalarsProducer {
+	return &TestScalarsProducer{
+		m: m,
+	}
+}
+
+func (v *TestScalarsProducer) Close() error { return v.m.Close() }
+
+func (v *TestScalarsProducer) Err() error { return v.m.Err() }
+
+func (v *TestScalarsProducer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestScalarsProducer) Source() pbs.StreamMessage { return v.m }
+
+var _ pbs.Producer = (*TestScalarsProducer)(nil)
+
+// TestScalarsConsumer is the consumer view of a TestScalars stream
+type TestScalarsConsumer struct {
+	m *TestScalars
+}
+
+func (m *TestScalars) Consumer() *TestScalarsConsumer {
+	return &TestScalarsConsumer{
+		m: m,
+	}
+}
+
+func (v *TestScalarsConsumer) Close() error { return v.m.Close() }
+
+func (v *TestScalarsConsumer) Err() error { return v.m.Err() }
+
+func (v *TestScalarsConsumer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestScalarsConsumer) Sink() pbs.StreamMessage { return v.m }
+
+var _ pbs.Consumer = (*TestScalarsConsumer)(nil)
+
+type TestScalarFields struct {
+	I32 *pbs.Field[int32] `protobuf:"int32,1,rep,name=i32"`
+	I64 *pbs.Field[int64] `protobuf:"int64,2,rep,name=i64"`
+	U32 *pbs.Field[uint32] `protobuf:"uint32,3,rep,name=u32"`
+	U64 *pbs.Field[uint64] `protobuf:"uint64,4,rep,name=u64"`
+	Si32 *pbs.Field[int32] `protobuf:"sint32,5,rep,name=si32"`
+	Si64 *pbs.Field[int64] `protobuf:"sint64,6,rep,name=si64"`
+	Fx32 *pbs.Field[uint32] `protobuf:"fixed32,7,rep,name=fx32"`
+	Fx64 *pbs.Field[uint64] `protobuf:"fixed64,8,rep,name=fx64"`
+	Sfx32 *pbs.Field[int32] `protobuf:"sfixed32,9,rep,name=sfx32"`
+	Sfx64 *pbs.Field[int64] `protobuf:"sfixed64,10,rep,name=sfx64"`
+	B *pbs.Field[bool] `protobuf:"bool,11,rep,name=b"`
+	F *pbs.Field[float32] `protobuf:"float,12,rep,name=f"`
+	D *pbs.Field[float64] `protobuf:"double,13,rep,name=d"`
+	S *pbs.Field[string] `protobuf:"string,14,rep,name=s"`
+	Bs *pbs.Field[[]byte] `protobuf:"bytes,15,rep,name=bs"`
+	*pbs.Stream
+}
+
+func NewTestScalarFields() *TestScalarFields {
+	return &TestScalarFields{
+		Stream: pbs.NewStream(),
+		I32: pbs.NewField[int32](),
+		I64: pbs.NewField[int64](),
+		U32: pbs.NewField[uint32](),
+		U64: pbs.NewField[uint64](),
+		Si32: pbs.NewField[int32](),
+		Si64: pbs.NewField[int64](),
+		Fx32: pbs.NewField[uint32](),
+		Fx64: pbs.NewField[uint64](),
+		Sfx32: pbs.NewField[int32](),
+		Sfx64: pbs.NewField[int64](),
+		B: pbs.NewField[bool](),
+		F: pbs.NewField[float32](),
+		D: pbs.NewField[float64](),
+		S: pbs.NewField[string](),
+		Bs: pbs.NewField[[]byte](),
+	}
+}
+func (m *TestScalarFields) Close() error {
+	err := m.Stream.Close()
+	m.I32.Close()
+	m.I64.Close()
+	m.U32.Close()
+	m.U64.Close()
+	m.Si32.Close()
+	m.Si64.Close()
+	m.Fx32.Close()
+	m.Fx64.Close()
+	m.Sfx32.Close()
+	m.Sfx64.Close()
+	m.B.Close()
+	m.F.Close()
+	m.D.Close()
+	m.S.Close()
+	m.Bs.Close()
+	return err
+}
+
+func (*TestScalarFields) ProtoMessage() {}
+
+func (m *TestScalarFields) String() string {return proto.CompactTextString(m)}
+
+func (m *TestScalarFields) Reset() {*m = *NewTestScalarFields()}
+
+var _ pbs.StreamMessage = (*TestScalarFields)(nil)
+
+// TestScalarFieldsProducer is the producer view of a TestScalarFields stream
+type TestScalarFieldsProducer struct {
+	I32 pbs.Sender[int32]
+	I64 pbs.Sender[int64]
+	U32 pbs.Sender[uint32]
+	U64 pbs.Sender[uint64]
+	Si32 pbs.Sender[int32]
+	Si64 pbs.Sender[int64]
+	Fx32 pbs.Sender[uint32]
+	Fx64 pbs.Sender[uint64]
+	Sfx32 pbs.Sender[int32]
+	Sfx64 pbs.Sender[int64]
+	B pbs.Sender[bool]
+	F pbs.Sender[float32]
+	D pbs.Sender[float64]
+	S pbs.Sender[string]
+	Bs pbs.Sender[[]byte]
+	m *TestScalarFields
+}
+
+func (m *TestScalarFields) Producer() *TestScalarFieldsProducer {
+	return &TestScalarFieldsProducer{
+		I32: m.I32,
+		I64: m.I64,
+		U32: m.U32,
+		U64: m.U64,
+		Si32: m.Si32,
+		Si64: m.Si64,
+		Fx32: m.Fx32,
+		Fx64: m.Fx64,
+		Sfx32: m.Sfx32,
+		Sfx64: m.Sfx64,
+		B: m.B,
+		F: m.F,
+		D: m.D,
+		S: m.S,
+		Bs: m.Bs,
+		m: m,
+	}
+}
+
+func (v *TestScalarFieldsProducer) Close() error { return v.m.Close() }
+
+func (v *TestScalarFieldsProducer) Err() error { return v.m.Err() }
+
+func (v *TestScalarFieldsProducer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestScalarFieldsProducer) Source() pbs.StreamMessage { return v.m }
+
+var _ pbs.Producer = (*TestScalarFieldsProducer)(nil)
+
+// TestScalarFieldsConsumer is the consumer view of a TestScalarFields stream
+type TestScalarFieldsConsumer struct {
+	I32 pbs.Receiver[int32]
+	I64 pbs.Receiver[int64]
+	U32 pbs.Receiver[uint32]
+	U64 pbs.Receiver[uint64]
+	Si32 pbs.Receiver[int32]
+	Si64 pbs.Receiver[int64]
+	Fx32 pbs.Receiver[uint32]
+	Fx64 pbs.Receiver[uint64]
+	Sfx32 pbs.Receiver[int32]
+	Sfx64 pbs.Receiver[int64]
+	B pbs.Receiver[bool]
+	F pbs.Receiver[float32]
+	D pbs.Receiver[float64]
+	S pbs.Receiver[string]
+	Bs pbs.Receiver[[]byte]
+	m *TestScalarFields
+}
+
+func (m *TestScalarFields) Consumer() *TestScalarFieldsConsumer {
+	return &TestScalarFieldsConsumer{
+		I32: m.I32,
+		I64: m.I64,
+		U32: m.U32,
+		U64: m.U64,
+		Si32: m.Si32,
+		Si64: m.Si64,
+		Fx32: m.Fx32,
+		Fx64: m.Fx64,
+		Sfx32: m.Sfx32,
+		Sfx64: m.Sfx64,
+		B: m.B,
+		F: m.F,
+		D: m.D,
+		S: m.S,
+		Bs: m.Bs,
+		m: m,
+	}
+}
+
+func (v *TestScalarFieldsConsumer) Close() error { return v.m.Close() }
+
+func (v *TestScalarFieldsConsumer) Err() error { return v.m.Err() }
+
+func (v *TestScalarFieldsConsumer) Closed() <-chan struct{} { return v.m.Closed() }
+
+func (v *TestScalarFieldsConsumer) Sink() pbs.StreamMessage { return v.m }
+
+var _ pbs.Consumer = (*TestScalarFieldsConsumer)(nil)
+
+// TestServiceServer is the server API for the TestService service
+type TestServiceServer interface {
+	Echo(ctx context.Context, req *TestMessage) (*TestMessage, error)
+	Split(ctx context.Context, req *TestMessage, resp *TestMessageProducer) error
+	Count(ctx context.Context, req *TestMessageConsumer) (*TestMessage, error)
+	Chat(ctx context.Context, req *TestMessageConsumer, resp *TestMessageProducer) error
+}
+
+// RegisterTestServiceServer registers the methods of srv with s
+func RegisterTestServiceServer(s *pbs.Server, srv TestServiceServer) {
+	pbs.HandleCall(s, "/pbs_test.TestService/Echo", func(call *pbs.ServerCall) error {
+		req := NewTestMessage()
+		if err := call.Request(req); err != nil {
+			return err
+		}
+		<-req.Closed()
+		if err := req.Err(); err != nil {
+			return err
+		}
+		resp, err := srv.Echo(call.Context(), req)
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			resp = NewTestMessage()
+		}
+		// a response not made with its New function fails the call
+		return call.Respond(resp)
+	})
+	pbs.HandleCall(s, "/pbs_test.TestService/Split", func(call *pbs.ServerCall) error {
+		req := NewTestMessage()
+		if err := call.Request(req); err != nil {
+			return err
+		}
+		<-req.Closed()
+		if err := req.Err(); err != nil {
+			return err
+		}
+		resp := NewTestMessage()
+		if err := call.Respond(resp); err != nil {
+			return err
+		}
+		return srv.Split(call.Context(), req, resp.Producer())
+	})
+	pbs.HandleCall(s, "/pbs_test.TestService/Count", func(call *pbs.ServerCall) error {
+		req := NewTestMessage()
+		if err := call.Request(req); err != nil {
+			return err
+		}
+		resp, err := srv.Count(call.Context(), req.Consumer())
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			resp = NewTestMessage()
+		}
+		// a response not made with its New function fails the call
+		return call.Respond(resp)
+	})
+	pbs.HandleCall(s, "/pbs_test.TestService/Chat", func(call *pbs.ServerCall) error {
+		req := NewTestMessage()
+		if err := call.Request(req); err != nil {
+			return err
+		}
+		resp := NewTestMessage()
+		if err := call.Respond(resp); err != nil {
+			return err
+		}
+		return srv.Chat(call.Context(), req.Consumer(), resp.Producer())
+	})
+}
+
+// TestServiceClient is the client API for the TestService service. Every call is
+// made over its own connection, and canceled with its context.
+type TestServiceClient struct {
+	network string
+	addr    string
+}
+
+func NewTestServiceClient(network, addr string) *TestServiceClient {
+	return &TestServiceClient{network: network, addr: addr}
+}
+
+func (c *TestServiceClient) Echo(ctx context.Context, req *TestMessage) (*TestMessage, error) {
+	call, err := pbs.NewCall(ctx, c.network, c.addr, "/pbs_test.TestService/Echo")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := call.Request(req); err != nil {
+		call.Close()
+		return nil, err
+	}
+	req.Close()
+
+	resp := NewTestMessage()
+	call.Response(resp)
+
+	<-resp.Closed()
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *TestServiceClient) Split(ctx context.Context, req *TestMessage) (*TestMessageConsumer, error) {
+	call, err := pbs.NewCall(ctx, c.network, c.addr, "/pbs_test.TestService/Split")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := call.Request(req); err != nil {
+		call.Close()
+		return nil, err
+	}
+	req.Close()
+
+	resp := NewTestMessage()
+	call.Response(resp)
+	return resp.Consumer(), nil
+}
+
+func (c *TestServiceClient) Count(ctx context.Context) (*TestMessageProducer, *TestMessage, error) {
+	call, err := pbs.NewCall(ctx, c.network, c.addr, "/pbs_test.TestService/Count")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := NewTestMessage()
+	if err := call.Request(req); err != nil {
+		call.Close()
+		return nil, nil, err
+	}
+
+	resp := NewTestMessage()
+	call.Response(resp)
+	return req.Producer(), resp, nil
+}
+
+func (c *TestServiceClient) Chat(ctx context.Context) (*TestMessageProducer, *TestMessageConsumer, error) {
+	call, err := pbs.NewCall(ctx, c.network, c.addr, "/pbs_test.TestService/Chat")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := NewTestMessage()
+	if err := call.Request(req); err != nil {
+		call.Close()
+		return nil, nil, err
+	}
+
+	resp := NewTestMessage()
+	call.Response(resp)
+	return req.Producer(), resp.Consumer(), nil
+}
+
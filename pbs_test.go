@@ -2,6 +2,8 @@ package pbs_test
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"sync"
 	"testing"
 
@@ -40,26 +42,24 @@ func TestStreamEncode(t *testing.T) {
 
 	repstrings := []string{"cat", "dog", "fish", "cow"}
 
+	ctx := context.Background()
 	for _, b := range repbytes {
-		tm.Repbytes <- b
+		tm.Repbytes.Send(ctx, b)
 	}
 
 	for _, i := range repints {
-		tm.Repint <- i
+		tm.Repint.Send(ctx, i)
 	}
 
 	for _, s := range repstrings {
-		tm.Repstring <- s
+		tm.Repstring.Send(ctx, s)
 	}
 
 	tm.Close()
+	<-tm.Closed()
 
-	select {
-	case err, ok := <-tm.errors:
-		if ok {
-			t.Fatal(err)
-		}
-	default:
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
 	}
 
 	outm := new(tpb.TestMessage)
@@ -133,21 +133,21 @@ func TestDecode(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	go func() {
-		for b := range outmes.Repbytes {
+		for b := range outmes.Repbytes.C() {
 			outbytes = append(outbytes, b)
 		}
 		wg.Done()
 	}()
 
 	go func() {
-		for i := range outmes.Repint {
+		for i := range outmes.Repint.C() {
 			outints = append(outints, i)
 		}
 		wg.Done()
 	}()
 
 	go func() {
-		for s := range outmes.Repstring {
+		for s := range outmes.Repstring.C() {
 			outstrings = append(outstrings, s)
 		}
 		wg.Done()
@@ -155,12 +155,8 @@ func TestDecode(t *testing.T) {
 
 	wg.Wait()
 
-	select {
-	case err, ok := <-outmes.Errors():
-		if ok {
-			t.Fatal(err)
-		}
-	default:
+	if err := outmes.Err(); err != nil {
+		t.Fatal(err)
 	}
 
 	if *tm.A != *outmes.A {
@@ -171,3 +167,151 @@ func TestDecode(t *testing.T) {
 		t.Fatal("B value incorrect")
 	}
 }
+
+func TestOversizedValue(t *testing.T) {
+	for _, data := range [][]byte{
+		// longer than the limit, and longer than an int can hold
+		{0x4a, 0x80, 0x80, 0x80, 0x80, 0x08},
+		{0x4a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	} {
+		out := NewTestMessage()
+		err := StreamDecode(bytes.NewReader(data), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range out.Repstring.C() {
+		}
+		<-out.Closed()
+		if out.Err() != ErrValueTooLarge {
+			t.Fatal("expected ErrValueTooLarge, got: ", out.Err())
+		}
+	}
+
+	// the limit can be lowered
+	out := NewTestMessage()
+	err := StreamDecode(bytes.NewReader([]byte{0x4a, 3, 'c', 'a', 't'}), out, MaxValueSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range out.Repstring.C() {
+	}
+	<-out.Closed()
+	if out.Err() != ErrValueTooLarge {
+		t.Fatal("expected ErrValueTooLarge, got: ", out.Err())
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	// fields 13 and 14 are not in TestMessage, and are skipped rather than
+	// decoded into its first field
+	data := []byte{
+		13<<3 | Varint, 7,
+		14<<3 | LengthDelim, 4, 'j', 'u', 'n', 'k',
+		4<<3 | LengthDelim, 3, 'c', 'a', 't',
+	}
+	out := NewTestMessage()
+	err := StreamDecode(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for range out.Repint.C() {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range out.Repbytes.C() {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range out.Repstring.C() {
+		}
+	}()
+	var subs int
+	for range out.Tsubm.C() {
+		subs++
+	}
+	wg.Wait()
+	<-out.Closed()
+
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if subs != 0 {
+		t.Fatalf("expected no submessages, got %d", subs)
+	}
+	if out.B == nil || *out.B != "cat" {
+		t.Fatal("B value incorrect")
+	}
+}
+
+func TestUnknownWireTypes(t *testing.T) {
+	// values of every wire type are skipped for fields TestMessage does
+	// not have, including groups with groups inside them
+	data := []byte{
+		13<<3 | Varint, 0x80, 0x01,
+		13<<3 | Int64, 1, 2, 3, 4, 5, 6, 7, 8,
+		13<<3 | LengthDelim, 2, 'h', 'i',
+		13<<3 | Bit32, 1, 2, 3, 4,
+		14<<3 | StartGroup,
+		1<<3 | Varint, 5,
+		3<<3 | StartGroup, 4<<3 | LengthDelim, 1, 'x', 3<<3 | EndGroup,
+		14<<3 | EndGroup,
+		3<<3 | Varint, 42,
+	}
+	out := NewTestMessage()
+	err := StreamDecode(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainTestMessage(out)
+	<-out.Closed()
+
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.A == nil || *out.A != 42 || out.B != nil {
+		t.Fatal("A value incorrect")
+	}
+
+	// a group cut off by the end of the stream is an error
+	out = NewTestMessage()
+	err = StreamDecode(bytes.NewReader(data[:26]), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainTestMessage(out)
+	<-out.Closed()
+	if out.Err() != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got: ", out.Err())
+	}
+}
+
+// drainTestMessage reads the repeated fields of m until they are closed
+func drainTestMessage(m *TestMessage) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for range m.Repint.C() {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range m.Repbytes.C() {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range m.Repstring.C() {
+		}
+	}()
+	for range m.Tsubm.C() {
+	}
+	wg.Wait()
+}
@@ -3,17 +3,35 @@ package main
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
 // PrintGoStreamProto writes out go source code for the given protobuf
 // Top level messages in the protobuf will be implemented as StreamMessages
 func PrintGoStreamProto(w io.Writer, pb *Protobuf) {
+	proto3 = pb.Syntax == "proto3"
+	for _, mes := range pb.Messages {
+		streamMessages[mes.Name] = true
+	}
+	for _, e := range pb.Enums {
+		enumTypes[makeGoName(e.Name)] = true
+	}
+	for _, mes := range pb.Messages {
+		registerEnums(mes, "")
+	}
+
 	fmt.Printf("package %s\n\n", pb.Package)
-	printImports(w)
+	printImports(w, pb)
+	for _, e := range pb.Enums {
+		printGoEnum(w, e, makeGoName(e.Name), makeGoName(e.Name)+"_")
+	}
 	for _, mes := range pb.Messages {
 		printGoProtoMessage(w, mes, "", true)
 	}
+	for _, s := range pb.Services {
+		printGoService(w, s, pb.Package)
+	}
 }
 
 var imports = []string{
@@ -21,8 +39,12 @@ var imports = []string{
 	"github.com/whyrusleeping/go-pbs",
 }
 
-// printImports writes out the default imports
-func printImports(w io.Writer) {
+// printImports writes out the default imports, and the ones needed by the
+// services of the protobuf
+func printImports(w io.Writer, pb *Protobuf) {
+	if len(pb.Services) > 0 {
+		fmt.Fprintln(w, "import \"context\"")
+	}
 	for _, i := range imports {
 		fmt.Fprintf(w, "import \"%s\"\n", i)
 	}
@@ -43,38 +65,224 @@ var typeMap = map[string]string{
 	"int64":  "int64",
 	"uint64": "uint64",
 	"bool":   "bool",
+
+	"sint32":   "int32",
+	"sint64":   "int64",
+	"fixed32":  "uint32",
+	"fixed64":  "uint64",
+	"sfixed32": "int32",
+	"sfixed64": "int64",
+	"float":    "float32",
+	"double":   "float64",
+}
+
+// streamMessages holds the names of the top level messages, which are
+// generated as StreamMessages
+var streamMessages = make(map[string]bool)
+
+// isNestedStream returns whether f is a singular field of a stream message
+// holding another stream message, which is streamed along with it
+func isNestedStream(f *Field, stream bool) bool {
+	return stream && f.Attribute != "repeated" && streamMessages[f.Type]
+}
+
+// proto3 is set when the messages are of proto3 syntax
+var proto3 bool
+
+// enumTypes holds the go names of the enums, nested ones included
+var enumTypes = make(map[string]bool)
+
+// registerEnums adds the enums declared in mes and its submessages to
+// enumTypes
+func registerEnums(mes *Message, prefix string) {
+	name := prefix + mes.Name
+	for _, e := range mes.Enums {
+		enumTypes[name+"_"+makeGoName(e.Name)] = true
+	}
+	for _, subm := range mes.SubMessages {
+		registerEnums(subm, name+"_")
+	}
 }
 
-// parseGoType returns the go representation of the passed in protobuf type
-func parseGoType(typ string, prefix string, rep bool) string {
+// resolveEnum returns the go name of the enum typ refers to from the scope
+// of prefix, looking in the enclosing messages as protobuf does
+func resolveEnum(typ string, prefix string) (string, bool) {
+	scope := strings.TrimSuffix(prefix, "_")
+	for {
+		name := makeGoName(typ)
+		if scope != "" {
+			name = scope + "_" + name
+		}
+		if enumTypes[name] {
+			return name, true
+		}
+		if scope == "" {
+			return "", false
+		}
+
+		i := strings.LastIndex(scope, "_")
+		if i < 0 {
+			scope = ""
+		} else {
+			scope = scope[:i]
+		}
+	}
+}
+
+// parseGoType returns the go representation of the passed in protobuf type.
+// Scalars and enums are held by value when value is set, as the values of
+// repeated fields and proto3 fields without a label are, and through a
+// pointer otherwise. Messages are always pointers.
+func parseGoType(typ string, prefix string, value bool) string {
 	t, ok := typeMap[typ]
 	if ok {
-		if rep || t[:2] == "[]" {
+		if value || t[:2] == "[]" {
 			return t
 		} else {
 			return "*" + t
 		}
 	}
 
+	if name, ok := resolveEnum(typ, prefix); ok {
+		if value {
+			return name
+		}
+		return "*" + name
+	}
+
 	return "*" + prefix + makeGoName(typ)
 }
 
+// parseGoElemType returns the go type of the values of a repeated field,
+// which for a map field of a stream message are its entries
+func parseGoElemType(f *Field, prefix string) string {
+	if f.Type == "map" {
+		return fmt.Sprintf("pbs.MapEntry[%s, %s]", parseGoType(f.KeyType, prefix, true), parseGoType(f.ValueType, prefix, true))
+	}
+	return parseGoType(f.Type, prefix, true)
+}
+
+// wireKinds maps the protobuf scalar types to their kind on the wire, as
+// named in the struct tags of protoc-gen-go
+var wireKinds = map[string]string{
+	"string": "bytes",
+	"bytes":  "bytes",
+	"int32":  "varint",
+	"uint32": "varint",
+	"int64":  "varint",
+	"uint64": "varint",
+	"bool":   "varint",
+
+	"sint32":   "zigzag32",
+	"sint64":   "zigzag64",
+	"fixed32":  "fixed32",
+	"fixed64":  "fixed64",
+	"sfixed32": "fixed32",
+	"sfixed64": "fixed64",
+	"float":    "fixed32",
+	"double":   "fixed64",
+}
+
+// wireKind returns the wire kind of a protobuf type, referred to from the
+// scope of prefix. Enums are varints, and messages bytes.
+func wireKind(typ string, prefix string) string {
+	if k, ok := wireKinds[typ]; ok {
+		return k
+	}
+	if _, ok := resolveEnum(typ, prefix); ok {
+		return "varint"
+	}
+	return "bytes"
+}
+
+// formatMapTag returns the struct tags of a map field. They follow
+// protoc-gen-go, as protobuf needs the kinds of the key and value to
+// marshal a go map.
+func formatMapTag(f *Field, prefix string) string {
+	return fmt.Sprintf("protobuf:\"bytes,%d,rep,name=%s\" protobuf_key:\"%s,1,opt,name=key\" protobuf_val:\"%s,2,opt,name=value\"",
+		f.Number, f.Name, wireKind(f.KeyType, prefix), wireKind(f.ValueType, prefix))
+}
+
 // formatGoProtoField returns a string representing the golang member variable
-// representation of the passed in field
+// representation of the passed in field. Map fields are go maps, except in
+// stream messages, where they are Fields of their entries.
 func formatGoProtoField(f *Field, prefix string, stream bool) string {
 	var typ string
 	if f.Attribute == "repeated" {
 		if stream {
-			typ = "chan "
+			typ = "*pbs.Field[" + parseGoElemType(f, prefix) + "]"
+		} else if f.Type == "map" {
+			typ = fmt.Sprintf("map[%s]%s", parseGoType(f.KeyType, prefix, true), parseGoType(f.ValueType, prefix, true))
 		} else {
-			typ = "[]"
+			typ = "[]" + parseGoType(f.Type, prefix, true)
 		}
+	} else if isNestedStream(f, stream) {
+		typ = "*" + makeGoName(f.Type)
+	} else {
+		typ = parseGoType(f.Type, prefix, f.Attribute == "")
 	}
-	typ += parseGoType(f.Type, prefix, f.Attribute == "repeated")
 	name := makeGoName(f.Name)
 
-	tag := fmt.Sprintf("`protobuf:\"%s,%d,%s,name=%s\"`", f.Type, f.Number, f.Attribute[:3], f.Name)
-	return fmt.Sprintf("%s %s %s", name, typ, tag)
+	tag := fmt.Sprintf("protobuf:\"%s\"", formatProtoTag(f, prefix))
+	if f.Type == "map" {
+		tag = formatMapTag(f, prefix)
+	}
+	if stream && f.Attribute == "repeated" {
+		if ptag := formatPbsTag(f); ptag != "" {
+			tag += " " + ptag
+		}
+	}
+	return fmt.Sprintf("%s %s `%s`", name, typ, tag)
+}
+
+// formatProtoTag returns the value of the protobuf struct tag of a field,
+// giving its protobuf type, number and label, and the options that change
+// how it is encoded. Fields of proto3 messages are marked as such, and
+// their repeated scalars are packed unless they say otherwise.
+func formatProtoTag(f *Field, prefix string) string {
+	label := "opt"
+	if f.Attribute != "" {
+		label = f.Attribute[:3]
+	}
+	parts := []string{f.Type, strconv.Itoa(f.Number), label}
+
+	packed := proto3 && f.Attribute == "repeated" && wireKind(f.Type, prefix) != "bytes"
+	if v, ok := f.Option("packed"); ok {
+		packed = v == "true"
+	}
+	if packed {
+		parts = append(parts, "packed")
+	}
+
+	parts = append(parts, "name="+f.Name)
+	if name, ok := resolveEnum(f.Type, prefix); ok {
+		parts = append(parts, "enum="+name)
+	}
+	if proto3 {
+		parts = append(parts, "proto3")
+	}
+	return strings.Join(parts, ",")
+}
+
+// pbsOptions maps the pbs field options to the keys of the pbs struct tag
+var pbsOptions = []struct{ option, key string }{
+	{"(pbs.delivery)", "delivery"},
+	{"(pbs.buffer)", "buffer"},
+}
+
+// formatPbsTag returns the pbs struct tag carrying the pbs options of a
+// repeated stream field, or an empty string if it has none
+func formatPbsTag(f *Field) string {
+	var opts []string
+	for _, o := range pbsOptions {
+		if v, ok := f.Option(o.option); ok {
+			opts = append(opts, o.key+"="+v)
+		}
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("pbs:\"%s\"", strings.Join(opts, ","))
 }
 
 // printGoProtoMessage generates go code for the given message and writes it out
@@ -85,9 +293,11 @@ func printGoProtoMessage(w io.Writer, mes *Message, prefix string, stream bool)
 	for _, f := range mes.Fields {
 		fmt.Fprintln(w, "\t"+formatGoProtoField(f, name+"_", stream))
 	}
+	for _, o := range mes.Oneofs {
+		printOneofField(w, o, name, stream)
+	}
 	if stream {
-		fmt.Fprintln(w, "\terrors chan error")
-		fmt.Fprintln(w, "\tcloseCh chan struct{}")
+		fmt.Fprintln(w, "\t*pbs.Stream")
 	}
 	fmt.Fprintln(w, "}\n")
 
@@ -98,12 +308,58 @@ func printGoProtoMessage(w io.Writer, mes *Message, prefix string, stream bool)
 	}
 	printProtoMethods(w, name)
 	printInterfaceAssertion(w, mes, name, stream)
+	if len(mes.Oneofs) > 0 {
+		printOneofTypes(w, mes, name)
+	}
 
+	if stream {
+		printStreamView(w, mes, name, "Producer", "pbs.Sender", "Source")
+		printStreamView(w, mes, name, "Consumer", "pbs.Receiver", "Sink")
+	}
+
+	for _, e := range mes.Enums {
+		printGoEnum(w, e, name+"_"+makeGoName(e.Name), name+"_")
+	}
 	for _, subm := range mes.SubMessages {
 		printGoProtoMessage(w, subm, name+"_", false)
 	}
 }
 
+// printGoEnum writes out an enum as a named int32 type with a constant for
+// each value, following protoc-gen-go. The constants of a top level enum
+// are prefixed with its name, those of a nested one with the name of the
+// enclosing message. Unknown values are kept as they are, and printed as
+// numbers.
+func printGoEnum(w io.Writer, e *Enum, name, constPrefix string) {
+	fmt.Fprintf(w, "type %s int32\n\n", name)
+
+	fmt.Fprintln(w, "const (")
+	for _, v := range e.Values {
+		fmt.Fprintf(w, "\t%s%s %s = %d\n", constPrefix, v.Name, name, v.Number)
+	}
+	fmt.Fprint(w, ")\n\n")
+
+	fmt.Fprintf(w, "var %s_name = map[int32]string{\n", name)
+	seen := make(map[int]bool)
+	for _, v := range e.Values {
+		// the first of several aliases of a number names it
+		if !seen[v.Number] {
+			fmt.Fprintf(w, "\t%d: \"%s\",\n", v.Number, v.Name)
+			seen[v.Number] = true
+		}
+	}
+	fmt.Fprint(w, "}\n\n")
+
+	fmt.Fprintf(w, "var %s_value = map[string]int32{\n", name)
+	for _, v := range e.Values {
+		fmt.Fprintf(w, "\t\"%s\": %d,\n", v.Name, v.Number)
+	}
+	fmt.Fprint(w, "}\n\n")
+
+	fmt.Fprintf(w, "func (x %s) Enum() *%s {\n\tp := new(%s)\n\t*p = x\n\treturn p\n}\n\n", name, name, name)
+	fmt.Fprintf(w, "func (x %s) String() string {\n\treturn proto.EnumName(%s_name, int32(x))\n}\n\n", name, name)
+}
+
 // printInterfaceAssertion prints a line that will do a compile time type assertion
 // on the given message type to make sure it matches either the pbs.StreamMessage
 // interface or the proto.Message
@@ -118,34 +374,86 @@ func printInterfaceAssertion(w io.Writer, mes *Message, name string, stream bool
 }
 
 // printGoStreamMethods writes out methods that implement the pbs.StreamMessage
-// interface for the given message
+// interface for the given message. Everything but Close is provided by the
+// embedded pbs.Stream; Close also closes the repeated fields and nested
+// stream messages, and like the Stream's Close it is safe to call more than
+// once. The Stream is closed first, so the encoder does not take the fields
+// closing along with it for fields its producer ended.
 func printGoStreamMethods(w io.Writer, mes *Message, name string) {
-	fmt.Fprintf(w, "func (m *%s) Errors() chan error { return m.errors }\n\n", name)
-	fmt.Fprintf(w, "func (m *%s) Closed() <-chan struct{} { return m.closeCh }\n\n", name)
 	fmt.Fprintf(w, "func (m *%s) Close() error {\n", name)
+	fmt.Fprintln(w, "\terr := m.Stream.Close()")
 	for _, f := range mes.Fields {
-		if f.Attribute == "repeated" {
-			fmt.Fprintf(w, "\tclose(m.%s)\n", makeGoName(f.Name))
+		if f.Attribute == "repeated" || isNestedStream(f, true) {
+			fmt.Fprintf(w, "\tm.%s.Close()\n", makeGoName(f.Name))
 		}
 	}
-	fmt.Fprintf(w, "\tclose(m.errors)\n")
-	fmt.Fprintf(w, "\tclose(m.closeCh)\n")
-	fmt.Fprintln(w, "\treturn nil")
+	for _, o := range mes.Oneofs {
+		fmt.Fprintf(w, "\tm.%sChanges.Close()\n", makeGoName(o.Name))
+	}
+	fmt.Fprintln(w, "\treturn err")
 	fmt.Fprintln(w, "}\n")
 }
 
+// printStreamView writes out the producer or consumer view of a stream message.
+// A view only exposes the repeated fields through the given field interface,
+// so that for example a consumer cannot send on the fields the decoder owns.
+// Nested stream messages are exposed through views of the same role.
+func printStreamView(w io.Writer, mes *Message, name, role, fieldIface, accessor string) {
+	view := name + role
+	fmt.Fprintf(w, "// %s is the %s view of a %s stream\n", view, strings.ToLower(role), name)
+	fmt.Fprintf(w, "type %s struct {\n", view)
+	for _, f := range mes.Fields {
+		if f.Attribute == "repeated" {
+			fmt.Fprintf(w, "\t%s %s[%s]\n", makeGoName(f.Name), fieldIface, parseGoElemType(f, name+"_"))
+		} else if isNestedStream(f, true) {
+			fmt.Fprintf(w, "\t%s *%s%s\n", makeGoName(f.Name), makeGoName(f.Type), role)
+		}
+	}
+	for _, o := range mes.Oneofs {
+		fmt.Fprintf(w, "\t%sChanges %s[%s]\n", makeGoName(o.Name), fieldIface, oneofIface(o, name))
+	}
+	fmt.Fprintf(w, "\tm *%s\n", name)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "func (m *%s) %s() *%s {\n", name, role, view)
+	fmt.Fprintf(w, "\treturn &%s{\n", view)
+	for _, f := range mes.Fields {
+		if f.Attribute == "repeated" {
+			fmt.Fprintf(w, "\t\t%s: m.%s,\n", makeGoName(f.Name), makeGoName(f.Name))
+		} else if isNestedStream(f, true) {
+			fmt.Fprintf(w, "\t\t%s: m.%s.%s(),\n", makeGoName(f.Name), makeGoName(f.Name), role)
+		}
+	}
+	for _, o := range mes.Oneofs {
+		fmt.Fprintf(w, "\t\t%sChanges: m.%sChanges,\n", makeGoName(o.Name), makeGoName(o.Name))
+	}
+	fmt.Fprintf(w, "\t\tm: m,\n")
+	fmt.Fprintf(w, "\t}\n}\n\n")
+
+	fmt.Fprintf(w, "func (v *%s) Close() error { return v.m.Close() }\n\n", view)
+	fmt.Fprintf(w, "func (v *%s) Err() error { return v.m.Err() }\n\n", view)
+	fmt.Fprintf(w, "func (v *%s) Closed() <-chan struct{} { return v.m.Closed() }\n\n", view)
+	fmt.Fprintf(w, "func (v *%s) %s() pbs.StreamMessage { return v.m }\n\n", view, accessor)
+	fmt.Fprintf(w, "var _ pbs.%s = (*%s)(nil)\n\n", role, view)
+}
+
 // printMessageConstructor writes a constructor function for the given message type
 func printMessageConstructor(w io.Writer, mes *Message, name string, stream bool) {
 	fmt.Fprintf(w, "func New%s() *%s {\n", name, name)
 	fmt.Fprintf(w, "\treturn &%s{\n", name)
 	if stream {
-		fmt.Fprintf(w, "\t\terrors: make(chan error, 1),\n")
-		fmt.Fprintf(w, "\t\tcloseCh: make(chan struct{}),\n")
+		fmt.Fprintf(w, "\t\tStream: pbs.NewStream(),\n")
 		for _, f := range mes.Fields {
 			if f.Attribute == "repeated" {
-				fmt.Fprintf(w, "\t\t%s: make(chan %s),\n", makeGoName(f.Name), parseGoType(f.Type, name+"_", true))
+				fmt.Fprintf(w, "\t\t%s: pbs.NewField[%s](),\n", makeGoName(f.Name), parseGoElemType(f, name+"_"))
+			} else if isNestedStream(f, true) {
+				fmt.Fprintf(w, "\t\t%s: New%s(),\n", makeGoName(f.Name), makeGoName(f.Type))
 			}
 		}
+		for _, o := range mes.Oneofs {
+			fmt.Fprintf(w, "\t\t%sChanges: pbs.NewField[%s](),\n", makeGoName(o.Name), oneofIface(o, name))
+		}
 	}
 	fmt.Fprintf(w, "\t}\n}\n")
 }
@@ -157,3 +465,242 @@ func printProtoMethods(w io.Writer, name string) {
 	fmt.Fprintf(w, "func (m *%s) String() string {return proto.CompactTextString(m)}\n\n", name)
 	fmt.Fprintf(w, "func (m *%s) Reset() {*m = *New%s()}\n\n", name, name)
 }
+
+// oneofIface returns the name of the interface implemented by the wrapper
+// types of the members of a oneof
+func oneofIface(o *Oneof, name string) string {
+	return "is" + name + "_" + makeGoName(o.Name)
+}
+
+// oneofWrapper returns the name of the wrapper type of a member of a oneof
+func oneofWrapper(f *Field, name string) string {
+	return name + "_" + makeGoName(f.Name)
+}
+
+// printOneofField writes out the interface field holding the case of a
+// oneof, following protoc-gen-go. A stream message also gets a Field that
+// the case can be changed on while the stream is open.
+func printOneofField(w io.Writer, o *Oneof, name string, stream bool) {
+	fmt.Fprintf(w, "\t// Types that are valid to be assigned to %s:\n", makeGoName(o.Name))
+	for _, f := range o.Fields {
+		fmt.Fprintf(w, "\t//\t*%s\n", oneofWrapper(f, name))
+	}
+	fmt.Fprintf(w, "\t%s %s `protobuf_oneof:\"%s\"`\n", makeGoName(o.Name), oneofIface(o, name), o.Name)
+	if stream {
+		fmt.Fprintf(w, "\t%sChanges *pbs.Field[%s] `pbs:\"oneof=%s\"`\n", makeGoName(o.Name), oneofIface(o, name), o.Name)
+	}
+}
+
+// goZeroValue returns the zero value of a go type, as returned by getters
+func goZeroValue(typ string) string {
+	switch {
+	case typ == "string":
+		return "\"\""
+	case typ == "bool":
+		return "false"
+	case typ[0] == '*' || typ[0] == '[':
+		return "nil"
+	default:
+		return "0"
+	}
+}
+
+// printOneofTypes writes out the interfaces of the oneofs of a message, the
+// wrapper types of their members and their getters, and the list of
+// wrappers that protobuf needs to marshal the message
+func printOneofTypes(w io.Writer, mes *Message, name string) {
+	for _, o := range mes.Oneofs {
+		iface := oneofIface(o, name)
+		fmt.Fprintf(w, "type %s interface {\n\t%s()\n}\n\n", iface, iface)
+
+		for _, f := range o.Fields {
+			wrapper := oneofWrapper(f, name)
+			fmt.Fprintf(w, "type %s struct {\n", wrapper)
+			fmt.Fprintf(w, "\t%s %s `protobuf:\"%s,%d,opt,name=%s,oneof\"`\n",
+				makeGoName(f.Name), parseGoType(f.Type, name+"_", true), wireKind(f.Type, name+"_"), f.Number, f.Name)
+			fmt.Fprint(w, "}\n\n")
+			fmt.Fprintf(w, "func (*%s) %s() {}\n\n", wrapper, iface)
+		}
+
+		fmt.Fprintf(w, "func (m *%s) Get%s() %s {\n", name, makeGoName(o.Name), iface)
+		fmt.Fprintf(w, "\tif m != nil {\n\t\treturn m.%s\n\t}\n\treturn nil\n}\n\n", makeGoName(o.Name))
+
+		for _, f := range o.Fields {
+			typ := parseGoType(f.Type, name+"_", true)
+			fmt.Fprintf(w, "func (m *%s) Get%s() %s {\n", name, makeGoName(f.Name), typ)
+			fmt.Fprintf(w, "\tif x, ok := m.Get%s().(*%s); ok {\n", makeGoName(o.Name), oneofWrapper(f, name))
+			fmt.Fprintf(w, "\t\treturn x.%s\n\t}\n", makeGoName(f.Name))
+			fmt.Fprintf(w, "\treturn %s\n}\n\n", goZeroValue(typ))
+		}
+	}
+
+	fmt.Fprintf(w, "// XXX_OneofWrappers is for the internal use of the proto package.\n")
+	fmt.Fprintf(w, "func (*%s) XXX_OneofWrappers() []interface{} {\n", name)
+	fmt.Fprintln(w, "\treturn []interface{}{")
+	for _, o := range mes.Oneofs {
+		for _, f := range o.Fields {
+			fmt.Fprintf(w, "\t\t(*%s)(nil),\n", oneofWrapper(f, name))
+		}
+	}
+	fmt.Fprint(w, "\t}\n}\n\n")
+}
+
+// printGoService writes out the server interface, its registration function
+// and the client of the given service. Calls are carried by pbs.NewCall and
+// pbs.HandleCall; streamed requests and responses are handed out as their
+// producer and consumer views.
+func printGoService(w io.Writer, s *Service, pkg string) {
+	name := makeGoName(s.Name)
+	fullName := s.Name
+	if pkg != "" {
+		fullName = pkg + "." + s.Name
+	}
+
+	fmt.Fprintf(w, "// %sServer is the server API for the %s service\n", name, s.Name)
+	fmt.Fprintf(w, "type %sServer interface {\n", name)
+	for _, m := range s.Methods {
+		fmt.Fprintf(w, "\t%s\n", formatServerMethod(m))
+	}
+	fmt.Fprint(w, "}\n\n")
+
+	fmt.Fprintf(w, "// Register%sServer registers the methods of srv with s\n", name)
+	fmt.Fprintf(w, "func Register%sServer(s *pbs.Server, srv %sServer) {\n", name, name)
+	for _, m := range s.Methods {
+		printServerMethod(w, m, "/"+fullName+"/"+m.Name)
+	}
+	fmt.Fprint(w, "}\n\n")
+
+	fmt.Fprintf(w, "// %sClient is the client API for the %s service. Every call is\n", name, s.Name)
+	fmt.Fprintln(w, "// made over its own connection, and canceled with its context.")
+	fmt.Fprintf(w, "type %sClient struct {\n", name)
+	fmt.Fprintln(w, "\tnetwork string")
+	fmt.Fprintln(w, "\taddr    string")
+	fmt.Fprint(w, "}\n\n")
+
+	fmt.Fprintf(w, "func New%sClient(network, addr string) *%sClient {\n", name, name)
+	fmt.Fprintf(w, "\treturn &%sClient{network: network, addr: addr}\n", name)
+	fmt.Fprint(w, "}\n\n")
+
+	for _, m := range s.Methods {
+		printClientMethod(w, m, name, "/"+fullName+"/"+m.Name)
+	}
+}
+
+// formatServerMethod returns the signature of a method in the server
+// interface. Unary requests arrive fully decoded, and unary responses are
+// returned whole.
+func formatServerMethod(m *Method) string {
+	req := makeGoName(m.Request)
+	resp := makeGoName(m.Response)
+
+	args := "ctx context.Context, req *" + req
+	if m.RequestStream {
+		args += "Consumer"
+	}
+
+	if m.ResponseStream {
+		return fmt.Sprintf("%s(%s, resp *%sProducer) error", makeGoName(m.Name), args, resp)
+	}
+	return fmt.Sprintf("%s(%s) (*%s, error)", makeGoName(m.Name), args, resp)
+}
+
+// printServerMethod writes out the registration of a method's handler
+func printServerMethod(w io.Writer, m *Method, method string) {
+	req := makeGoName(m.Request)
+	resp := makeGoName(m.Response)
+
+	fmt.Fprintf(w, "\tpbs.HandleCall(s, \"%s\", func(call *pbs.ServerCall) error {\n", method)
+	fmt.Fprintf(w, "\t\treq := New%s()\n", req)
+	fmt.Fprintln(w, "\t\tif err := call.Request(req); err != nil {")
+	fmt.Fprintln(w, "\t\t\treturn err")
+	fmt.Fprintln(w, "\t\t}")
+
+	arg := "req"
+	if m.RequestStream {
+		arg = "req.Consumer()"
+	} else {
+		fmt.Fprintln(w, "\t\t<-req.Closed()")
+		fmt.Fprintln(w, "\t\tif err := req.Err(); err != nil {")
+		fmt.Fprintln(w, "\t\t\treturn err")
+		fmt.Fprintln(w, "\t\t}")
+	}
+
+	if m.ResponseStream {
+		fmt.Fprintf(w, "\t\tresp := New%s()\n", resp)
+		fmt.Fprintln(w, "\t\tif err := call.Respond(resp); err != nil {")
+		fmt.Fprintln(w, "\t\t\treturn err")
+		fmt.Fprintln(w, "\t\t}")
+		fmt.Fprintf(w, "\t\treturn srv.%s(call.Context(), %s, resp.Producer())\n", makeGoName(m.Name), arg)
+	} else {
+		fmt.Fprintf(w, "\t\tresp, err := srv.%s(call.Context(), %s)\n", makeGoName(m.Name), arg)
+		fmt.Fprintln(w, "\t\tif err != nil {")
+		fmt.Fprintln(w, "\t\t\treturn err")
+		fmt.Fprintln(w, "\t\t}")
+		fmt.Fprintln(w, "\t\tif resp == nil {")
+		fmt.Fprintf(w, "\t\t\tresp = New%s()\n", resp)
+		fmt.Fprintln(w, "\t\t}")
+		fmt.Fprintln(w, "\t\t// a response not made with its New function fails the call")
+		fmt.Fprintln(w, "\t\treturn call.Respond(resp)")
+	}
+	fmt.Fprintln(w, "\t})")
+}
+
+// printClientMethod writes out a method of the client. A unary request is
+// passed in and sent whole, a streamed one is returned for the caller to
+// send on and close. A unary response is waited for, unless the request is
+// streamed, and a streamed one is returned as it is decoded.
+func printClientMethod(w io.Writer, m *Method, service, method string) {
+	req := makeGoName(m.Request)
+	resp := makeGoName(m.Response)
+
+	args := "ctx context.Context"
+	var rets []string
+	if m.RequestStream {
+		rets = append(rets, "*"+req+"Producer")
+	} else {
+		args += ", req *" + req
+	}
+	if m.ResponseStream {
+		rets = append(rets, "*"+resp+"Consumer")
+	} else {
+		rets = append(rets, "*"+resp)
+	}
+	fail := strings.Repeat("nil, ", len(rets)) + "err"
+
+	fmt.Fprintf(w, "func (c *%sClient) %s(%s) (%s, error) {\n", service, makeGoName(m.Name), args, strings.Join(rets, ", "))
+	fmt.Fprintf(w, "\tcall, err := pbs.NewCall(ctx, c.network, c.addr, \"%s\")\n", method)
+	fmt.Fprintln(w, "\tif err != nil {")
+	fmt.Fprintf(w, "\t\treturn %s\n", fail)
+	fmt.Fprint(w, "\t}\n\n")
+
+	if m.RequestStream {
+		fmt.Fprintf(w, "\treq := New%s()\n", req)
+	}
+	fmt.Fprintln(w, "\tif err := call.Request(req); err != nil {")
+	fmt.Fprintln(w, "\t\tcall.Close()")
+	fmt.Fprintf(w, "\t\treturn %s\n", fail)
+	fmt.Fprintln(w, "\t}")
+	if !m.RequestStream {
+		fmt.Fprintln(w, "\treq.Close()")
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "\tresp := New%s()\n", resp)
+	fmt.Fprintln(w, "\tcall.Response(resp)")
+
+	switch {
+	case m.RequestStream && m.ResponseStream:
+		fmt.Fprintln(w, "\treturn req.Producer(), resp.Consumer(), nil")
+	case m.RequestStream:
+		fmt.Fprintln(w, "\treturn req.Producer(), resp, nil")
+	case m.ResponseStream:
+		fmt.Fprintln(w, "\treturn resp.Consumer(), nil")
+	default:
+		fmt.Fprintln(w, "\n\t<-resp.Closed()")
+		fmt.Fprintln(w, "\tif err := resp.Err(); err != nil {")
+		fmt.Fprintln(w, "\t\treturn nil, err")
+		fmt.Fprintln(w, "\t}")
+		fmt.Fprintln(w, "\treturn resp, nil")
+	}
+	fmt.Fprint(w, "}\n\n")
+}
@@ -6,24 +6,91 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Field struct {
-	Name      string
-	Number    int
-	Type      string
+	Name    string
+	Number  int
+	Type    string
+	Options []*FieldOption
+
+	// Attribute is the label of the field, or empty for a field of a
+	// proto3 message declared without one
 	Attribute string
+
+	// KeyType and ValueType are the types of a map field, whose Type is
+	// "map" and whose Attribute is "repeated"
+	KeyType   string
+	ValueType string
+}
+
+// FieldOption is a single option given in brackets after a field number,
+// such as [(pbs.delivery) = "drop_oldest"]
+type FieldOption struct {
+	Name  string
+	Value string
+}
+
+// Option returns the value of the named option, and whether it was set
+func (f *Field) Option(name string) (string, bool) {
+	for _, o := range f.Options {
+		if o.Name == name {
+			return o.Value, true
+		}
+	}
+	return "", false
 }
 
 type Message struct {
 	Name        string
 	Fields      []*Field
+	Oneofs      []*Oneof
+	Enums       []*Enum
 	SubMessages []*Message
 }
 
+// Enum is an enum type and its values
+type Enum struct {
+	Name   string
+	Values []*EnumValue
+}
+
+// EnumValue is a named value of an enum
+type EnumValue struct {
+	Name   string
+	Number int
+}
+
+// Oneof is a set of fields of which at most one is set at a time
+type Oneof struct {
+	Name   string
+	Fields []*Field
+}
+
+// Service is a set of rpc methods
+type Service struct {
+	Name    string
+	Methods []*Method
+}
+
+// Method is an rpc method of a service. Its request and response are
+// streamed when they are marked with stream.
+type Method struct {
+	Name           string
+	Request        string
+	Response       string
+	RequestStream  bool
+	ResponseStream bool
+}
+
 type Protobuf struct {
+	// Syntax is "proto2" or "proto3", as given by the syntax statement
+	Syntax   string
 	Package  string
 	Messages []*Message
+	Enums    []*Enum
+	Services []*Service
 }
 
 func (f *Field) ParseField(r *TokenReader) error {
@@ -33,7 +100,58 @@ func (f *Field) ParseField(r *TokenReader) error {
 	}
 
 	f.Type = typ
+	return f.parseDeclaration(r)
+}
+
+// ParseMapField parses a map field following the map keyword, such as
+// map<string, int32> counts = 4;
+func (f *Field) ParseMapField(r *TokenReader) error {
+	open, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	if open != "<" {
+		return errors.New("expected opening angle bracket after map")
+	}
+
+	key, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	comma, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	if comma != "," {
+		return errors.New("expected comma after map key type")
+	}
+
+	value, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	closing, err := r.NextToken()
+	if err != nil {
+		return err
+	}
 
+	if closing != ">" {
+		return errors.New("expected closing angle bracket after map value type")
+	}
+
+	f.Type = "map"
+	f.KeyType = key
+	f.ValueType = value
+	return f.parseDeclaration(r)
+}
+
+// parseDeclaration parses the name, number and options following the type
+// of a field
+func (f *Field) parseDeclaration(r *TokenReader) error {
 	name, err := r.NextToken()
 	if err != nil {
 		return err
@@ -67,12 +185,81 @@ func (f *Field) ParseField(r *TokenReader) error {
 		return err
 	}
 
+	if semi == "[" {
+		err := f.parseOptions(r)
+		if err != nil {
+			return err
+		}
+
+		semi, err = r.NextToken()
+		if err != nil {
+			return err
+		}
+	}
+
 	if semi != ";" {
 		return errors.New("expected a semicolon after field number")
 	}
 	return nil
 }
 
+// parseOptions parses the field options following an opening bracket
+func (f *Field) parseOptions(r *TokenReader) error {
+	for {
+		name, err := r.NextToken()
+		if err != nil {
+			return err
+		}
+
+		// extension options such as (pbs.delivery) are parenthesized
+		if name == "(" {
+			ext, err := r.NextToken()
+			if err != nil {
+				return err
+			}
+
+			closing, err := r.NextToken()
+			if err != nil {
+				return err
+			}
+
+			if closing != ")" {
+				return errors.New("expected closing parenthesis after option name")
+			}
+			name = "(" + ext + ")"
+		}
+
+		eq, err := r.NextToken()
+		if err != nil {
+			return err
+		}
+
+		if eq != "=" {
+			return errors.New("expected equals sign after option name")
+		}
+
+		val, err := r.NextToken()
+		if err != nil {
+			return err
+		}
+
+		f.Options = append(f.Options, &FieldOption{Name: name, Value: strings.Trim(val, "\"")})
+
+		sep, err := r.NextToken()
+		if err != nil {
+			return err
+		}
+
+		switch sep {
+		case ",":
+		case "]":
+			return nil
+		default:
+			return errors.New("expected comma or closing bracket after option value")
+		}
+	}
+}
+
 func ParseMessage(r *TokenReader) (*Message, error) {
 	m := new(Message)
 	mesname, err := r.NextToken()
@@ -110,6 +297,31 @@ func ParseMessage(r *TokenReader) (*Message, error) {
 
 			m.Fields = append(m.Fields, f)
 
+		case "map":
+			f := &Field{Attribute: "repeated"}
+			err := f.ParseMapField(r)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Fields = append(m.Fields, f)
+
+		case "enum":
+			e, err := ParseEnum(r)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Enums = append(m.Enums, e)
+
+		case "oneof":
+			o, err := ParseOneof(r)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Oneofs = append(m.Oneofs, o)
+
 		case "message":
 			// its a submessage!
 			subm, err := ParseMessage(r)
@@ -118,14 +330,318 @@ func ParseMessage(r *TokenReader) (*Message, error) {
 			}
 
 			m.SubMessages = append(m.SubMessages, subm)
+		default:
+			// a field without a label, which only proto3 allows
+			f := &Field{Type: tok}
+			err := f.parseDeclaration(r)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Fields = append(m.Fields, f)
+		}
+	}
+}
+
+// ParseOneof parses a oneof following the oneof keyword, such as
+// oneof event { string text = 6; int32 code = 7; }
+func ParseOneof(r *TokenReader) (*Oneof, error) {
+	o := new(Oneof)
+	name, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	openBracket, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if openBracket != "{" {
+		return nil, errors.New("expected opening bracket after oneof name")
+	}
+
+	o.Name = name
+
+	for {
+		tok, err := r.NextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok == "}" {
+			return o, nil
+		}
+
+		// the members of a oneof are optional fields without the label
+		f := &Field{Attribute: "optional", Type: tok}
+		err = f.parseDeclaration(r)
+		if err != nil {
+			return nil, err
+		}
+
+		o.Fields = append(o.Fields, f)
+	}
+}
+
+// ParseEnum parses an enum following the enum keyword, such as
+// enum Mood { CALM = 0; ANGRY = 1; }
+// Options of the enum, like allow_alias, and of its values are skipped.
+func ParseEnum(r *TokenReader) (*Enum, error) {
+	e := new(Enum)
+	name, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	openBracket, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if openBracket != "{" {
+		return nil, errors.New("expected opening bracket after enum name")
+	}
+
+	e.Name = name
+
+	for {
+		tok, err := r.NextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok {
+		case "}":
+			return e, nil
+		case ";":
+			continue
+		case "option":
+			for tok != ";" {
+				tok, err = r.NextToken()
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case "[":
+			for tok != "]" {
+				tok, err = r.NextToken()
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		eq, err := r.NextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if eq != "=" {
+			return nil, errors.New("expected equals sign after enum value name")
+		}
+
+		num, err := r.NextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Values = append(e.Values, &EnumValue{Name: tok, Number: n})
+	}
+}
+
+func ParseService(r *TokenReader) (*Service, error) {
+	s := new(Service)
+	name, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	openBracket, err := r.NextToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if openBracket != "{" {
+		return nil, errors.New("expected opening bracket after service name")
+	}
+
+	s.Name = name
+
+	for {
+		tok, err := r.NextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok {
+		case "}":
+			return s, nil
+		case "rpc":
+			m := new(Method)
+			err := m.ParseMethod(r)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Methods = append(s.Methods, m)
 		default:
 			return nil, fmt.Errorf("Unrecognized token: %s", tok)
 		}
 	}
 }
 
+// ParseMethod parses an rpc method, such as
+// rpc Chat (stream Message) returns (stream Message);
+func (m *Method) ParseMethod(r *TokenReader) error {
+	name, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	m.Name = name
+
+	m.Request, m.RequestStream, err = parseMethodType(r)
+	if err != nil {
+		return err
+	}
+
+	returns, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	if returns != "returns" {
+		return errors.New("expected returns after method request")
+	}
+
+	m.Response, m.ResponseStream, err = parseMethodType(r)
+	if err != nil {
+		return err
+	}
+
+	end, err := r.NextToken()
+	if err != nil {
+		return err
+	}
+
+	switch end {
+	case ";":
+		return nil
+	case "{":
+		closing, err := r.NextToken()
+		if err != nil {
+			return err
+		}
+
+		if closing != "}" {
+			return errors.New("method options are not supported")
+		}
+		return nil
+	default:
+		return errors.New("expected a semicolon after method response")
+	}
+}
+
+// parseMethodType parses the parenthesized request or response type of a
+// method, and whether it is marked as a stream
+func parseMethodType(r *TokenReader) (string, bool, error) {
+	open, err := r.NextToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	if open != "(" {
+		return "", false, errors.New("expected opening parenthesis before method type")
+	}
+
+	typ, err := r.NextToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	var stream bool
+	if typ == "stream" {
+		stream = true
+		typ, err = r.NextToken()
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	closing, err := r.NextToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	if closing != ")" {
+		return "", false, errors.New("expected closing parenthesis after method type")
+	}
+	return typ, stream, nil
+}
+
+// parseSyntax parses a syntax statement following the syntax keyword, such
+// as syntax = "proto3";
+func parseSyntax(r *TokenReader) (string, error) {
+	eq, err := r.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	if eq != "=" {
+		return "", errors.New("expected equals sign after syntax")
+	}
+
+	val, err := r.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	syntax := strings.Trim(val, "\"")
+	if syntax != "proto2" && syntax != "proto3" {
+		return "", fmt.Errorf("unsupported syntax %q", syntax)
+	}
+
+	semi, err := r.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	if semi != ";" {
+		return "", errors.New("expected semicolon after syntax")
+	}
+	return syntax, nil
+}
+
+// checkLabels checks the labels of the fields of mes and its submessages:
+// proto2 fields must have one, and proto3 fields cannot be required
+func checkLabels(mes *Message, proto3 bool) error {
+	for _, f := range mes.Fields {
+		switch {
+		case f.Attribute == "" && !proto3:
+			return fmt.Errorf("field %s of %s has no label", f.Name, mes.Name)
+		case f.Attribute == "required" && proto3:
+			return fmt.Errorf("field %s of %s is required, which proto3 does not allow", f.Name, mes.Name)
+		}
+	}
+	for _, subm := range mes.SubMessages {
+		err := checkLabels(subm, proto3)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ParseProtoFile(r io.Reader) (*Protobuf, error) {
-	pb := new(Protobuf)
+	pb := &Protobuf{Syntax: "proto2"}
 	read := NewTokenReader(r)
 	for {
 		tok, err := read.NextToken()
@@ -151,14 +667,41 @@ func ParseProtoFile(r io.Reader) (*Protobuf, error) {
 			if semi != ";" {
 				return nil, errors.New("expected semicolon after package name")
 			}
+		case "syntax":
+			syntax, err := parseSyntax(read)
+			if err != nil {
+				return nil, err
+			}
+			pb.Syntax = syntax
 		case "message":
 			message, err := ParseMessage(read)
 			if err != nil {
 				return nil, err
 			}
 
+			err = checkLabels(message, pb.Syntax == "proto3")
+			if err != nil {
+				return nil, err
+			}
+
 			pb.Messages = append(pb.Messages, message)
 
+		case "enum":
+			e, err := ParseEnum(read)
+			if err != nil {
+				return nil, err
+			}
+
+			pb.Enums = append(pb.Enums, e)
+
+		case "service":
+			service, err := ParseService(read)
+			if err != nil {
+				return nil, err
+			}
+
+			pb.Services = append(pb.Services, service)
+
 		default:
 			fmt.Println("Unrecognized token: ", tok)
 		}
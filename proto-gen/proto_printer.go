@@ -3,13 +3,24 @@ package main
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
 func PrintProtobuf(w io.Writer, pb *Protobuf) {
+	if pb.Syntax == "proto3" {
+		fmt.Fprintf(w, "syntax = %q;\n\n", pb.Syntax)
+	}
 	fmt.Fprintf(w, "package %s;\n\n", pb.Package)
+	for _, e := range pb.Enums {
+		PrintEnum(w, e, 0)
+	}
 	for _, mes := range pb.Messages {
 		PrintMessage(w, mes, 0)
 	}
+	for _, s := range pb.Services {
+		PrintService(w, s)
+	}
 }
 
 func writeIndent(w io.Writer, indent string, count int) {
@@ -23,9 +34,36 @@ func PrintMessage(w io.Writer, mes *Message, indent int) {
 	fmt.Fprintf(w, "message %s {\n", mes.Name)
 	for _, f := range mes.Fields {
 		writeIndent(w, "  ", indent+1)
-		fmt.Fprintf(w, "%s %s %s = %d;\n", f.Attribute, f.Type, f.Name, f.Number)
+		if f.Type == "map" {
+			fmt.Fprintf(w, "map<%s, %s> %s = %d", f.KeyType, f.ValueType, f.Name, f.Number)
+		} else if f.Attribute == "" {
+			fmt.Fprintf(w, "%s %s = %d", f.Type, f.Name, f.Number)
+		} else {
+			fmt.Fprintf(w, "%s %s %s = %d", f.Attribute, f.Type, f.Name, f.Number)
+		}
+		if len(f.Options) > 0 {
+			var opts []string
+			for _, o := range f.Options {
+				opts = append(opts, o.Name+" = "+formatOptionValue(o.Value))
+			}
+			fmt.Fprintf(w, " [%s]", strings.Join(opts, ", "))
+		}
+		fmt.Fprintln(w, ";")
+	}
+	for _, o := range mes.Oneofs {
+		writeIndent(w, "  ", indent+1)
+		fmt.Fprintf(w, "oneof %s {\n", o.Name)
+		for _, f := range o.Fields {
+			writeIndent(w, "  ", indent+2)
+			fmt.Fprintf(w, "%s %s = %d;\n", f.Type, f.Name, f.Number)
+		}
+		writeIndent(w, "  ", indent+1)
+		fmt.Fprintln(w, "}")
 	}
 	fmt.Fprintln(w)
+	for _, e := range mes.Enums {
+		PrintEnum(w, e, indent+1)
+	}
 	for _, subm := range mes.SubMessages {
 		PrintMessage(w, subm, indent+1)
 	}
@@ -33,3 +71,40 @@ func PrintMessage(w io.Writer, mes *Message, indent int) {
 	writeIndent(w, "  ", indent)
 	fmt.Fprintln(w, "}")
 }
+
+func PrintEnum(w io.Writer, e *Enum, indent int) {
+	writeIndent(w, "  ", indent)
+	fmt.Fprintf(w, "enum %s {\n", e.Name)
+	for _, v := range e.Values {
+		writeIndent(w, "  ", indent+1)
+		fmt.Fprintf(w, "%s = %d;\n", v.Name, v.Number)
+	}
+	writeIndent(w, "  ", indent)
+	fmt.Fprintln(w, "}")
+}
+
+// formatOptionValue quotes option values that are not numbers or identifiers
+func formatOptionValue(v string) string {
+	if _, err := strconv.ParseFloat(v, 64); err == nil || v == "true" || v == "false" {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+func PrintService(w io.Writer, s *Service) {
+	fmt.Fprintf(w, "service %s {\n", s.Name)
+	for _, m := range s.Methods {
+		writeIndent(w, "  ", 1)
+		fmt.Fprintf(w, "rpc %s (%s) returns (%s);\n", m.Name,
+			formatMethodType(m.Request, m.RequestStream),
+			formatMethodType(m.Response, m.ResponseStream))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func formatMethodType(typ string, stream bool) string {
+	if stream {
+		return "stream " + typ
+	}
+	return typ
+}
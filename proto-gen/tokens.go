@@ -34,8 +34,10 @@ func (tr *TokenReader) NextToken() (string, error) {
 			return "", err
 		}
 
-		if b == ' ' || b == ';' || b == '\n' || b == '\t' || b == '=' {
-			if b == ';' || b == '=' {
+		if b == ' ' || b == ';' || b == '\n' || b == '\t' || b == '=' ||
+			b == '[' || b == ']' || b == ',' || b == '(' || b == ')' ||
+			b == '{' || b == '}' || b == '<' || b == '>' {
+			if b != ' ' && b != '\n' && b != '\t' {
 				tr.next = string(b)
 			}
 			if tr.buffer.Len() > 0 {
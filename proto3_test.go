@@ -0,0 +1,126 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func encodeProto3(t *testing.T, m *TestProto3, samples []int64) []byte {
+	buf := new(bytes.Buffer)
+	err := StreamEncode(buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range samples {
+		if err := m.Samples.Send(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	<-m.Closed()
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProto3ZeroValues(t *testing.T) {
+	// only the field with explicit presence is written
+	m := NewTestProto3()
+	m.Limit = new(int32)
+	data := encodeProto3(t, m, nil)
+	if !bytes.Equal(data, []byte{3<<3 | Varint, 0}) {
+		t.Fatalf("expected only the limit to be written, got %x", data)
+	}
+}
+
+func TestUnsetOptionalFields(t *testing.T) {
+	// proto2 fields are unset when they are nil pointers or byte slices,
+	// and are not written either
+	tm := NewTestMessage()
+	tm.B = proto.String("cat")
+	buf := new(bytes.Buffer)
+	err := StreamEncode(buf, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), []byte{4<<3 | LengthDelim, 3, 'c', 'a', 't'}) {
+		t.Fatalf("expected only b to be written, got %x", buf.Bytes())
+	}
+
+	outm := new(tpb.TestMessage)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outm.A != nil || outm.D != nil || outm.E != nil || outm.GetB() != "cat" {
+		t.Fatal("plain decoder got wrong fields: ", outm)
+	}
+}
+
+func TestProto3Fields(t *testing.T) {
+	m := NewTestProto3()
+	m.Name = "cat"
+	m.Count = -3
+	m.Done = true
+	m.Level = TestProto3_SOME
+	data := encodeProto3(t, m, []int64{0, -5})
+
+	out := NewTestProto3()
+	err := StreamDecode(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []int64
+	for s := range out.Samples.C() {
+		samples = append(samples, s)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Name != "cat" || out.Count != -3 || !out.Done || out.Level != TestProto3_SOME || out.Limit != nil {
+		t.Fatal("got wrong scalars: ", out.Name, out.Count, out.Done, out.Level, out.Limit)
+	}
+	if len(samples) != 2 || samples[0] != 0 || samples[1] != -5 {
+		t.Fatal("got wrong samples: ", samples)
+	}
+
+	outm := new(tpb.TestProto3)
+	err = proto.Unmarshal(data, outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outm.Name != "cat" || outm.Count != -3 || !outm.Done || outm.Level != tpb.TestProto3_SOME {
+		t.Fatal("plain decoder got wrong scalars: ", outm)
+	}
+	if len(outm.Samples) != 2 || outm.Samples[1] != -5 {
+		t.Fatal("plain decoder got wrong samples: ", outm.Samples)
+	}
+}
+
+func TestProto3Packed(t *testing.T) {
+	props, err := GetProperties(NewTestProto3())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// repeated scalars are packed by default, strings cannot be
+	if !props.FieldMapping[4].Packed || props.FieldMapping[5].Packed {
+		t.Fatal("got wrong packing: ", props.FieldMapping[4].Packed, props.FieldMapping[5].Packed)
+	}
+}
@@ -0,0 +1,507 @@
+package pbs
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Resumable stream frames. See the wire format description next to the
+// wire types.
+const (
+	helloFrame      = 1
+	recordFrame     = 2
+	checkpointFrame = 3
+)
+
+const (
+	defaultReplayBuffer = 1024
+	defaultCheckpoint   = 64
+
+	// maxRedials is how many times in a row dialing may fail before a
+	// resumable stream gives up
+	maxRedials = 8
+)
+
+// ErrResumeMismatch is returned by ResumableDecoder.Serve for a connection
+// that carries a different stream than the one being decoded
+var ErrResumeMismatch = errors.New("pbs: connection resumes a different stream")
+
+// ErrResumeGap is returned when a resumable stream is missing records,
+// which means the two ends disagree about what has been acknowledged
+var ErrResumeGap = errors.New("pbs: records missing from resumed stream")
+
+// Dialer opens a new connection to the consumer of a resumable stream
+type Dialer func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// record is a chunk of the encoded stream, numbered so it can be replayed
+// and deduplicated
+type record struct {
+	seq  uint64
+	data []byte
+	end  bool
+}
+
+// ResumableEncoder encodes a stream over connections from a Dialer. When
+// the connection drops it dials again and replays every record the
+// consumer has not acknowledged, so the consumer sees an unbroken stream.
+type ResumableEncoder struct {
+	dial  Dialer
+	token uint64
+	limit int
+
+	// wlk serializes writes to the connection
+	wlk sync.Mutex
+
+	lk     sync.Mutex
+	seq    uint64
+	acked  uint64
+	replay []record
+
+	// last is the sequence number of the record ending the stream, once
+	// it has been written
+	last uint64
+
+	conn io.ReadWriteCloser
+	err  error
+	done chan struct{}
+
+	// changed is closed and replaced whenever records are acknowledged or
+	// the encoder fails
+	changed chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ResumableEncode starts encoding sm over connections obtained from dial,
+// and returns once the scalar fields have been buffered. Once sm is closed
+// and every value has been acknowledged by the consumer, the connection is
+// closed and Done is closed. Dialing is retried with a backoff, and the
+// stream fails if it fails too many times in a row.
+func ResumableEncode(dial Dialer, sm StreamMessage, opts ...EncodeOption) (*ResumableEncoder, error) {
+	cfg := new(encodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	var token [8]byte
+	_, err := rand.Read(token[:])
+	if err != nil {
+		return nil, err
+	}
+
+	re := &ResumableEncoder{
+		dial:    dial,
+		token:   binary.BigEndian.Uint64(token[:]),
+		limit:   cfg.replay,
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	if re.limit <= 0 {
+		re.limit = defaultReplayBuffer
+	}
+	re.ctx, re.cancel = context.WithCancel(context.Background())
+
+	err = StreamEncode(re, sm, opts...)
+	if err != nil {
+		re.cancel()
+		return nil, err
+	}
+
+	go re.run(sm)
+	go func() {
+		select {
+		case <-sm.Closed():
+			re.end()
+		case <-re.ctx.Done():
+		}
+	}()
+	return re, nil
+}
+
+// Done returns a channel that is closed once the consumer has acknowledged
+// the whole stream, or the encoder has failed
+func (re *ResumableEncoder) Done() <-chan struct{} {
+	return re.done
+}
+
+// Err returns the error the encoder failed with, if any
+func (re *ResumableEncoder) Err() error {
+	re.lk.Lock()
+	defer re.lk.Unlock()
+	return re.err
+}
+
+// Write adds b to the stream as one or more records, sending them if
+// connected. It blocks while the replay buffer is full.
+func (re *ResumableEncoder) Write(b []byte) (int, error) {
+	var n int
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > maxFrameData {
+			chunk = chunk[:maxFrameData]
+		}
+
+		err := re.append(record{data: append([]byte(nil), chunk...)})
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// end adds the record that marks the end of the stream
+func (re *ResumableEncoder) end() {
+	re.append(record{end: true})
+}
+
+func (re *ResumableEncoder) append(r record) error {
+	re.lk.Lock()
+	for len(re.replay) >= re.limit && re.err == nil {
+		changed := re.changed
+		re.lk.Unlock()
+		<-changed
+		re.lk.Lock()
+	}
+	re.lk.Unlock()
+
+	re.wlk.Lock()
+	defer re.wlk.Unlock()
+
+	re.lk.Lock()
+	if re.err != nil {
+		re.lk.Unlock()
+		return re.err
+	}
+	re.seq++
+	r.seq = re.seq
+	if r.end {
+		re.last = r.seq
+	}
+	re.replay = append(re.replay, r)
+	conn := re.conn
+	re.lk.Unlock()
+
+	if conn != nil {
+		err := writeRecord(conn, r)
+		if err != nil {
+			// the reader notices too, and reconnects
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// fail stops the encoder with err, unless it has already stopped
+func (re *ResumableEncoder) fail(err error) {
+	re.lk.Lock()
+	defer re.lk.Unlock()
+
+	if re.err != nil {
+		return
+	}
+	re.err = err
+	close(re.changed)
+	re.changed = make(chan struct{})
+	re.cancel()
+}
+
+// run keeps the encoder connected until the stream has been acknowledged
+func (re *ResumableEncoder) run(sm StreamMessage) {
+	defer close(re.done)
+
+	backoff := 50 * time.Millisecond
+	failures := 0
+	for {
+		conn, err := re.dial(re.ctx)
+		if err == nil {
+			var finished, resumed bool
+			finished, resumed, err = re.serve(conn)
+			conn.Close()
+			if finished {
+				re.cancel()
+				return
+			}
+			if err == ErrResumeGap {
+				re.fail(err)
+				reportError(sm, err)
+				return
+			}
+			if resumed {
+				failures = 0
+				backoff = 50 * time.Millisecond
+				continue
+			}
+		}
+		if re.ctx.Err() != nil {
+			return
+		}
+
+		// the consumer could not be reached
+		failures++
+		if failures >= maxRedials {
+			re.fail(err)
+			reportError(sm, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-re.ctx.Done():
+			return
+		}
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// serve resumes the stream over conn. It returns whether the consumer has
+// acknowledged the end of the stream, and whether the stream was resumed
+// at all before the connection failed.
+func (re *ResumableEncoder) serve(conn io.ReadWriteCloser) (bool, bool, error) {
+	err := writeControlFrame(conn, helloFrame, re.token)
+	if err != nil {
+		return false, false, err
+	}
+
+	r := bufio.NewReader(conn)
+	f, err := readControlFrame(r)
+	if err != nil {
+		return false, false, err
+	}
+	if f.kind != checkpointFrame {
+		return false, false, errMalformedFrame
+	}
+
+	err = re.checkpoint(f.ints[1])
+	if err != nil {
+		return false, false, err
+	}
+
+	// acknowledgements are read while replaying, so neither end of the
+	// connection blocks the other
+	acked := make(chan error, 1)
+	go func() {
+		acked <- re.readCheckpoints(r)
+	}()
+
+	defer func() {
+		re.lk.Lock()
+		if re.conn == conn {
+			re.conn = nil
+		}
+		re.lk.Unlock()
+	}()
+
+	// replay whatever the consumer is missing, then start sending new
+	// records as they are written
+	re.wlk.Lock()
+	re.lk.Lock()
+	replay := append([]record(nil), re.replay...)
+	re.lk.Unlock()
+
+	for _, rec := range replay {
+		err := writeRecord(conn, rec)
+		if err != nil {
+			re.wlk.Unlock()
+			return false, true, err
+		}
+	}
+	re.lk.Lock()
+	re.conn = conn
+	re.lk.Unlock()
+	re.wlk.Unlock()
+
+	err = <-acked
+	return err == nil, true, err
+}
+
+// readCheckpoints handles the consumer's checkpoints until it has
+// acknowledged the end of the stream, which returns nil
+func (re *ResumableEncoder) readCheckpoints(r *bufio.Reader) error {
+	for {
+		f, err := readControlFrame(r)
+		if err != nil {
+			return err
+		}
+		if f.kind != checkpointFrame {
+			return errMalformedFrame
+		}
+
+		err = re.checkpoint(f.ints[1])
+		if err != nil {
+			return err
+		}
+
+		re.lk.Lock()
+		finished := re.last != 0 && re.acked >= re.last
+		re.lk.Unlock()
+		if finished {
+			return nil
+		}
+	}
+}
+
+// checkpoint drops every record up to seq from the replay buffer
+func (re *ResumableEncoder) checkpoint(seq uint64) error {
+	re.lk.Lock()
+	defer re.lk.Unlock()
+
+	if seq > re.seq || seq < re.acked {
+		return ErrResumeGap
+	}
+
+	for len(re.replay) > 0 && re.replay[0].seq <= seq {
+		re.replay = re.replay[1:]
+	}
+	re.acked = seq
+
+	close(re.changed)
+	re.changed = make(chan struct{})
+	return nil
+}
+
+func writeRecord(w io.Writer, r record) error {
+	var end uint64
+	if r.end {
+		end = 1
+	}
+	return writeControlFrame(w, recordFrame, r.seq, r.data, end)
+}
+
+// ResumableDecoder decodes a stream written by a ResumableEncoder, over
+// any number of connections in turn
+type ResumableDecoder struct {
+	buf   *streamBuffer
+	every int
+
+	lk    sync.Mutex
+	token uint64
+	bound bool
+	seq   uint64
+	ended bool
+}
+
+// NewResumableDecoder starts decoding into sm. The stream's data is read
+// from the connections passed to Serve.
+func NewResumableDecoder(sm StreamMessage, opts ...DecodeOption) (*ResumableDecoder, error) {
+	cfg := new(decodeConfig)
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	rd := &ResumableDecoder{
+		buf:   newStreamBuffer(),
+		every: cfg.checkpoint,
+	}
+	if rd.every <= 0 {
+		rd.every = defaultCheckpoint
+	}
+
+	err := StreamDecode(rd.buf, sm, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop buffering data once the consumer is gone
+	go func() {
+		<-sm.Closed()
+		rd.buf.discard()
+	}()
+	return rd, nil
+}
+
+// Serve reads the stream from conn, a connection dialed by the encoder,
+// until the stream ends or the connection fails. A connection that drops
+// can be replaced by passing the encoder's next connection to Serve, and
+// the stream carries on where it left off. Serve returns nil once the
+// whole stream has been received.
+func (rd *ResumableDecoder) Serve(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	f, err := readControlFrame(r)
+	if err != nil {
+		return err
+	}
+	if f.kind != helloFrame {
+		return errMalformedFrame
+	}
+
+	rd.lk.Lock()
+	if rd.bound && rd.token != f.ints[1] {
+		rd.lk.Unlock()
+		return ErrResumeMismatch
+	}
+	rd.bound = true
+	rd.token = f.ints[1]
+	seq := rd.seq
+	rd.lk.Unlock()
+
+	// tell the encoder where to resume from
+	err = writeControlFrame(conn, checkpointFrame, seq)
+	if err != nil {
+		return err
+	}
+
+	var unacked int
+	for {
+		f, err := readControlFrame(r)
+		if err != nil {
+			return err
+		}
+		if f.kind != recordFrame {
+			return errMalformedFrame
+		}
+
+		seq, end, err := rd.receive(f)
+		if err != nil {
+			return err
+		}
+
+		unacked++
+		if unacked >= rd.every || end {
+			err := writeControlFrame(conn, checkpointFrame, seq)
+			if err != nil {
+				return err
+			}
+			unacked = 0
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+// receive hands a record to the decoder, unless it is a duplicate. It
+// returns the sequence number received so far.
+func (rd *ResumableDecoder) receive(f *controlFrame) (uint64, bool, error) {
+	rd.lk.Lock()
+	defer rd.lk.Unlock()
+
+	seq := f.ints[1]
+	switch {
+	case seq <= rd.seq:
+		// replayed after a reconnect, already have it
+		return rd.seq, rd.ended, nil
+	case seq != rd.seq+1:
+		return 0, false, ErrResumeGap
+	}
+
+	rd.seq = seq
+	if f.ints[3] != 0 {
+		rd.ended = true
+		rd.buf.end(io.EOF)
+	} else {
+		rd.buf.write(f.data[2])
+	}
+	return rd.seq, rd.ended, nil
+}
@@ -0,0 +1,168 @@
+package pbs_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+// resumeDialer connects a resumable encoder to rd over in-memory pipes,
+// and lets the test drop the current connection
+type resumeDialer struct {
+	rd *ResumableDecoder
+
+	lk    sync.Mutex
+	conn  net.Conn
+	dials int
+}
+
+func (d *resumeDialer) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	a, b := net.Pipe()
+	go d.rd.Serve(b)
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.conn = a
+	d.dials++
+	return a, nil
+}
+
+func (d *resumeDialer) drop() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.conn.Close()
+}
+
+func TestResumableStream(t *testing.T) {
+	out := NewTestMessage()
+	rd, err := NewResumableDecoder(out, CheckpointEvery(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &resumeDialer{rd: rd}
+	tm := NewTestMessage()
+	re, err := ResumableEncode(d.dial, tm, ReplayBuffer(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			tm.Repstring.Send(context.Background(), fmt.Sprint("value ", i))
+		}
+		tm.Close()
+	}()
+
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+		if len(strs)%7 == 0 {
+			// values in flight are replayed over the next connection
+			d.drop()
+		}
+	}
+
+	if len(strs) != 20 {
+		t.Fatal("expected every value exactly once, got: ", strs)
+	}
+	for i, s := range strs {
+		if s != fmt.Sprint("value ", i) {
+			t.Fatal("values were not delivered in order: ", strs)
+		}
+	}
+
+	select {
+	case <-re.Done():
+	case <-time.After(time.Second):
+		t.Fatal("encoder never finished")
+	}
+	if err := re.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.dials < 2 {
+		t.Fatal("expected the encoder to reconnect, dials: ", d.dials)
+	}
+}
+
+func TestResumeMismatch(t *testing.T) {
+	rd, err := NewResumableDecoder(NewTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := func(token byte) error {
+		a, b := net.Pipe()
+		defer a.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- rd.Serve(b)
+		}()
+
+		// Hello{token}
+		a.Write([]byte{0x0a, 2, 0x08, token})
+		a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		a.Read(make([]byte, 16))
+		a.Close()
+		return <-errs
+	}
+
+	if err := hello(1); err == ErrResumeMismatch {
+		t.Fatal("first connection was rejected")
+	}
+	if err := hello(2); err != ErrResumeMismatch {
+		t.Fatal("expected ErrResumeMismatch, got: ", err)
+	}
+}
+
+func TestResumableLargeValue(t *testing.T) {
+	out := NewTestMessage()
+	rd, err := NewResumableDecoder(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a value larger than a single record
+	big := string(make([]byte, 2<<20))
+	d := &resumeDialer{rd: rd}
+	tm := NewTestMessage()
+	re, err := ResumableEncode(d.dial, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		tm.Repstring.Send(context.Background(), big)
+		tm.Close()
+	}()
+
+	var strs []string
+	for s := range out.Repstring.C() {
+		strs = append(strs, s)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 1 || strs[0] != big {
+		t.Fatal("got wrong values: ", len(strs))
+	}
+
+	select {
+	case <-re.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("encoder never finished")
+	}
+	if err := re.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
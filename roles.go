@@ -0,0 +1,67 @@
+package pbs
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrStreamBound is returned when a stream that is already being encoded
+// or decoded is passed to StreamEncode or StreamDecode again
+var ErrStreamBound = errors.New("pbs: stream is already being encoded or decoded")
+
+// Producer is the view of a stream held by the code that produces its
+// values. The producer owns the stream: it sends values on the repeated
+// fields and closes the stream once it is done. Closed fires once the
+// encoder has written everything out, and Err reports write errors.
+type Producer interface {
+	io.Closer
+	Err() error
+	Closed() <-chan struct{}
+
+	// Source returns the message the encoder reads values from
+	Source() StreamMessage
+}
+
+// Consumer is the view of a stream held by the code that receives decoded
+// values. The repeated fields belong to the decoder, which closes them when
+// the input ends; the consumer only receives from them. Closing a consumer
+// abandons the stream early. Err reports decode errors.
+type Consumer interface {
+	io.Closer
+	Err() error
+	Closed() <-chan struct{}
+
+	// Sink returns the message the decoder delivers values to
+	Sink() StreamMessage
+}
+
+// Encode starts encoding the stream of the producer p to w.
+// See StreamEncode for details.
+func Encode(w io.Writer, p Producer) error {
+	return StreamEncode(w, p.Source())
+}
+
+// Decode starts decoding r into the stream of the consumer c.
+// See StreamDecode for details.
+func Decode(r io.Reader, c Consumer) error {
+	return StreamDecode(r, c.Sink())
+}
+
+const (
+	roleNone = iota
+	roleEncoder
+	roleDecoder
+)
+
+// bind claims the stream for the encoder or decoder. A stream can only be
+// claimed once.
+func (s *Stream) bind(role int) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.role != roleNone {
+		return ErrStreamBound
+	}
+	s.role = role
+	return nil
+}
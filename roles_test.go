@@ -0,0 +1,88 @@
+package pbs_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func TestProducerConsumer(t *testing.T) {
+	r, w := io.Pipe()
+
+	cons := NewTestMessage().Consumer()
+	err := Decode(r, cons)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prod := NewTestMessage().Producer()
+	err = Encode(w, prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		for _, s := range []string{"cat", "dog"} {
+			if err := prod.Repstring.Send(ctx, s); err != nil {
+				t.Error(err)
+			}
+		}
+		prod.Close()
+		<-prod.Closed()
+		w.Close()
+	}()
+
+	var out []string
+	for s := range cons.Repstring.C() {
+		out = append(out, s)
+	}
+
+	if len(out) != 2 || out[0] != "cat" || out[1] != "dog" {
+		t.Fatal("got wrong values from consumer: ", out)
+	}
+
+	<-cons.Closed()
+	if err := cons.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerFieldsReceiveOnly(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	tm := NewTestMessage()
+	err := StreamDecode(r, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tm.Repstring.Send(context.Background(), "not allowed")
+	if err != ErrReceiveOnly {
+		t.Fatal("expected ErrReceiveOnly, got: ", err)
+	}
+}
+
+func TestStreamBoundOnce(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	tm := NewTestMessage()
+	err := StreamDecode(r, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = StreamEncode(io.Discard, tm)
+	if err != ErrStreamBound {
+		t.Fatal("expected ErrStreamBound, got: ", err)
+	}
+
+	err = StreamDecode(r, tm)
+	if err != ErrStreamBound {
+		t.Fatal("expected ErrStreamBound, got: ", err)
+	}
+}
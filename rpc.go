@@ -0,0 +1,166 @@
+package pbs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// The types of the two streams of a call's session
+const (
+	requestStream  = "request"
+	responseStream = "response"
+)
+
+// ErrResponded is returned by ServerCall.Respond when the call already has
+// a response
+var ErrResponded = errors.New("pbs: call already has a response")
+
+// ServerCall is a call being served by a handler registered with
+// HandleCall
+type ServerCall struct {
+	sess *Session
+	ctx  context.Context
+	resp StreamMessage
+}
+
+// HandleCall registers h to serve calls of method, as made with NewCall.
+// The call's response is ended when h returns, failing with the error h
+// returned, if any. A call that h did not respond to gets an empty
+// response.
+func HandleCall(s *Server, method string, h func(call *ServerCall) error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.handlers[method] = func(ctx context.Context, conn io.ReadWriteCloser) {
+		sess := NewSession(conn, false)
+		defer sess.Close()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-sess.Closed():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		call := &ServerCall{sess: sess, ctx: ctx}
+		call.finish(h(call))
+
+		// the client closes the session once it has the whole response
+		<-ctx.Done()
+	}
+}
+
+// Context returns the context of the call, which is canceled when the
+// client cancels the call or goes away, or the server is closed
+func (c *ServerCall) Context() context.Context {
+	return c.ctx
+}
+
+// Request waits for the client to open the request stream, and starts
+// decoding it into req
+func (c *ServerCall) Request(req StreamMessage, opts ...DecodeOption) error {
+	return c.sess.Accept(c.ctx, requestStream, req, opts...)
+}
+
+// Respond starts encoding resp as the response to the call. resp is closed
+// once the handler returns, with the handler's error if it returns one. A
+// handler that closes resp itself ends the response early, and an error it
+// returns after that is dropped.
+func (c *ServerCall) Respond(resp StreamMessage, opts ...EncodeOption) error {
+	if c.resp != nil {
+		return ErrResponded
+	}
+
+	err := c.sess.Open(responseStream, resp, opts...)
+	if err != nil {
+		return err
+	}
+	c.resp = resp
+	return nil
+}
+
+// finish ends the response with the handler's error
+func (c *ServerCall) finish(err error) {
+	if c.resp == nil {
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		c.sess.openEnded(responseStream, msg)
+		return
+	}
+
+	if err != nil {
+		if st := getStream(c.resp); st != nil {
+			select {
+			case <-st.Closing():
+				// the handler already ended the response
+				return
+			default:
+			}
+		}
+		reportError(c.resp, err)
+		return
+	}
+	c.resp.Close()
+}
+
+// ClientCall is a call of a method on a server
+type ClientCall struct {
+	sess *Session
+	ctx  context.Context
+}
+
+// NewCall connects to the server at addr and starts a call of method.
+// Canceling ctx cancels the call, failing its streams with the context's
+// error.
+func NewCall(ctx context.Context, network, addr, method string) (*ClientCall, error) {
+	conn, err := dialServer(ctx, network, addr, method)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := NewSession(conn, true)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.fail(ctx.Err())
+			sess.conn.Close()
+		case <-sess.Closed():
+		}
+	}()
+	return &ClientCall{sess: sess, ctx: ctx}, nil
+}
+
+// Request starts encoding req as the request of the call
+func (c *ClientCall) Request(req StreamMessage, opts ...EncodeOption) error {
+	return c.sess.Open(requestStream, req, opts...)
+}
+
+// Response decodes the response of the call into resp once the server
+// responds, and returns right away. If the handler failed, or the call
+// failed before the response arrived, resp fails with the error; a
+// handler's error arrives as a *RemoteError. The call is closed once resp
+// is closed.
+func (c *ClientCall) Response(resp StreamMessage, opts ...DecodeOption) {
+	go func() {
+		defer c.Close()
+
+		err := c.sess.Accept(c.ctx, responseStream, resp, opts...)
+		if err != nil {
+			reportError(resp, err)
+			resp.Close()
+			return
+		}
+		<-resp.Closed()
+	}()
+}
+
+// Close ends the call, canceling it on the server if it has not finished
+func (c *ClientCall) Close() error {
+	return c.sess.Close()
+}
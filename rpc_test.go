@@ -0,0 +1,298 @@
+package pbs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+// startEchoServer serves a method that echoes the strings of its request,
+// failing on the string "fail"
+func startEchoServer(t *testing.T, canceled chan<- struct{}) *Server {
+	s := NewServer()
+	HandleCall(s, "/test.Echo/Echo", func(call *ServerCall) error {
+		req := NewTestMessage()
+		if err := call.Request(req); err != nil {
+			return err
+		}
+
+		resp := NewTestMessage()
+		if err := call.Respond(resp); err != nil {
+			return err
+		}
+
+		ctx := call.Context()
+		for {
+			v, err := req.Repstring.Recv(ctx)
+			if err != nil {
+				if canceled != nil {
+					<-ctx.Done()
+					close(canceled)
+				}
+				return req.Err()
+			}
+			if v == "fail" {
+				return errors.New("cannot echo fail")
+			}
+			if err := resp.Repstring.Send(ctx, v); err != nil {
+				return err
+			}
+		}
+	})
+	return s
+}
+
+func TestCall(t *testing.T) {
+	s := startEchoServer(t, nil)
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	call, err := NewCall(ctx, "tcp", addr, "/test.Echo/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, resp := NewTestMessage(), NewTestMessage()
+	if err := call.Request(req); err != nil {
+		t.Fatal(err)
+	}
+	call.Response(resp)
+
+	for _, v := range []string{"cat", "dog"} {
+		if err := req.Repstring.Send(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := resp.Repstring.Recv(ctx)
+		if err != nil || got != v {
+			t.Fatalf("expected %q, got %q: %v", v, got, err)
+		}
+	}
+	req.Close()
+
+	<-resp.Closed()
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing handler fails the response of its call only
+	call, err = NewCall(ctx, "tcp", addr, "/test.Echo/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, resp = NewTestMessage(), NewTestMessage()
+	call.Request(req)
+	call.Response(resp)
+	req.Repstring.Send(ctx, "fail")
+
+	<-resp.Closed()
+	rerr, ok := resp.Err().(*RemoteError)
+	if !ok || rerr.Msg != "cannot echo fail" {
+		t.Fatal("expected the handler's error, got: ", resp.Err())
+	}
+
+	if _, err := NewCall(ctx, "tcp", addr, "/test.Echo/Nope"); err != ErrUnknownType {
+		t.Fatal("expected ErrUnknownType, got: ", err)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	canceled := make(chan struct{})
+	s := startEchoServer(t, canceled)
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call, err := NewCall(ctx, "tcp", addr, "/test.Echo/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, resp := NewTestMessage(), NewTestMessage()
+	call.Request(req)
+	call.Response(resp)
+
+	req.Repstring.Send(ctx, "cat")
+	if _, err := resp.Repstring.Recv(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	<-resp.Closed()
+	if resp.Err() != context.Canceled {
+		t.Fatal("expected the call to be canceled, got: ", resp.Err())
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler was not canceled")
+	}
+}
+
+func TestCallHandlerClosesResponse(t *testing.T) {
+	s := NewServer()
+	HandleCall(s, "/test.Echo/Close", func(call *ServerCall) error {
+		resp := NewTestMessage()
+		if err := call.Respond(resp); err != nil {
+			return err
+		}
+		resp.Producer().Close()
+		<-resp.Closed()
+		return errors.New("too late")
+	})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		call, err := NewCall(ctx, "tcp", addr, "/test.Echo/Close")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := NewTestMessage()
+		call.Response(resp)
+
+		// the response ended before the handler's error
+		select {
+		case <-resp.Closed():
+		case <-ctx.Done():
+			t.Fatal("response was never closed")
+		}
+		if err := resp.Err(); err != nil {
+			t.Fatal("expected the response to end cleanly, got: ", err)
+		}
+	}
+}
+
+// testService implements the service of the test protobuf
+type testService struct{}
+
+func (testService) Echo(ctx context.Context, req *TestMessage) (*TestMessage, error) {
+	if req.B != nil && *req.B == "literal" {
+		// not made with NewTestMessage
+		return &TestMessage{B: req.B}, nil
+	}
+	resp := NewTestMessage()
+	resp.B = proto.String("echo " + *req.B)
+	return resp, nil
+}
+
+func (testService) Split(ctx context.Context, req *TestMessage, resp *TestMessageProducer) error {
+	for _, c := range *req.B {
+		if err := resp.Repstring.Send(ctx, string(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (testService) Count(ctx context.Context, req *TestMessageConsumer) (*TestMessage, error) {
+	var n int32
+	for range req.Repstring.C() {
+		n++
+	}
+	resp := NewTestMessage()
+	resp.A = proto.Int32(n)
+	return resp, nil
+}
+
+func (testService) Chat(ctx context.Context, req *TestMessageConsumer, resp *TestMessageProducer) error {
+	for s := range req.Repstring.C() {
+		if err := resp.Repstring.Send(ctx, "echo "+s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGeneratedService(t *testing.T) {
+	s := NewServer()
+	RegisterTestServiceServer(s, testService{})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c := NewTestServiceClient("tcp", addr)
+
+	req := NewTestMessage()
+	req.B = proto.String("cat")
+	resp, err := c.Echo(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.B == nil || *resp.B != "echo cat" {
+		t.Fatal("got wrong echo: ", resp.B)
+	}
+
+	// a response literal fails the call instead of the server
+	req = NewTestMessage()
+	req.B = proto.String("literal")
+	_, err = c.Echo(ctx, req)
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Msg != ErrNilStream.Error() {
+		t.Fatal("expected the nil stream error, got: ", err)
+	}
+
+	req = NewTestMessage()
+	req.B = proto.String("dog")
+	split, err := c.Split(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	for s := range split.Repstring.C() {
+		parts = append(parts, s)
+	}
+	<-split.Closed()
+	if err := split.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 3 || parts[2] != "g" {
+		t.Fatal("got wrong parts: ", parts)
+	}
+
+	up, count, err := c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b"} {
+		if err := up.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	up.Close()
+	<-count.Closed()
+	if err := count.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count.A == nil || *count.A != 2 {
+		t.Fatal("got wrong count: ", count.A)
+	}
+
+	chatUp, chatDown, err := c.Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chatUp.Repstring.Send(ctx, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := chatDown.Repstring.Recv(ctx)
+	if err != nil || got != "echo hi" {
+		t.Fatal("got wrong chat reply: ", got, err)
+	}
+	chatUp.Close()
+	for range chatDown.Repstring.C() {
+	}
+	<-chatDown.Closed()
+	if err := chatDown.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
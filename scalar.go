@@ -0,0 +1,154 @@
+package pbs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// appendWireVal appends the encoding of val, without a tag, to b. Values of
+// the bytes encoding are length delimited.
+func appendWireVal(b []byte, enc Encoding, val interface{}) ([]byte, error) {
+	v := reflect.ValueOf(val)
+	kind := v.Kind()
+	signed := kind == reflect.Int32 || kind == reflect.Int64
+	unsigned := kind == reflect.Uint32 || kind == reflect.Uint64
+
+	switch {
+	case enc == EncodeVarint && kind == reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case enc == EncodeVarint && signed:
+		// enums are named int32 types
+		return append(b, proto.EncodeVarint(uint64(v.Int()))...), nil
+	case enc == EncodeVarint && unsigned:
+		return append(b, proto.EncodeVarint(v.Uint())...), nil
+	case enc == EncodeZigzag && signed:
+		n := v.Int()
+		return append(b, proto.EncodeVarint(uint64(n<<1^n>>63))...), nil
+	case enc == EncodeFixed32 && kind == reflect.Float32:
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float()))), nil
+	case enc == EncodeFixed32 && (kind == reflect.Int32 || kind == reflect.Uint32):
+		return binary.LittleEndian.AppendUint32(b, uint32(scalarBits(v))), nil
+	case enc == EncodeFixed64 && kind == reflect.Float64:
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	case enc == EncodeFixed64 && (kind == reflect.Int64 || kind == reflect.Uint64):
+		return binary.LittleEndian.AppendUint64(b, scalarBits(v)), nil
+	case enc == EncodeBytes:
+		var data []byte
+		switch val := val.(type) {
+		case proto.Message:
+			var err error
+			data, err = proto.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+		case string:
+			data = []byte(val)
+		case []byte:
+			data = val
+		default:
+			return nil, fmt.Errorf("pbs: cannot encode a %T as bytes", val)
+		}
+		b = append(b, proto.EncodeVarint(uint64(len(data)))...)
+		return append(b, data...), nil
+	}
+	return nil, fmt.Errorf("pbs: cannot encode a %T as %s", val, enc)
+}
+
+// scalarBits returns the bits of an integer value, as an unsigned integer
+func scalarBits(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	default:
+		return v.Uint()
+	}
+}
+
+// fixedSize returns the number of bytes of a value of a fixed width wire
+// type
+func fixedSize(typ byte) int {
+	if typ == Bit32 {
+		return 4
+	}
+	return 8
+}
+
+// readFixed reads a little endian value of a fixed width wire type
+func readFixed(r io.Reader, typ byte) (uint64, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf[:fixedSize(typ)])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// setWireVal sets v, a field of a message, the key or value of a map entry
+// or the member of a oneof, from a value of the given encoding. A varint or
+// fixed width value is given by x, and a length delimited one by b.
+func setWireVal(v reflect.Value, enc Encoding, typ byte, x uint64, b []byte) error {
+	if typ != enc.wireType() {
+		return fmt.Errorf("pbs: got a value of wire type %d for a %s field", typ, enc)
+	}
+
+	kind := v.Kind()
+	if kind == reflect.Ptr && !v.Type().Implements(protoMessageType) {
+		// an optional scalar
+		nv := reflect.New(v.Type().Elem())
+		err := setWireVal(nv.Elem(), enc, typ, x, b)
+		if err != nil {
+			return err
+		}
+		v.Set(nv)
+		return nil
+	}
+
+	if typ != LengthDelim {
+		if enc == EncodeZigzag {
+			x = uint64(int64(x>>1) ^ -int64(x&1))
+		}
+
+		switch {
+		case kind == reflect.Bool && typ == Varint:
+			v.SetBool(x != 0)
+		case kind == reflect.Int32 || kind == reflect.Int64:
+			v.SetInt(int64(x))
+		case kind == reflect.Uint32 || kind == reflect.Uint64:
+			v.SetUint(x)
+		case kind == reflect.Float32 && typ == Bit32:
+			v.SetFloat(float64(math.Float32frombits(uint32(x))))
+		case kind == reflect.Float64 && typ == Int64:
+			v.SetFloat(math.Float64frombits(x))
+		default:
+			return fmt.Errorf("pbs: cannot decode a %s value into a %s", enc, v.Type())
+		}
+		return nil
+	}
+
+	switch {
+	case kind == reflect.String:
+		v.SetString(string(b))
+	case kind == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(b)
+	case kind == reflect.Ptr:
+		m := reflect.New(v.Type().Elem())
+		err := proto.Unmarshal(b, m.Interface().(proto.Message))
+		if err != nil {
+			return err
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("pbs: cannot decode a length delimited value into a %s", v.Type())
+	}
+	return nil
+}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
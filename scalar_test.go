@@ -0,0 +1,199 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+// scalarCases holds a value of every protobuf scalar type, by the name of
+// the field of that type in the scalar test messages
+var scalarCases = []struct {
+	field string
+	val   interface{}
+}{
+	{"I32", int32(math.MinInt32)},
+	{"I64", int64(math.MinInt64)},
+	{"U32", uint32(math.MaxUint32)},
+	{"U64", uint64(math.MaxUint64)},
+	{"Si32", int32(math.MinInt32)},
+	{"Si64", int64(math.MinInt64)},
+	{"Fx32", uint32(math.MaxUint32)},
+	{"Fx64", uint64(math.MaxUint64)},
+	{"Sfx32", int32(-9)},
+	{"Sfx64", int64(-1 << 45)},
+	{"B", true},
+	{"F", float32(-1.5)},
+	{"D", math.Pi},
+	{"S", "héllo"},
+	{"Bs", []byte{0, 255}},
+}
+
+// testScalarValues holds its scalars by value, as proto3 messages do
+type testScalarValues struct {
+	I32   int32   `protobuf:"int32,1,opt,name=i32"`
+	I64   int64   `protobuf:"int64,2,opt,name=i64"`
+	U32   uint32  `protobuf:"uint32,3,opt,name=u32"`
+	U64   uint64  `protobuf:"uint64,4,opt,name=u64"`
+	Si32  int32   `protobuf:"sint32,5,opt,name=si32"`
+	Si64  int64   `protobuf:"sint64,6,opt,name=si64"`
+	Fx32  uint32  `protobuf:"fixed32,7,opt,name=fx32"`
+	Fx64  uint64  `protobuf:"fixed64,8,opt,name=fx64"`
+	Sfx32 int32   `protobuf:"sfixed32,9,opt,name=sfx32"`
+	Sfx64 int64   `protobuf:"sfixed64,10,opt,name=sfx64"`
+	B     bool    `protobuf:"bool,11,opt,name=b"`
+	F     float32 `protobuf:"float,12,opt,name=f"`
+	D     float64 `protobuf:"double,13,opt,name=d"`
+	S     string  `protobuf:"string,14,opt,name=s"`
+	Bs    []byte  `protobuf:"bytes,15,opt,name=bs"`
+	*Stream
+}
+
+func (*testScalarValues) ProtoMessage() {}
+
+func (m *testScalarValues) String() string { return proto.CompactTextString(m) }
+
+func (m *testScalarValues) Reset() { *m = testScalarValues{Stream: NewStream()} }
+
+// scalarForm is a way of holding a scalar in a stream message
+type scalarForm struct {
+	name  string
+	new   func() StreamMessage
+	set   func(f reflect.Value, val interface{})
+	get   func(t *testing.T, m StreamMessage, field string) interface{}
+	plain func() proto.Message
+}
+
+var scalarForms = []scalarForm{
+	{
+		name: "pointer",
+		new:  func() StreamMessage { return NewTestScalars() },
+		set: func(f reflect.Value, val interface{}) {
+			if f.Kind() != reflect.Ptr {
+				f.Set(reflect.ValueOf(val))
+				return
+			}
+			p := reflect.New(f.Type().Elem())
+			p.Elem().Set(reflect.ValueOf(val))
+			f.Set(p)
+		},
+		get: func(t *testing.T, m StreamMessage, field string) interface{} {
+			<-m.Closed()
+			return reflect.Indirect(reflect.ValueOf(m).Elem().FieldByName(field)).Interface()
+		},
+		plain: func() proto.Message { return new(tpb.TestScalars) },
+	},
+	{
+		name: "value",
+		new:  func() StreamMessage { return &testScalarValues{Stream: NewStream()} },
+		set: func(f reflect.Value, val interface{}) {
+			f.Set(reflect.ValueOf(val))
+		},
+		get: func(t *testing.T, m StreamMessage, field string) interface{} {
+			<-m.Closed()
+			return reflect.ValueOf(m).Elem().FieldByName(field).Interface()
+		},
+		plain: func() proto.Message { return new(tpb.TestScalars) },
+	},
+	{
+		name: "channel",
+		new:  func() StreamMessage { return NewTestScalarFields() },
+		set: func(f reflect.Value, val interface{}) {
+			// sent once the stream is being encoded
+		},
+		get: func(t *testing.T, m StreamMessage, field string) interface{} {
+			f := reflect.ValueOf(m).Elem().FieldByName(field)
+			v, ok := f.MethodByName("C").Call(nil)[0].Recv()
+			if !ok {
+				t.Fatal("field closed without a value")
+			}
+			return v.Interface()
+		},
+		plain: func() proto.Message { return new(tpb.TestScalarFields) },
+	},
+}
+
+func encodeScalar(t *testing.T, form scalarForm, field string, val interface{}) []byte {
+	buf := new(bytes.Buffer)
+	m := form.new()
+	f := reflect.ValueOf(m).Elem().FieldByName(field)
+	form.set(f, val)
+
+	err := StreamEncode(buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send := f.MethodByName("Send"); send.IsValid() {
+		ret := send.Call([]reflect.Value{reflect.ValueOf(context.Background()), reflect.ValueOf(val)})
+		if err, _ := ret[0].Interface().(error); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.Close()
+	<-m.Closed()
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScalarTypes(t *testing.T) {
+	for _, form := range scalarForms {
+		for _, c := range scalarCases {
+			form, c := form, c
+			t.Run(form.name+"/"+c.field, func(t *testing.T) {
+				data := encodeScalar(t, form, c.field, c.val)
+
+				out := form.new()
+				err := StreamDecode(bytes.NewReader(data), out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := form.get(t, out, c.field)
+				<-out.Closed()
+				if err := out.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, c.val) {
+					t.Fatalf("expected %v, got %v", c.val, got)
+				}
+
+				outm := form.plain()
+				err = proto.Unmarshal(data, outm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f := reflect.ValueOf(outm).Elem().FieldByName(c.field)
+				if form.name == "channel" {
+					if f.Len() != 1 {
+						t.Fatal("plain decoder got wrong values: ", f)
+					}
+					f = f.Index(0)
+				}
+				if got := reflect.Indirect(f).Interface(); !reflect.DeepEqual(got, c.val) {
+					t.Fatalf("plain decoder expected %v, got %v", c.val, got)
+				}
+			})
+		}
+	}
+}
+
+func TestUnsupportedWireType(t *testing.T) {
+	// wire type 3 starts a group
+	out := NewTestScalars()
+	err := StreamDecode(bytes.NewReader([]byte{1<<3 | 3}), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out.Closed()
+	if out.Err() == nil {
+		t.Fatal("expected an unsupported wire type to fail the stream")
+	}
+}
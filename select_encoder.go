@@ -0,0 +1,263 @@
+package pbs
+
+import (
+	"reflect"
+	"sort"
+)
+
+// selectField is a repeated field being multiplexed by the select encoder
+type selectField struct {
+	field  byte
+	rf     repeatedField
+	weight int
+	credit int
+	closed bool
+}
+
+// selectGroup is a set of fields that share the same priority
+type selectGroup struct {
+	priority int
+	fields   []*selectField
+
+	cases    []reflect.SelectCase
+	selected []*selectField
+}
+
+// multiplexer receives the values of every repeated field of a message in a
+// single goroutine. Fields in a higher priority group are always served
+// first when they have a value ready. Within a group, ready fields are
+// served in proportion to their weights.
+type multiplexer struct {
+	groups   []*selectGroup
+	all      []*selectField
+	draining bool
+
+	// uniform is set when there is a single priority and every weight is
+	// the same, in which case the random choice made by reflect.Select is
+	// already fair and polling can be skipped
+	uniform bool
+
+	cases  []reflect.SelectCase
+	fields []*selectField
+
+	// gate is the flow control credit of a flow controlled stream. Fields
+	// without credit are left alone until credit arrives.
+	gate *creditGate
+
+	// ended is called when the producer closes a field before the stream
+	// is closing
+	ended func(field byte)
+
+	// done is closed once the stream is closing
+	done <-chan struct{}
+}
+
+func newMultiplexer(repeated map[byte]repeatedField, cfg *encodeConfig, gate *creditGate) *multiplexer {
+	m := &multiplexer{gate: gate}
+	byPrio := make(map[int]*selectGroup)
+	for field, rf := range repeated {
+		weight := cfg.weights[field]
+		if weight <= 0 {
+			weight = 1
+		}
+
+		sf := &selectField{
+			field:  field,
+			rf:     rf,
+			weight: weight,
+			credit: weight,
+		}
+		m.all = append(m.all, sf)
+
+		prio := cfg.priorities[field]
+		g, ok := byPrio[prio]
+		if !ok {
+			g = &selectGroup{priority: prio}
+			byPrio[prio] = g
+			m.groups = append(m.groups, g)
+		}
+		g.fields = append(g.fields, sf)
+	}
+
+	sort.Slice(m.groups, func(i, j int) bool {
+		return m.groups[i].priority > m.groups[j].priority
+	})
+
+	m.uniform = len(m.groups) <= 1
+	for _, sf := range m.all {
+		if sf.weight != m.all[0].weight {
+			m.uniform = false
+		}
+	}
+	return m
+}
+
+// next returns the next value to encode. Once done is closed, next only
+// returns values that are immediately available. It returns false when
+// every field has been closed, or when done is closed and nothing is left.
+func (m *multiplexer) next(done <-chan struct{}) (*selectField, reflect.Value, bool) {
+	m.done = done
+	for {
+		if !m.uniform || m.draining {
+			for _, g := range m.groups {
+				sf, v, ok := g.poll(m.blocked, m.closed)
+				if ok {
+					return sf, v, true
+				}
+			}
+		}
+
+		if m.draining {
+			return nil, reflect.Value{}, false
+		}
+
+		sf, v, ok := m.wait(done)
+		if ok {
+			return sf, v, true
+		}
+	}
+}
+
+// wait blocks until any open field has a value ready, a field is closed,
+// or done is closed. It returns true only if a value was received.
+func (m *multiplexer) wait(done <-chan struct{}) (*selectField, reflect.Value, bool) {
+	var changed <-chan struct{}
+	if m.gate != nil {
+		// taken before looking at the credit, so none is missed
+		changed = m.gate.changes()
+	}
+
+	open := false
+	cases := m.cases[:0]
+	fields := m.fields[:0]
+	for _, sf := range m.all {
+		if sf.closed {
+			continue
+		}
+		open = true
+		if m.blocked(sf) {
+			continue
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: sf.rf.selectChan()})
+		fields = append(fields, sf)
+	}
+	if !open {
+		m.draining = true
+		return nil, reflect.Value{}, false
+	}
+	cases = append(cases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(changed)},
+	)
+	m.cases, m.fields = cases, fields
+
+	chosen, v, ok := reflect.Select(cases)
+	switch chosen {
+	case len(fields):
+		m.draining = true
+		return nil, reflect.Value{}, false
+	case len(fields) + 1:
+		// credit arrived, look at the fields again
+		return nil, reflect.Value{}, false
+	}
+
+	sf := fields[chosen]
+	if !ok {
+		m.closed(sf)
+		return nil, reflect.Value{}, false
+	}
+	sf.credit--
+	return sf, v, true
+}
+
+// closed marks a field whose channel was closed
+func (m *multiplexer) closed(sf *selectField) {
+	sf.closed = true
+	if m.ended == nil || m.draining {
+		return
+	}
+
+	select {
+	case <-m.done:
+		// the field closed along with the stream, which a select may
+		// notice first
+	default:
+		m.ended(sf.field)
+	}
+}
+
+// poll receives a value from a ready field in the group without blocking.
+// A field that has used up its credit is only served when no field with
+// credit left is ready, at which point every field's credit is refilled
+// from its weight. Over time ready fields are served in proportion to
+// their weights.
+func (g *selectGroup) poll(blocked func(*selectField) bool, closed func(*selectField)) (*selectField, reflect.Value, bool) {
+	refilled := false
+	for {
+		cases := g.cases[:0]
+		fields := g.selected[:0]
+		for _, sf := range g.fields {
+			if sf.closed || (sf.credit <= 0 && !refilled) || blocked(sf) {
+				continue
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: sf.rf.selectChan()})
+			fields = append(fields, sf)
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+		g.cases, g.selected = cases, fields
+
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == len(fields) {
+			if refilled {
+				return nil, reflect.Value{}, false
+			}
+			g.refill()
+			refilled = true
+			continue
+		}
+
+		sf := fields[chosen]
+		if !ok {
+			closed(sf)
+			continue
+		}
+		sf.credit--
+		return sf, v, true
+	}
+}
+
+// blocked returns whether a field has to wait for flow control credit.
+// While draining, values are taken regardless and wait for credit when
+// they are written.
+func (m *multiplexer) blocked(sf *selectField) bool {
+	return m.gate != nil && !m.draining && m.gate.blocked(sf.field)
+}
+
+// refill starts a new round, giving every field in the group its weight
+// in credit again
+func (g *selectGroup) refill() {
+	for _, sf := range g.fields {
+		sf.credit = sf.weight
+	}
+}
+
+// handleSelect is the select encoder: it encodes the values of every
+// repeated field from a single goroutine
+func (se *streamEncoder) handleSelect(cfg *encodeConfig) {
+	var done <-chan struct{}
+	if se.st != nil {
+		defer se.st.detach()
+		done = se.st.Closing()
+	}
+
+	m := newMultiplexer(se.repeated, cfg, se.gate)
+	m.ended = se.end
+	for {
+		sf, val, ok := m.next(done)
+		if !ok {
+			return
+		}
+
+		se.write(sf.field, val)
+	}
+}
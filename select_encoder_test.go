@@ -0,0 +1,186 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+// muxMessage has bare, buffered channel fields, so tests can have values
+// ready on several fields at once
+type muxMessage struct {
+	High chan string `protobuf:"bytes,1,rep,name=high"`
+	Low  chan string `protobuf:"bytes,2,rep,name=low"`
+	*Stream
+}
+
+func newMuxMessage(n int) *muxMessage {
+	return &muxMessage{
+		High:   make(chan string, n),
+		Low:    make(chan string, n),
+		Stream: NewStream(),
+	}
+}
+
+func (m *muxMessage) ProtoMessage()  {}
+func (m *muxMessage) String() string { return "muxMessage" }
+func (m *muxMessage) Reset()         {}
+
+// readFields returns the field numbers of the length delimited values in buf,
+// skipping the markers of fields that ended
+func readFields(t *testing.T, buf []byte) []int {
+	var out []int
+	for len(buf) > 0 {
+		if buf[0]&0x80 != 0 {
+			// an end of field marker, a multi byte tag and a varint
+			_, n := proto.DecodeVarint(buf)
+			_, m := proto.DecodeVarint(buf[n:])
+			if n == 0 || m == 0 {
+				t.Fatal("truncated marker in output")
+			}
+			buf = buf[n+m:]
+			continue
+		}
+		if len(buf) < 2 || int(buf[1])+2 > len(buf) {
+			t.Fatal("truncated value in output")
+		}
+		out = append(out, int(buf[0]>>3))
+		buf = buf[2+int(buf[1]):]
+	}
+	return out
+}
+
+func encodeMux(t *testing.T, high, low int, opts ...EncodeOption) []int {
+	m := newMuxMessage(high + low)
+	for i := 0; i < high; i++ {
+		m.High <- "high"
+	}
+	for i := 0; i < low; i++ {
+		m.Low <- "low"
+	}
+	close(m.High)
+	close(m.Low)
+
+	buf := new(bytes.Buffer)
+	err := StreamEncode(buf, m, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	<-m.Closed()
+
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return readFields(t, buf.Bytes())
+}
+
+func TestSelectEncoderPriority(t *testing.T) {
+	fields := encodeMux(t, 5, 5, FieldPriority(1, 10))
+
+	if len(fields) != 10 {
+		t.Fatal("expected 10 values, got: ", len(fields))
+	}
+	for i, f := range fields {
+		if (i < 5 && f != 1) || (i >= 5 && f != 2) {
+			t.Fatal("high priority values were not encoded first: ", fields)
+		}
+	}
+}
+
+func TestSelectEncoderWeights(t *testing.T) {
+	fields := encodeMux(t, 8, 8, FieldWeight(1, 3))
+
+	// every round serves three values of field 1 for each value of field 2
+	var high int
+	for _, f := range fields[:8] {
+		if f == 1 {
+			high++
+		}
+	}
+	if high != 6 {
+		t.Fatal("expected 6 of the first 8 values from field 1, got: ", fields)
+	}
+}
+
+func TestSelectEncoderRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tm := generateTestMessage()
+	err := StreamEncode(buf, tm, SelectEncoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, s := range []string{"cat", "dog", "fish"} {
+		if err := tm.Repstring.Send(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.Repint.Send(ctx, int32(len(s))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm.Close()
+	<-tm.Closed()
+
+	outm := new(tpb.TestMessage)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outm.Repstring) != 3 || outm.Repstring[2] != "fish" {
+		t.Fatal("got wrong repeated strings: ", outm.Repstring)
+	}
+	if len(outm.Repint) != 3 || outm.Repint[2] != 4 {
+		t.Fatal("got wrong repeated ints: ", outm.Repint)
+	}
+}
+
+func benchmarkEncode(b *testing.B, opts ...EncodeOption) {
+	tm := NewTestMessage()
+	err := StreamEncode(io.Discard, tm, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < b.N; i++ {
+			tm.Repstring.Send(ctx, "pbs is fun")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < b.N; i++ {
+			tm.Repint.Send(ctx, int32(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < b.N; i++ {
+			tm.Repbytes.Send(ctx, []byte("pbs is still fun"))
+		}
+	}()
+
+	wg.Wait()
+	tm.Close()
+	<-tm.Closed()
+}
+
+func BenchmarkEncodeGoroutines(b *testing.B) {
+	benchmarkEncode(b)
+}
+
+func BenchmarkEncodeSelect(b *testing.B) {
+	benchmarkEncode(b, SelectEncoder())
+}
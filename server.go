@@ -0,0 +1,403 @@
+package pbs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server handshake frames. See the wire format description next to the
+// wire types.
+const (
+	connectFrame = 1
+	acceptFrame  = 2
+	rejectFrame  = 3
+)
+
+// DefaultHandshakeTimeout is how long a server waits for a connection to
+// name its stream type, unless configured otherwise
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrServerClosed is returned by Serve once the server has been shut down
+var ErrServerClosed = errors.New("pbs: server closed")
+
+// ErrUnknownType is returned by Dial when the server has no handler for
+// the stream type
+var ErrUnknownType = errors.New("pbs: server has no handler for stream type")
+
+// Server accepts connections carrying streams, and hands each decoded
+// stream to the handler registered for its type. A connection carries a
+// single stream, whose type is named by the client when it dials.
+type Server struct {
+	// MaxConns is the most connections served at once. Once it is
+	// reached, no more connections are accepted until one finishes. Zero
+	// means no limit.
+	MaxConns int
+
+	// IdleTimeout closes a connection when nothing has been read from it
+	// for this long, failing its stream with the timeout error. Zero
+	// means connections never time out.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout closes a connection that has not named its stream
+	// type within this long. Zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	lk        sync.Mutex
+	handlers  map[string]func(ctx context.Context, conn io.ReadWriteCloser)
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	sem       chan struct{}
+	conwg     sync.WaitGroup
+
+	// quit is closed once the server stops accepting connections, and ctx
+	// is canceled once it stops serving them
+	quit   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer returns a server with no handlers
+func NewServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		handlers:  make(map[string]func(context.Context, io.ReadWriteCloser)),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		quit:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Handle registers the handler for streams of type typ. For every
+// connection carrying such a stream, newMsg constructs the message, which
+// is decoded with StreamDecode and passed to h. The context h is called
+// with is canceled when the server is closed.
+//
+// The connection is closed once h returns, so h should consume the stream
+// until it is closed.
+func Handle[T StreamMessage](s *Server, typ string, newMsg func() T, h func(ctx context.Context, sm T), opts ...DecodeOption) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.handlers[typ] = func(ctx context.Context, conn io.ReadWriteCloser) {
+		sm := newMsg()
+		err := StreamDecode(conn, sm, opts...)
+		if err != nil {
+			return
+		}
+
+		h(ctx, sm)
+
+		sm.Close()
+		conn.Close()
+		<-sm.Closed()
+	}
+}
+
+// Serve accepts connections on l and serves each of them in its own
+// goroutine. Temporary errors accepting a connection are retried after a
+// growing delay. It always returns a non-nil error, which is
+// ErrServerClosed once the server has been shut down.
+func (s *Server) Serve(l net.Listener) error {
+	s.lk.Lock()
+	select {
+	case <-s.quit:
+		s.lk.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[l] = struct{}{}
+	if s.MaxConns > 0 && s.sem == nil {
+		s.sem = make(chan struct{}, s.MaxConns)
+	}
+	sem := s.sem
+	s.lk.Unlock()
+
+	defer func() {
+		s.lk.Lock()
+		delete(s.listeners, l)
+		s.lk.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-s.quit:
+				return ErrServerClosed
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return ErrServerClosed
+			default:
+			}
+
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Temporary() {
+				return err
+			}
+			if sem != nil {
+				<-sem
+			}
+
+			// back off like net/http, from 5ms up to a second
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			select {
+			case <-time.After(delay):
+			case <-s.quit:
+				return ErrServerClosed
+			}
+			continue
+		}
+		delay = 0
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+			}()
+			defer s.untrack(conn)
+
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// track adds conn to the connections being served, unless the server was
+// shut down
+func (s *Server) track(conn net.Conn) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	s.conwg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	conn.Close()
+	delete(s.conns, conn)
+	s.conwg.Done()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	var c io.ReadWriteCloser = conn
+	if s.IdleTimeout > 0 {
+		c = &idleConn{Conn: conn, timeout: s.IdleTimeout}
+	}
+	read := bufio.NewReader(c)
+
+	// a client that never names its stream type would hold on to the
+	// connection, and to its place under MaxConns
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return
+	}
+
+	f, err := readControlFrame(read)
+	if err != nil || f.kind != connectFrame {
+		return
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	s.lk.Lock()
+	handler, ok := s.handlers[string(f.data[1])]
+	s.lk.Unlock()
+
+	if !ok {
+		writeControlFrame(c, rejectFrame)
+		return
+	}
+	err = writeControlFrame(c, acceptFrame)
+	if err != nil {
+		return
+	}
+
+	handler(s.ctx, bufferedConn{Reader: read, WriteCloser: c})
+}
+
+// Shutdown stops accepting connections, and waits for the connections
+// being served to finish. If ctx is done first, the server is closed and
+// Shutdown returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.conwg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every connection being
+// served, canceling the contexts passed to handlers
+func (s *Server) Close() error {
+	s.stop()
+	s.cancel()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// stop closes the listeners, so no more connections are accepted
+func (s *Server) stop() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	select {
+	case <-s.quit:
+	default:
+		close(s.quit)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// bufferedConn reads a connection through the reader its handshake was
+// read with, so nothing the reader buffered is lost
+type bufferedConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// idleConn pushes the read deadline of a connection back before every read
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Dial connects to a server and opens a stream of type typ. The message
+// returned is constructed by newMsg and is already being encoded to the
+// server; the connection is closed once the message is closed. ctx bounds
+// dialing and the handshake only.
+func Dial[T StreamMessage](ctx context.Context, network, addr, typ string, newMsg func() T, opts ...EncodeOption) (T, error) {
+	var zero T
+
+	conn, err := dialServer(ctx, network, addr, typ)
+	if err != nil {
+		return zero, err
+	}
+
+	sm := newMsg()
+	err = StreamEncode(conn, sm, opts...)
+	if err != nil {
+		conn.Close()
+		return zero, err
+	}
+
+	go func() {
+		<-sm.Closed()
+		conn.Close()
+	}()
+	return sm, nil
+}
+
+// dialServer connects to a server, and completes the handshake for a
+// stream of type typ
+func dialServer(ctx context.Context, network, addr, typ string) (io.ReadWriteCloser, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// interrupt the handshake if ctx is done before it completes
+	handshook := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+			interrupted <- true
+		case <-handshook:
+			interrupted <- false
+		}
+	}()
+
+	read := bufio.NewReader(conn)
+	f, err := dialHandshake(conn, read, typ)
+	close(handshook)
+	if <-interrupted {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if f.kind != acceptFrame {
+		conn.Close()
+		return nil, ErrUnknownType
+	}
+	return bufferedConn{Reader: read, WriteCloser: conn}, nil
+}
+
+func dialHandshake(w io.Writer, r *bufio.Reader, typ string) (*controlFrame, error) {
+	err := writeControlFrame(w, connectFrame, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readControlFrame(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return f, err
+}
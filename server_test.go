@@ -0,0 +1,283 @@
+package pbs_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func TestServerDispatch(t *testing.T) {
+	received := make(chan []string, 1)
+	s := NewServer()
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		var strs []string
+		for v := range tm.Repstring.C() {
+			strs = append(strs, v)
+		}
+		<-tm.Closed()
+		received <- strs
+	})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tm, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"cat", "dog", "emu"} {
+		if err := tm.Repstring.Send(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm.Close()
+	<-tm.Closed()
+	if err := tm.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case strs := <-received:
+		if len(strs) != 3 || strs[2] != "emu" {
+			t.Fatal("got wrong values: ", strs)
+		}
+	case <-ctx.Done():
+		t.Fatal("handler did not receive the stream")
+	}
+
+	_, err = Dial(ctx, "tcp", addr, "nope", NewTestMessage)
+	if err != ErrUnknownType {
+		t.Fatal("expected ErrUnknownType, got: ", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	s := NewServer()
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		close(started)
+		for range tm.Repstring.C() {
+		}
+		<-tm.Closed()
+	})
+	addr := startServer(t, s)
+
+	ctx := context.Background()
+	tm, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// a graceful shutdown waits for the stream to end
+	shut := make(chan error, 1)
+	go func() {
+		shut <- s.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shut:
+		t.Fatal("shutdown returned before the stream ended: ", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if _, err := Dial(ctx, "tcp", addr, "test", NewTestMessage); err == nil {
+		t.Fatal("expected dialing a shut down server to fail")
+	}
+
+	tm.Close()
+	if err := <-shut; err != nil {
+		t.Fatal(err)
+	}
+
+	// a shutdown that runs out of time closes the connections
+	s = NewServer()
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		for range tm.Repstring.C() {
+		}
+	})
+	addr = startServer(t, s)
+	if _, err = Dial(ctx, "tcp", addr, "test", NewTestMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	if err := s.Shutdown(tctx); err != context.DeadlineExceeded {
+		t.Fatal("expected the shutdown to time out, got: ", err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	results := make(chan error, 2)
+	s := NewServer()
+	s.MaxConns = 1
+	s.IdleTimeout = time.Millisecond * 100
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		for range tm.Repstring.C() {
+		}
+		<-tm.Closed()
+		results <- tm.Err()
+	})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	ctx := context.Background()
+	first, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second connection waits until the first one is served
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+		dialed <- err
+	}()
+
+	select {
+	case err := <-dialed:
+		t.Fatal("second connection was served while the first was open: ", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// the first stream sends nothing, and times out
+	var nerr net.Error
+	if err := <-results; !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatal("expected a timeout error, got: ", err)
+	}
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	s := NewServer()
+	s.MaxConns = 1
+	s.HandshakeTimeout = time.Millisecond * 100
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		for range tm.Repstring.C() {
+		}
+		<-tm.Closed()
+	})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	// a client that never sends its handshake does not keep its place
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	tm, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+}
+
+// flakyListener fails its first accepts with a temporary error
+type flakyListener struct {
+	net.Listener
+	fails int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptRetry(t *testing.T) {
+	s := NewServer()
+	s.MaxConns = 1
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		for range tm.Repstring.C() {
+		}
+		<-tm.Closed()
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(&flakyListener{Listener: l, fails: 3})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	tm, err := Dial(ctx, "tcp", l.Addr().String(), "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+	<-tm.Closed()
+
+	s.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal("expected ErrServerClosed, got: ", err)
+	}
+}
+
+func TestServerOversizedHandshake(t *testing.T) {
+	s := NewServer()
+	Handle(s, "test", NewTestMessage, func(ctx context.Context, tm *TestMessage) {
+		for range tm.Repstring.C() {
+		}
+		<-tm.Closed()
+	})
+	addr := startServer(t, s)
+	defer s.Close()
+
+	// a connect frame claiming to be over 2^63 bytes long
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte{1<<3 | LengthDelim, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the server to close the connection")
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	tm, err := Dial(ctx, "tcp", addr, "test", NewTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+}
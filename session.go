@@ -0,0 +1,514 @@
+package pbs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// Session frames. See the wire format description next to the wire types.
+const (
+	openFrame         = 1
+	dataFrame         = 2
+	closeFrame        = 3
+	streamCreditFrame = 4
+	resetFrame        = 5
+)
+
+const (
+	// SessionWindow is how many bytes of a stream of a session may be on
+	// their way to the decoder, or buffered for it, at once. The encoder
+	// waits for the decoder to read them before writing more.
+	SessionWindow = 1 << 20
+
+	// MaxPendingStreams is how many streams of a session may be waiting to
+	// be accepted. Streams opened beyond it are refused.
+	MaxPendingStreams = 256
+)
+
+// ErrSessionClosed is returned when using a session after it was closed
+var ErrSessionClosed = errors.New("pbs: session closed")
+
+// ErrStreamOverflow is the error a stream of a session fails with when the
+// other end sent more than SessionWindow without waiting for the decoder
+var ErrStreamOverflow = errors.New("pbs: stream exceeded its flow control window")
+
+// ErrStreamRefused is the error a stream of a session fails with when the
+// other end already has MaxPendingStreams streams waiting to be accepted
+var ErrStreamRefused = errors.New("pbs: stream refused by the other end")
+
+// RemoteError is the error a stream of a session fails with when the
+// encoder on the other end of the session failed
+type RemoteError struct {
+	Stream uint64
+	Msg    string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("pbs: remote stream %d failed: %s", e.Stream, e.Msg)
+}
+
+// Session carries any number of independent streams, each with its own
+// StreamMessage type, over a single connection. Either end of the session
+// may open streams; the other end accepts them by type.
+type Session struct {
+	conn io.ReadWriteCloser
+
+	// wlk serializes the frames written to conn
+	wlk sync.Mutex
+
+	lk       sync.Mutex
+	nextID   uint64
+	streams  map[uint64]*streamBuffer
+	pending  map[string][]*streamBuffer
+	npending int
+	windows  map[uint64]*sendWindow
+	err      error
+	closed   chan struct{}
+
+	// changed is closed and replaced whenever a stream is opened by the
+	// other end, credit arrives for a stream opened by this end, or the
+	// session fails
+	changed chan struct{}
+}
+
+// sendWindow is the flow control state of a stream opened by this end
+type sendWindow struct {
+	credit int64
+
+	// err is set when the other end refused the stream
+	err error
+}
+
+// NewSession starts a session over conn. The two ends of a session must
+// pass different values for initiator, conventionally true for the end
+// that dialed the connection.
+func NewSession(conn io.ReadWriteCloser, initiator bool) *Session {
+	s := &Session{
+		conn:    conn,
+		nextID:  2,
+		streams: make(map[uint64]*streamBuffer),
+		pending: make(map[string][]*streamBuffer),
+		windows: make(map[uint64]*sendWindow),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	if initiator {
+		s.nextID = 1
+	}
+
+	go s.readFrames()
+	return s
+}
+
+// Open starts encoding sm as a new stream of the session. The other end
+// accepts it by passing the same typ to Accept. The stream is closed on
+// the other end once sm is closed and every value has been written.
+func (s *Session) Open(typ string, sm StreamMessage, opts ...EncodeOption) error {
+	id, err := s.open(typ)
+	if err != nil {
+		return err
+	}
+
+	err = StreamEncode(&sessionWriter{s: s, id: id}, sm, opts...)
+	if err != nil {
+		s.closeStream(id, err.Error())
+		return err
+	}
+
+	go func() {
+		select {
+		case <-sm.Closed():
+		case <-s.closed:
+			return
+		}
+
+		var msg string
+		if err := sm.Err(); err != nil {
+			msg = err.Error()
+		}
+		s.closeStream(id, msg)
+	}()
+	return nil
+}
+
+// open allocates the id of a new stream, and opens it on the other end
+func (s *Session) open(typ string) (uint64, error) {
+	s.lk.Lock()
+	if s.err != nil {
+		s.lk.Unlock()
+		return 0, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	s.windows[id] = &sendWindow{credit: SessionWindow}
+	s.lk.Unlock()
+
+	err := s.writeFrame(openFrame, id, typ)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// openEnded opens a stream without any data, and ends it right away, with
+// the error message msg if it is not empty
+func (s *Session) openEnded(typ, msg string) error {
+	id, err := s.open(typ)
+	if err != nil {
+		return err
+	}
+	return s.closeStream(id, msg)
+}
+
+// closeStream ends a stream opened by this end, with the error message
+// msg if it is not empty
+func (s *Session) closeStream(id uint64, msg string) error {
+	s.lk.Lock()
+	delete(s.windows, id)
+	s.lk.Unlock()
+
+	return s.writeFrame(closeFrame, id, msg)
+}
+
+// reserve waits until the other end has granted credit for stream id, and
+// takes up to n bytes of it. It returns how many bytes may be written.
+func (s *Session) reserve(id uint64, n int) (int, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		w, ok := s.windows[id]
+		if !ok {
+			return 0, ErrSessionClosed
+		}
+		if w.err != nil {
+			return 0, w.err
+		}
+		if w.credit > 0 {
+			if int64(n) > w.credit {
+				n = int(w.credit)
+			}
+			w.credit -= int64(n)
+			return n, nil
+		}
+
+		changed := s.changed
+		s.lk.Unlock()
+		<-changed
+		s.lk.Lock()
+	}
+}
+
+// notify wakes up everything waiting on the session. It must be called
+// with s.lk held.
+func (s *Session) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Accept waits for the other end to open a stream of the given type, and
+// starts decoding it into sm. Streams are accepted in the order they were
+// opened.
+func (s *Session) Accept(ctx context.Context, typ string, sm StreamMessage, opts ...DecodeOption) error {
+	s.lk.Lock()
+	for len(s.pending[typ]) == 0 {
+		if s.err != nil {
+			s.lk.Unlock()
+			return s.err
+		}
+
+		changed := s.changed
+		s.lk.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.lk.Lock()
+	}
+
+	ss := s.pending[typ][0]
+	s.pending[typ] = s.pending[typ][1:]
+	s.npending--
+	s.lk.Unlock()
+
+	err := StreamDecode(ss, sm, opts...)
+	if err != nil {
+		ss.discard()
+		return err
+	}
+
+	// stop buffering data once the consumer is gone, and let the encoder
+	// finish without waiting for it
+	go func() {
+		<-sm.Closed()
+		ss.discard()
+	}()
+	return nil
+}
+
+// Close closes the session and its connection. Streams still being
+// decoded fail with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return s.conn.Close()
+}
+
+// Closed returns a channel that is closed when the session ends
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the error that ended the session, or nil while it is open
+func (s *Session) Err() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.err
+}
+
+// fail ends the session with err, unless it has already ended
+func (s *Session) fail(err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.closed)
+	close(s.changed)
+
+	for _, ss := range s.streams {
+		ss.end(err)
+	}
+}
+
+func (s *Session) writeFrame(kind byte, id uint64, vals ...interface{}) error {
+	s.wlk.Lock()
+	defer s.wlk.Unlock()
+
+	select {
+	case <-s.closed:
+		return s.Err()
+	default:
+	}
+
+	err := writeControlFrame(s.conn, kind, append([]interface{}{id}, vals...)...)
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// readFrames reads frames off the connection and hands them to the
+// streams they belong to, until the connection fails
+func (s *Session) readFrames() {
+	r := bufio.NewReader(s.conn)
+	for {
+		f, err := readControlFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.fail(err)
+			return
+		}
+
+		id := f.ints[1]
+
+		s.lk.Lock()
+		switch f.kind {
+		case openFrame:
+			if s.npending >= MaxPendingStreams {
+				// written from another goroutine, as the other end may
+				// be writing to this one too
+				go s.writeFrame(resetFrame, id)
+				break
+			}
+
+			ss := newStreamBuffer()
+			ss.limit = SessionWindow
+			ss.grant = func(n int) {
+				s.writeFrame(streamCreditFrame, id, uint64(n))
+			}
+			s.streams[id] = ss
+
+			typ := string(f.data[2])
+			s.pending[typ] = append(s.pending[typ], ss)
+			s.npending++
+			s.notify()
+		case streamCreditFrame:
+			if w, ok := s.windows[id]; ok {
+				w.credit += int64(f.ints[2])
+				s.notify()
+			}
+		case resetFrame:
+			if w, ok := s.windows[id]; ok {
+				w.err = ErrStreamRefused
+				s.notify()
+			}
+		case dataFrame:
+			if ss, ok := s.streams[id]; ok {
+				ss.write(f.data[2])
+			}
+		case closeFrame:
+			if ss, ok := s.streams[id]; ok {
+				delete(s.streams, id)
+
+				var err error = io.EOF
+				if msg := string(f.data[2]); msg != "" {
+					err = &RemoteError{Stream: id, Msg: msg}
+				}
+				ss.end(err)
+			}
+		}
+		s.lk.Unlock()
+	}
+}
+
+// sessionWriter writes the output of an encoder as data frames
+type sessionWriter struct {
+	s  *Session
+	id uint64
+}
+
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	var n int
+	for n < len(b) {
+		size := len(b) - n
+		if size > maxFrameData {
+			size = maxFrameData
+		}
+
+		size, err := sw.s.reserve(sw.id, size)
+		if err != nil {
+			return n, err
+		}
+
+		err = sw.s.writeFrame(dataFrame, sw.id, b[n:n+size])
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// streamBuffer buffers the data of a stream until its decoder reads it.
+// Writers never wait for the decoder, so a slow stream of a session does
+// not hold up the others; the encoder of a session stream waits for
+// credit instead.
+type streamBuffer struct {
+	lk        sync.Mutex
+	cond      *sync.Cond
+	buf       bytes.Buffer
+	err       error
+	discarded bool
+
+	// limit is the most data buffered at once, zero meaning no limit. A
+	// writer that exceeds it fails the stream with ErrStreamOverflow.
+	limit int
+
+	// grant, if set, returns credit for data the decoder has read or
+	// that was discarded. Credit is returned once half the limit has
+	// been read.
+	grant    func(n int)
+	consumed int
+}
+
+func newStreamBuffer() *streamBuffer {
+	ss := new(streamBuffer)
+	ss.cond = sync.NewCond(&ss.lk)
+	return ss
+}
+
+func (ss *streamBuffer) write(b []byte) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	if ss.discarded || ss.err != nil {
+		return
+	}
+	if ss.limit > 0 && ss.buf.Len()+len(b) > ss.limit {
+		ss.discarded = true
+		ss.buf.Reset()
+		ss.err = ErrStreamOverflow
+		ss.cond.Broadcast()
+		return
+	}
+	ss.buf.Write(b)
+	ss.cond.Broadcast()
+}
+
+// end marks the end of the stream's data. Reads fail with err once the
+// buffered data has been read.
+func (ss *streamBuffer) end(err error) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	if ss.err == nil {
+		ss.err = err
+	}
+	ss.cond.Broadcast()
+}
+
+// discard drops the buffered data and anything that arrives later. The
+// encoder is granted all the credit it could need, so it does not wait
+// for data nobody reads.
+func (ss *streamBuffer) discard() {
+	ss.lk.Lock()
+	if ss.discarded {
+		ss.lk.Unlock()
+		return
+	}
+	ss.discarded = true
+	ss.buf.Reset()
+	if ss.err == nil {
+		ss.err = io.EOF
+	}
+	ss.cond.Broadcast()
+	ss.lk.Unlock()
+
+	if ss.grant != nil {
+		ss.grant(math.MaxInt32)
+	}
+}
+
+func (ss *streamBuffer) Read(b []byte) (int, error) {
+	ss.lk.Lock()
+	for ss.buf.Len() == 0 {
+		if ss.err != nil {
+			ss.lk.Unlock()
+			return 0, ss.err
+		}
+		ss.cond.Wait()
+	}
+	n, _ := ss.buf.Read(b)
+
+	var credit int
+	if ss.grant != nil {
+		ss.consumed += n
+		if ss.consumed >= ss.limit/2 {
+			credit = ss.consumed
+			ss.consumed = 0
+		}
+	}
+	ss.lk.Unlock()
+
+	// the credit is written outside the lock, as the connection may
+	// block
+	if credit > 0 {
+		ss.grant(credit)
+	}
+	return n, nil
+}
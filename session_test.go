@@ -0,0 +1,295 @@
+package pbs_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func newSessions() (*Session, *Session) {
+	a, b := net.Pipe()
+	return NewSession(a, true), NewSession(b, false)
+}
+
+func collect(tm *TestMessage) chan []string {
+	out := make(chan []string, 1)
+	go func() {
+		var strs []string
+		for s := range tm.Repstring.C() {
+			strs = append(strs, s)
+		}
+		out <- strs
+	}()
+	return out
+}
+
+func TestSessionStreams(t *testing.T) {
+	client, server := newSessions()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cats := NewTestMessage()
+	cats.B = proto.String("cats")
+	dogs := NewTestMessage()
+	dogs.B = proto.String("dogs")
+
+	if err := client.Open("cats", cats); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Open("dogs", dogs); err != nil {
+		t.Fatal(err)
+	}
+
+	inCats := NewTestMessage()
+	if err := server.Accept(ctx, "cats", inCats); err != nil {
+		t.Fatal(err)
+	}
+	inDogs := NewTestMessage()
+	if err := client.Accept(ctx, "dogs", inDogs); err != nil {
+		t.Fatal(err)
+	}
+	gotCats := collect(inCats)
+	gotDogs := collect(inDogs)
+
+	// values of both streams are interleaved on the connection
+	for i := 0; i < 3; i++ {
+		if err := cats.Repstring.Send(ctx, "meow"); err != nil {
+			t.Fatal(err)
+		}
+		if err := dogs.Repstring.Send(ctx, "woof"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cats.Close()
+	dogs.Close()
+
+	for _, c := range []struct {
+		got  chan []string
+		tm   *TestMessage
+		name string
+		val  string
+	}{
+		{gotCats, inCats, "cats", "meow"},
+		{gotDogs, inDogs, "dogs", "woof"},
+	} {
+		strs := <-c.got
+		if len(strs) != 3 || strs[2] != c.val {
+			t.Fatalf("got wrong values on %s stream: %v", c.name, strs)
+		}
+		if *c.tm.B != c.name {
+			t.Fatal("got wrong scalar: ", *c.tm.B)
+		}
+		<-c.tm.Closed()
+		if err := c.tm.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSessionRemoteError(t *testing.T) {
+	client, server := newSessions()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the flow control channel ends right away, failing the stream
+	tm := NewTestMessage()
+	err := client.Open("test", tm, FlowControl(strings.NewReader("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tm.Repstring.Send(ctx, "cat")
+
+	in := NewTestMessage()
+	if err := server.Accept(ctx, "test", in); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-in.Closed():
+	case <-ctx.Done():
+		t.Fatal("stream was never closed")
+	}
+
+	rerr, ok := in.Err().(*RemoteError)
+	if !ok {
+		t.Fatal("expected a RemoteError, got: ", in.Err())
+	}
+	if rerr.Msg != ErrFlowClosed.Error() {
+		t.Fatal("got wrong remote error: ", rerr.Msg)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newSessions()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Accept(context.Background(), "test", NewTestMessage())
+	}()
+
+	client.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrSessionClosed {
+			t.Fatal("expected ErrSessionClosed, got: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return when the session closed")
+	}
+	<-server.Closed()
+}
+
+func TestSessionWindow(t *testing.T) {
+	client, server := newSessions()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tm := NewTestMessage()
+	if err := client.Open("test", tm); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing accepts the stream, so the encoder stops at the window
+	big := strings.Repeat("c", 1<<16)
+	n := 2 * SessionWindow / len(big)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := tm.Repstring.Send(ctx, big); err != nil {
+				return
+			}
+		}
+		tm.Close()
+	}()
+
+	select {
+	case <-tm.Closed():
+		t.Fatal("encoder wrote past the window of an unaccepted stream")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	in := NewTestMessage()
+	if err := server.Accept(ctx, "test", in); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	for range in.Repstring.C() {
+		got++
+	}
+	<-in.Closed()
+	if err := in.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got != n {
+		t.Fatalf("expected %d values, got %d", n, got)
+	}
+}
+
+// rawFrame encodes a session frame carrying data for stream id
+func rawFrame(kind byte, id uint64, data []byte) []byte {
+	body := append([]byte{1 << 3}, proto.EncodeVarint(id)...)
+	body = append(body, 2<<3|LengthDelim)
+	body = append(body, proto.EncodeVarint(uint64(len(data)))...)
+	body = append(body, data...)
+
+	frame := append([]byte{kind<<3 | LengthDelim}, proto.EncodeVarint(uint64(len(body)))...)
+	return append(frame, body...)
+}
+
+func TestSessionOverflow(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	s := NewSession(b, false)
+	defer s.Close()
+
+	// the other end ignores the window of its stream
+	go func() {
+		a.Write(rawFrame(1, 1, []byte("test")))
+		chunk := make([]byte, SessionWindow/2)
+		for i := 0; i < 3; i++ {
+			if _, err := a.Write(rawFrame(2, 1, chunk)); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	in := NewTestMessage()
+	if err := s.Accept(ctx, "test", in); err != nil {
+		t.Fatal(err)
+	}
+	for range in.Repstring.C() {
+	}
+	select {
+	case <-in.Closed():
+	case <-ctx.Done():
+		t.Fatal("stream was never closed")
+	}
+	if in.Err() != ErrStreamOverflow {
+		t.Fatal("expected ErrStreamOverflow, got: ", in.Err())
+	}
+}
+
+func TestSessionPendingLimit(t *testing.T) {
+	client, server := newSessions()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := 0; i < MaxPendingStreams; i++ {
+		if err := client.Open("test", NewTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one stream too many is refused
+	tm := NewTestMessage()
+	if err := client.Open("test", tm); err != nil {
+		t.Fatal(err)
+	}
+	for tm.Repstring.Send(ctx, "cat") == nil {
+		// the encoder fails once the refusal arrives
+		time.Sleep(time.Millisecond * 10)
+	}
+	<-tm.Closed()
+	if tm.Err() != ErrStreamRefused {
+		t.Fatal("expected ErrStreamRefused, got: ", tm.Err())
+	}
+}
+
+func TestSessionOversizedFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	s := NewSession(b, false)
+	defer s.Close()
+
+	// a data frame claiming to be 2 GiB long
+	go a.Write([]byte{2<<3 | LengthDelim, 0x80, 0x80, 0x80, 0x80, 0x08})
+
+	select {
+	case <-s.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("session survived an oversized frame")
+	}
+	if s.Err() != ErrValueTooLarge {
+		t.Fatal("expected ErrValueTooLarge, got: ", s.Err())
+	}
+}
@@ -0,0 +1,216 @@
+package pbs
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStreamClosed is returned by Send once the stream has been closed
+var ErrStreamClosed = errors.New("pbs: send on closed stream")
+
+// ErrNilStream is returned by StreamEncode and StreamDecode for a message
+// whose embedded *Stream is nil, such as a message literal. Generated
+// messages must be made with their New function.
+var ErrNilStream = errors.New("pbs: message embeds a nil *Stream, make it with its New function")
+
+// Stream implements the closing protocol shared by StreamMessages. Generated
+// messages embed a *Stream, which provides the Closed and Err methods of
+// the StreamMessage interface.
+//
+// Closing a stream happens in two steps. Close marks the stream as closing,
+// which producers observe through Closing and which makes the send helpers
+// return an error. The stream is then reported as closed through Closed once
+// every worker attached to it, such as the goroutines started by
+// StreamEncode, has finished.
+//
+// Much like a context.Context, the first error encountered while encoding
+// or decoding is recorded and returned by Err, and also closes the stream.
+type Stream struct {
+	lk      sync.Mutex
+	closing chan struct{}
+	closed  chan struct{}
+	errors  chan error
+	err     error
+	workers int
+	role    int
+	dropped map[byte]uint64
+}
+
+// NewStream returns a new, open Stream
+func NewStream() *Stream {
+	return &Stream{
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+		errors:  make(chan error, 1),
+	}
+}
+
+// Close marks the stream as closing. It is safe to call Close more than
+// once, and from multiple goroutines.
+func (s *Stream) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.shutdown()
+	return nil
+}
+
+// Closing returns a channel that is closed once Close has been called
+func (s *Stream) Closing() <-chan struct{} {
+	return s.closing
+}
+
+// Closed returns a channel that is closed once the stream has been closed
+// and all of its workers have finished
+func (s *Stream) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the first error encountered while encoding or decoding the
+// stream, or nil if there has been none. Once Closed is closed, Err no
+// longer changes.
+func (s *Stream) Err() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.err
+}
+
+// Errors returns a channel that the first error encountered while encoding
+// or decoding the stream is delivered on. The channel is closed once the
+// stream is closed.
+//
+// Deprecated: Errors is kept so code written against the old error channel
+// keeps working. Wait on Closed and check Err instead.
+func (s *Stream) Errors() chan error {
+	return s.errors
+}
+
+// fail records err as the stream's error, unless an error has already been
+// recorded, and closes the stream. It never blocks. An error arriving once
+// the stream is closed is dropped, as Err no longer changes then and the
+// error channel is closed.
+func (s *Stream) fail(err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	if s.err == nil {
+		s.err = err
+		select {
+		case s.errors <- err:
+		default:
+		}
+	}
+	s.shutdown()
+}
+
+// shutdown marks the stream as closing. It must be called with s.lk held.
+func (s *Stream) shutdown() {
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	s.finish()
+}
+
+// finish closes the closed channel if the stream is closing and has no
+// workers left. It must be called with s.lk held.
+func (s *Stream) finish() {
+	if s.workers > 0 {
+		return
+	}
+
+	select {
+	case <-s.closing:
+	default:
+		return
+	}
+
+	select {
+	case <-s.closed:
+	default:
+		close(s.errors)
+		close(s.closed)
+	}
+}
+
+// attach registers a worker that has to finish before the stream is
+// reported as closed
+func (s *Stream) attach() {
+	s.lk.Lock()
+	s.workers++
+	s.lk.Unlock()
+}
+
+// detach marks a worker registered with attach as finished
+func (s *Stream) detach() {
+	s.lk.Lock()
+	s.workers--
+	s.finish()
+	s.lk.Unlock()
+}
+
+// context returns a context that is cancelled once the stream is closing
+func (s *Stream) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Send sends v on ch, a bare channel field of a message that embeds s.
+// Instead of blocking forever it returns ErrStreamClosed once s is closing,
+// so a producer never has to race the encoder shutting down.
+func Send[T any](ctx context.Context, s *Stream, ch chan<- T, v T) error {
+	select {
+	case <-s.closing:
+		return ErrStreamClosed
+	default:
+	}
+
+	select {
+	case ch <- v:
+		return nil
+	case <-s.closing:
+		return ErrStreamClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Stream) pbsStream() *Stream {
+	return s
+}
+
+// streamer is implemented by messages that embed a *Stream
+type streamer interface {
+	pbsStream() *Stream
+}
+
+// getStream returns the Stream embedded in sm, or nil if it has none
+func getStream(sm StreamMessage) *Stream {
+	if s, ok := sm.(streamer); ok {
+		return s.pbsStream()
+	}
+	return nil
+}
+
+// checkStream returns ErrNilStream if sm embeds a *Stream that is nil
+func checkStream(sm StreamMessage) error {
+	if s, ok := sm.(streamer); ok && s.pbsStream() == nil {
+		return ErrNilStream
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/whyrusleeping/go-pbs"
+)
+
+func TestCloseTwice(t *testing.T) {
+	tm := NewTestMessage()
+	tm.Close()
+	tm.Close()
+
+	select {
+	case <-tm.Closed():
+	default:
+		t.Fatal("stream should be closed")
+	}
+
+	err := tm.Repint.Send(context.Background(), 5)
+	if err != ErrFieldClosed {
+		t.Fatal("expected ErrFieldClosed, got: ", err)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	st := NewStream()
+	ch := make(chan string)
+
+	go st.Close()
+
+	err := Send(context.Background(), st, ch, "hello")
+	if err != ErrStreamClosed {
+		t.Fatal("expected ErrStreamClosed, got: ", err)
+	}
+}
+
+func TestClosedWaitsForEncoder(t *testing.T) {
+	r, w := io.Pipe()
+	buf := new(bytes.Buffer)
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(buf, r)
+		close(copied)
+	}()
+
+	tm := generateTestMessage()
+	err := StreamEncode(w, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tm.Repstring.Send(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Close()
+
+	<-tm.Closed()
+	w.Close()
+	<-copied
+
+	if !bytes.HasSuffix(buf.Bytes(), []byte("hello")) {
+		t.Fatal("stream was reported closed before all values were written")
+	}
+}
+
+func TestConsumerClose(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	tm := NewTestMessage()
+	err := StreamDecode(r, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		w.Write([]byte{0x4a, 3, 'c', 'a', 't'})
+		w.Write([]byte{0x4a, 3, 'd', 'o', 'g'})
+	}()
+
+	if s := <-tm.Repstring.C(); s != "cat" {
+		t.Fatal("expected cat, got: ", s)
+	}
+
+	// closing while the decoder is blocked sending "dog" must not panic,
+	// and must not be reported as an error
+	tm.Close()
+
+	select {
+	case <-tm.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("stream was never closed")
+	}
+
+	if err := tm.Err(); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestFirstErrorWins(t *testing.T) {
+	// a repeated int field, followed by a truncated string
+	buf := bytes.NewReader([]byte{0x10, 7, 0x4a, 10, 'c', 'a'})
+
+	tm := NewTestMessage()
+	err := StreamDecode(buf, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody is receiving on the error channel, the decoder must not block
+	if i := <-tm.Repint.C(); i != 7 {
+		t.Fatal("expected 7, got: ", i)
+	}
+
+	select {
+	case <-tm.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("stream was never closed")
+	}
+
+	if tm.Err() != io.ErrUnexpectedEOF {
+		t.Fatal("expected unexpected EOF, got: ", tm.Err())
+	}
+
+	// the deprecated error channel still carries the error, then closes
+	if err := <-tm.Errors(); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected unexpected EOF on error channel, got: ", err)
+	}
+	if _, ok := <-tm.Errors(); ok {
+		t.Fatal("expected error channel to be closed")
+	}
+}
+
+// failWriter accepts writes until failing is set
+type failWriter struct {
+	failing atomic.Bool
+}
+
+func (fw *failWriter) Write(b []byte) (int, error) {
+	if fw.failing.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+func TestEncodeErrorClosesFields(t *testing.T) {
+	tm := generateTestMessage()
+	fw := new(failWriter)
+	err := StreamEncode(fw, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.failing.Store(true)
+
+	ctx := context.Background()
+	err = tm.Repstring.Send(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-tm.Closed()
+	if tm.Err() != io.ErrClosedPipe {
+		t.Fatal("expected write error, got: ", tm.Err())
+	}
+
+	// the failed write closes the fields, so producers are not left blocked
+	err = tm.Repint.Send(ctx, 1)
+	if err != ErrFieldClosed {
+		t.Fatal("expected ErrFieldClosed, got: ", err)
+	}
+}
+
+// eofReader signals when it has been read to its end
+type eofReader struct {
+	r    io.Reader
+	done chan struct{}
+}
+
+func (er *eofReader) Read(b []byte) (int, error) {
+	n, err := er.r.Read(b)
+	if err == io.EOF {
+		close(er.done)
+	}
+	return n, err
+}
+
+func TestErrorAfterClose(t *testing.T) {
+	tm := NewTestMessage()
+	tm.Close()
+	<-tm.Closed()
+
+	// the truncated string fails the decoder after the stream has closed
+	er := &eofReader{r: bytes.NewReader([]byte{0x4a, 10, 'c', 'a'}), done: make(chan struct{})}
+	err := StreamDecode(er, tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-er.done
+	time.Sleep(time.Millisecond * 50)
+
+	if err := tm.Err(); err != nil {
+		t.Fatal("expected no error on a closed stream, got: ", err)
+	}
+}
@@ -0,0 +1,160 @@
+package pbs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Encoding is how the values of a field are written on the wire
+type Encoding int
+
+const (
+	EncodeVarint Encoding = iota
+	EncodeZigzag
+	EncodeFixed32
+	EncodeFixed64
+	EncodeBytes
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodeVarint:
+		return "varint"
+	case EncodeZigzag:
+		return "zigzag"
+	case EncodeFixed32:
+		return "fixed32"
+	case EncodeFixed64:
+		return "fixed64"
+	case EncodeBytes:
+		return "bytes"
+	default:
+		return "Encoding(" + strconv.Itoa(int(e)) + ")"
+	}
+}
+
+// wireType returns the wire type values of the encoding are written with
+func (e Encoding) wireType() byte {
+	switch e {
+	case EncodeFixed32:
+		return Bit32
+	case EncodeFixed64:
+		return Int64
+	case EncodeBytes:
+		return LengthDelim
+	default:
+		return Varint
+	}
+}
+
+// tagEncodings maps the types named by the struct tags of both dialects to
+// their encoding: the protobuf types written by proto-gen, and the wire
+// kinds written by protoc-gen-go. Any other type is a message or an enum.
+var tagEncodings = map[string]Encoding{
+	"varint": EncodeVarint,
+	"int32":  EncodeVarint,
+	"int64":  EncodeVarint,
+	"uint32": EncodeVarint,
+	"uint64": EncodeVarint,
+	"bool":   EncodeVarint,
+
+	"zigzag32": EncodeZigzag,
+	"zigzag64": EncodeZigzag,
+	"sint32":   EncodeZigzag,
+	"sint64":   EncodeZigzag,
+
+	"fixed32":  EncodeFixed32,
+	"sfixed32": EncodeFixed32,
+	"float":    EncodeFixed32,
+
+	"fixed64":  EncodeFixed64,
+	"sfixed64": EncodeFixed64,
+	"double":   EncodeFixed64,
+
+	"bytes":  EncodeBytes,
+	"string": EncodeBytes,
+}
+
+// fieldTag is a parsed protobuf struct tag
+type fieldTag struct {
+	typ      string
+	number   int
+	label    string
+	encoding Encoding
+
+	packed   bool
+	oneof    bool
+	proto3   bool
+	name     string
+	jsonName string
+	enum     string
+	def      string
+}
+
+// parseTag parses a protobuf struct tag, like "sint32,3,opt,name=x" or
+// "zigzag32,3,opt,name=x,json=x". The type is a protobuf type or a wire
+// kind; a type that is neither is a message, unless the tag names an enum.
+func parseTag(s string) (*fieldTag, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 3 {
+		return nil, errors.New("not enough values in protobuf field tag")
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > maxFieldNumber {
+		return nil, fmt.Errorf("pbs: field number %d is out of range, fields are numbered 1 to %d", n, maxFieldNumber)
+	}
+
+	tag := &fieldTag{typ: parts[0], number: n, label: parts[2]}
+	switch tag.label {
+	case "opt", "req", "rep":
+	default:
+		return nil, fmt.Errorf("pbs: unknown label %q in protobuf field tag", tag.label)
+	}
+
+options:
+	for i, opt := range parts[3:] {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "packed":
+			tag.packed = true
+		case "oneof":
+			tag.oneof = true
+		case "proto3":
+			tag.proto3 = true
+		case "name":
+			tag.name = val
+		case "json":
+			tag.jsonName = val
+		case "enum":
+			tag.enum = val
+		case "def":
+			// the default comes last, and may itself hold commas
+			tag.def = strings.Join(append([]string{val}, parts[3+i+1:]...), ",")
+			break options
+		}
+		// other options do not change how values are written
+	}
+
+	enc, ok := tagEncodings[tag.typ]
+	switch {
+	case ok:
+		tag.encoding = enc
+	case tag.typ == "group":
+		return nil, fmt.Errorf("pbs: field %d is a group, which is not supported", n)
+	case tag.enum != "":
+		tag.encoding = EncodeVarint
+	default:
+		tag.encoding = EncodeBytes
+	}
+
+	if tag.packed && (tag.label != "rep" || tag.encoding == EncodeBytes) {
+		return nil, fmt.Errorf("pbs: field %d of type %s cannot be packed", n, tag.typ)
+	}
+	return tag, nil
+}
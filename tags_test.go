@@ -0,0 +1,252 @@
+package pbs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/whyrusleeping/go-pbs"
+	tpb "github.com/whyrusleeping/go-pbs/testproto"
+)
+
+func TestTagDialects(t *testing.T) {
+	// proto-gen names protobuf types, protoc-gen-go wire kinds
+	gen, err := GetProperties(NewTestScalars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := GetProperties(new(tpb.TestScalars))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n, fi := range gen.FieldMapping {
+		if plain.FieldMapping[n].Encoding != fi.Encoding {
+			t.Fatalf("field %d is %s as %s, but %s as %s", n, fi.Encoding, fi.Type,
+				plain.FieldMapping[n].Encoding, plain.FieldMapping[n].Type)
+		}
+	}
+	if gen.FieldMapping[5].Encoding != EncodeZigzag || gen.FieldMapping[12].Encoding != EncodeFixed32 {
+		t.Fatal("got wrong encodings: ", gen.FieldMapping[5].Encoding, gen.FieldMapping[12].Encoding)
+	}
+
+	props, err := GetProperties(new(tpb.TestEnvelope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi := props.FieldMapping[9]; fi.Encoding != EncodeVarint || fi.Enum != "pbs_test.TestEnvelope_Priority" {
+		t.Fatal("got wrong enum field: ", fi)
+	}
+	if fi := props.FieldMapping[4]; fi.KeyEncoding != EncodeBytes || fi.ValueEncoding != EncodeVarint {
+		t.Fatal("got wrong map field: ", fi)
+	}
+}
+
+type optionsMessage struct {
+	Name *string `protobuf:"bytes,1,opt,name=full_name,json=fullName,def=a,b"`
+	*Stream
+}
+
+func (*optionsMessage) ProtoMessage() {}
+
+func (m *optionsMessage) String() string { return proto.CompactTextString(m) }
+
+func (m *optionsMessage) Reset() { *m = optionsMessage{Stream: NewStream()} }
+
+func TestTagOptions(t *testing.T) {
+	props, err := GetProperties(new(optionsMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi := props.FieldMapping[1]
+	if fi.Name != "full_name" || fi.JSONName != "fullName" || fi.Default != "a,b" {
+		t.Fatalf("got wrong options: %q %q %q", fi.Name, fi.JSONName, fi.Default)
+	}
+}
+
+type packedMessage struct {
+	Vals *Field[int32] `protobuf:"zigzag32,1,rep,packed,name=vals"`
+	*Stream
+}
+
+func newPackedMessage() *packedMessage {
+	return &packedMessage{Vals: NewField[int32](), Stream: NewStream()}
+}
+
+func (m *packedMessage) Close() error {
+	err := m.Stream.Close()
+	m.Vals.Close()
+	return err
+}
+
+func (*packedMessage) ProtoMessage() {}
+
+func (m *packedMessage) String() string { return proto.CompactTextString(m) }
+
+func (m *packedMessage) Reset() { *m = *newPackedMessage() }
+
+type plainPackedMessage struct {
+	Vals []int32 `protobuf:"zigzag32,1,rep,packed,name=vals"`
+}
+
+func (*plainPackedMessage) ProtoMessage() {}
+
+func (m *plainPackedMessage) String() string { return proto.CompactTextString(m) }
+
+func (m *plainPackedMessage) Reset() { *m = plainPackedMessage{} }
+
+func TestPackedField(t *testing.T) {
+	buf := new(bytes.Buffer)
+	m := newPackedMessage()
+	err := StreamEncode(buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []int32{-1, 300} {
+		if err := m.Vals.Send(context.Background(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	<-m.Closed()
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	outm := new(plainPackedMessage)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outm.Vals) != 2 || outm.Vals[0] != -1 || outm.Vals[1] != 300 {
+		t.Fatal("plain decoder got wrong values: ", outm.Vals)
+	}
+
+	// a record of a packed field may hold any number of values
+	data, err := proto.Marshal(&plainPackedMessage{Vals: []int32{1, -2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := newPackedMessage()
+	err = StreamDecode(bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vals []int32
+	for v := range out.Vals.C() {
+		vals = append(vals, v)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 3 || vals[0] != 1 || vals[1] != -2 || vals[2] != 3 {
+		t.Fatal("got wrong values: ", vals)
+	}
+}
+
+func TestPackedTagInvalid(t *testing.T) {
+	type badMessage struct {
+		Name []string `protobuf:"bytes,1,rep,packed,name=name"`
+		optionsMessage
+	}
+
+	_, err := GetProperties(new(badMessage))
+	if err == nil {
+		t.Fatal("expected a packed string field to be rejected")
+	}
+}
+
+type highFieldMessage struct {
+	Name *string       `protobuf:"bytes,200,opt,name=name"`
+	Vals *Field[int32] `protobuf:"varint,16,rep,name=vals"`
+	*Stream
+}
+
+func newHighFieldMessage() *highFieldMessage {
+	return &highFieldMessage{Vals: NewField[int32](), Stream: NewStream()}
+}
+
+func (m *highFieldMessage) Close() error {
+	err := m.Stream.Close()
+	m.Vals.Close()
+	return err
+}
+
+func (*highFieldMessage) ProtoMessage() {}
+
+func (m *highFieldMessage) String() string { return proto.CompactTextString(m) }
+
+func (m *highFieldMessage) Reset() { *m = *newHighFieldMessage() }
+
+type plainHighFieldMessage struct {
+	Name *string `protobuf:"bytes,200,opt,name=name"`
+	Vals []int32 `protobuf:"varint,16,rep,name=vals"`
+}
+
+func (*plainHighFieldMessage) ProtoMessage() {}
+
+func (m *plainHighFieldMessage) String() string { return proto.CompactTextString(m) }
+
+func (m *plainHighFieldMessage) Reset() { *m = plainHighFieldMessage{} }
+
+func TestHighFieldNumbers(t *testing.T) {
+	// fields numbered 16 and up have tags longer than a byte
+	buf := new(bytes.Buffer)
+	m := newHighFieldMessage()
+	m.Name = proto.String("cat")
+	err := StreamEncode(buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Vals.Send(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	<-m.Closed()
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	outm := new(plainHighFieldMessage)
+	err = proto.Unmarshal(buf.Bytes(), outm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outm.Name == nil || *outm.Name != "cat" || len(outm.Vals) != 1 || outm.Vals[0] != 7 {
+		t.Fatal("plain decoder got wrong values: ", outm)
+	}
+
+	out := newHighFieldMessage()
+	err = StreamDecode(bytes.NewReader(buf.Bytes()), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals []int32
+	for v := range out.Vals.C() {
+		vals = append(vals, v)
+	}
+	<-out.Closed()
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name == nil || *out.Name != "cat" || len(vals) != 1 || vals[0] != 7 {
+		t.Fatal("got wrong values: ", out.Name, vals)
+	}
+}
+
+func TestFieldNumberOutOfRange(t *testing.T) {
+	type bigMessage struct {
+		Name *string `protobuf:"bytes,256,opt,name=name"`
+		optionsMessage
+	}
+
+	_, err := GetProperties(new(bigMessage))
+	if err == nil {
+		t.Fatal("expected field number 256 to be rejected")
+	}
+}
@@ -10,6 +10,9 @@ It is generated from these files:
 
 It has these top-level messages:
 	TestMessage
+	TestEnvelope
+	TestScalars
+	TestScalarFields
 */
 package pbs_test
 
@@ -20,6 +23,62 @@ import math "math"
 var _ = proto.Marshal
 var _ = math.Inf
 
+type Mood int32
+
+const (
+	Mood_CALM   Mood = 0
+	Mood_ANGRY  Mood = 1
+	Mood_SLEEPY Mood = 2
+)
+
+var Mood_name = map[int32]string{
+	0: "CALM",
+	1: "ANGRY",
+	2: "SLEEPY",
+}
+var Mood_value = map[string]int32{
+	"CALM":   0,
+	"ANGRY":  1,
+	"SLEEPY": 2,
+}
+
+func (x Mood) Enum() *Mood {
+	p := new(Mood)
+	*p = x
+	return p
+}
+func (x Mood) String() string {
+	return proto.EnumName(Mood_name, int32(x))
+}
+
+type TestEnvelope_Priority int32
+
+const (
+	TestEnvelope_LOW    TestEnvelope_Priority = 0
+	TestEnvelope_HIGH   TestEnvelope_Priority = 1
+	TestEnvelope_URGENT TestEnvelope_Priority = -1
+)
+
+var TestEnvelope_Priority_name = map[int32]string{
+	0:  "LOW",
+	1:  "HIGH",
+	-1: "URGENT",
+}
+var TestEnvelope_Priority_value = map[string]int32{
+	"LOW":    0,
+	"HIGH":   1,
+	"URGENT": -1,
+}
+
+func (x TestEnvelope_Priority) Enum() *TestEnvelope_Priority {
+	p := new(TestEnvelope_Priority)
+	*p = x
+	return p
+}
+func (x TestEnvelope_Priority) String() string {
+	return proto.EnumName(TestEnvelope_Priority_name, int32(x))
+}
+
 type TestMessage struct {
 	Tsubm            []*TestMessage_TestSubMessage `protobuf:"bytes,1,rep,name=tsubm" json:"tsubm,omitempty"`
 	Repint           []int32                       `protobuf:"varint,2,rep,name=repint" json:"repint,omitempty"`
@@ -124,5 +183,450 @@ func (m *TestMessage_TestSubMessage) GetY() []uint32 {
 	return nil
 }
 
+type TestEnvelope struct {
+	Name        *string                    `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Body        *TestMessage               `protobuf:"bytes,2,opt,name=body" json:"body,omitempty"`
+	Notes       []string                   `protobuf:"bytes,3,rep,name=notes" json:"notes,omitempty"`
+	Counts      map[string]int32           `protobuf:"bytes,4,rep,name=counts" json:"counts,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Attachments []*TestEnvelope_Attachment `protobuf:"bytes,5,rep,name=attachments" json:"attachments,omitempty"`
+	Priority    *TestEnvelope_Priority     `protobuf:"varint,9,opt,name=priority,enum=pbs_test.TestEnvelope_Priority" json:"priority,omitempty"`
+	Moods       []Mood                     `protobuf:"varint,10,rep,name=moods,enum=pbs_test.Mood" json:"moods,omitempty"`
+	// Types that are valid to be assigned to Event:
+	//	*TestEnvelope_Text
+	//	*TestEnvelope_Code
+	//	*TestEnvelope_File
+	Event            isTestEnvelope_Event `protobuf_oneof:"event"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (m *TestEnvelope) Reset()         { *m = TestEnvelope{} }
+func (m *TestEnvelope) String() string { return proto.CompactTextString(m) }
+func (*TestEnvelope) ProtoMessage()    {}
+
+func (m *TestEnvelope) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *TestEnvelope) GetBody() *TestMessage {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetNotes() []string {
+	if m != nil {
+		return m.Notes
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetCounts() map[string]int32 {
+	if m != nil {
+		return m.Counts
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetAttachments() []*TestEnvelope_Attachment {
+	if m != nil {
+		return m.Attachments
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetPriority() TestEnvelope_Priority {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return TestEnvelope_LOW
+}
+
+func (m *TestEnvelope) GetMoods() []Mood {
+	if m != nil {
+		return m.Moods
+	}
+	return nil
+}
+
+type isTestEnvelope_Event interface {
+	isTestEnvelope_Event()
+}
+
+type TestEnvelope_Text struct {
+	Text string `protobuf:"bytes,6,opt,name=text,oneof"`
+}
+type TestEnvelope_Code struct {
+	Code int32 `protobuf:"varint,7,opt,name=code,oneof"`
+}
+type TestEnvelope_File struct {
+	File *TestEnvelope_Attachment `protobuf:"bytes,8,opt,name=file,oneof"`
+}
+
+func (*TestEnvelope_Text) isTestEnvelope_Event() {}
+func (*TestEnvelope_Code) isTestEnvelope_Event() {}
+func (*TestEnvelope_File) isTestEnvelope_Event() {}
+
+func (m *TestEnvelope) GetEvent() isTestEnvelope_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (m *TestEnvelope) GetText() string {
+	if x, ok := m.GetEvent().(*TestEnvelope_Text); ok {
+		return x.Text
+	}
+	return ""
+}
+
+func (m *TestEnvelope) GetCode() int32 {
+	if x, ok := m.GetEvent().(*TestEnvelope_Code); ok {
+		return x.Code
+	}
+	return 0
+}
+
+func (m *TestEnvelope) GetFile() *TestEnvelope_Attachment {
+	if x, ok := m.GetEvent().(*TestEnvelope_File); ok {
+		return x.File
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*TestEnvelope) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*TestEnvelope_Text)(nil),
+		(*TestEnvelope_Code)(nil),
+		(*TestEnvelope_File)(nil),
+	}
+}
+
+type TestEnvelope_Attachment struct {
+	Headers map[string]string `protobuf:"bytes,1,rep,name=headers" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Types that are valid to be assigned to Body:
+	//	*TestEnvelope_Attachment_Content
+	//	*TestEnvelope_Attachment_Data
+	Body             isTestEnvelope_Attachment_Body `protobuf_oneof:"body"`
+	XXX_unrecognized []byte                         `json:"-"`
+}
+
+func (m *TestEnvelope_Attachment) Reset()         { *m = TestEnvelope_Attachment{} }
+func (m *TestEnvelope_Attachment) String() string { return proto.CompactTextString(m) }
+func (*TestEnvelope_Attachment) ProtoMessage()    {}
+
+func (m *TestEnvelope_Attachment) GetHeaders() map[string]string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+type isTestEnvelope_Attachment_Body interface {
+	isTestEnvelope_Attachment_Body()
+}
+
+type TestEnvelope_Attachment_Content struct {
+	Content string `protobuf:"bytes,2,opt,name=content,oneof"`
+}
+type TestEnvelope_Attachment_Data struct {
+	Data []byte `protobuf:"bytes,3,opt,name=data,oneof"`
+}
+
+func (*TestEnvelope_Attachment_Content) isTestEnvelope_Attachment_Body() {}
+func (*TestEnvelope_Attachment_Data) isTestEnvelope_Attachment_Body()    {}
+
+func (m *TestEnvelope_Attachment) GetBody() isTestEnvelope_Attachment_Body {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *TestEnvelope_Attachment) GetContent() string {
+	if x, ok := m.GetBody().(*TestEnvelope_Attachment_Content); ok {
+		return x.Content
+	}
+	return ""
+}
+
+func (m *TestEnvelope_Attachment) GetData() []byte {
+	if x, ok := m.GetBody().(*TestEnvelope_Attachment_Data); ok {
+		return x.Data
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*TestEnvelope_Attachment) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*TestEnvelope_Attachment_Content)(nil),
+		(*TestEnvelope_Attachment_Data)(nil),
+	}
+}
+
+type TestScalars struct {
+	I32              *int32   `protobuf:"varint,1,opt,name=i32" json:"i32,omitempty"`
+	I64              *int64   `protobuf:"varint,2,opt,name=i64" json:"i64,omitempty"`
+	U32              *uint32  `protobuf:"varint,3,opt,name=u32" json:"u32,omitempty"`
+	U64              *uint64  `protobuf:"varint,4,opt,name=u64" json:"u64,omitempty"`
+	Si32             *int32   `protobuf:"zigzag32,5,opt,name=si32" json:"si32,omitempty"`
+	Si64             *int64   `protobuf:"zigzag64,6,opt,name=si64" json:"si64,omitempty"`
+	Fx32             *uint32  `protobuf:"fixed32,7,opt,name=fx32" json:"fx32,omitempty"`
+	Fx64             *uint64  `protobuf:"fixed64,8,opt,name=fx64" json:"fx64,omitempty"`
+	Sfx32            *int32   `protobuf:"fixed32,9,opt,name=sfx32" json:"sfx32,omitempty"`
+	Sfx64            *int64   `protobuf:"fixed64,10,opt,name=sfx64" json:"sfx64,omitempty"`
+	B                *bool    `protobuf:"varint,11,opt,name=b" json:"b,omitempty"`
+	F                *float32 `protobuf:"fixed32,12,opt,name=f" json:"f,omitempty"`
+	D                *float64 `protobuf:"fixed64,13,opt,name=d" json:"d,omitempty"`
+	S                *string  `protobuf:"bytes,14,opt,name=s" json:"s,omitempty"`
+	Bs               []byte   `protobuf:"bytes,15,opt,name=bs" json:"bs,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *TestScalars) Reset()         { *m = TestScalars{} }
+func (m *TestScalars) String() string { return proto.CompactTextString(m) }
+func (*TestScalars) ProtoMessage()    {}
+
+func (m *TestScalars) GetI32() int32 {
+	if m != nil && m.I32 != nil {
+		return *m.I32
+	}
+	return 0
+}
+
+func (m *TestScalars) GetI64() int64 {
+	if m != nil && m.I64 != nil {
+		return *m.I64
+	}
+	return 0
+}
+
+func (m *TestScalars) GetU32() uint32 {
+	if m != nil && m.U32 != nil {
+		return *m.U32
+	}
+	return 0
+}
+
+func (m *TestScalars) GetU64() uint64 {
+	if m != nil && m.U64 != nil {
+		return *m.U64
+	}
+	return 0
+}
+
+func (m *TestScalars) GetSi32() int32 {
+	if m != nil && m.Si32 != nil {
+		return *m.Si32
+	}
+	return 0
+}
+
+func (m *TestScalars) GetSi64() int64 {
+	if m != nil && m.Si64 != nil {
+		return *m.Si64
+	}
+	return 0
+}
+
+func (m *TestScalars) GetFx32() uint32 {
+	if m != nil && m.Fx32 != nil {
+		return *m.Fx32
+	}
+	return 0
+}
+
+func (m *TestScalars) GetFx64() uint64 {
+	if m != nil && m.Fx64 != nil {
+		return *m.Fx64
+	}
+	return 0
+}
+
+func (m *TestScalars) GetSfx32() int32 {
+	if m != nil && m.Sfx32 != nil {
+		return *m.Sfx32
+	}
+	return 0
+}
+
+func (m *TestScalars) GetSfx64() int64 {
+	if m != nil && m.Sfx64 != nil {
+		return *m.Sfx64
+	}
+	return 0
+}
+
+func (m *TestScalars) GetB() bool {
+	if m != nil && m.B != nil {
+		return *m.B
+	}
+	return false
+}
+
+func (m *TestScalars) GetF() float32 {
+	if m != nil && m.F != nil {
+		return *m.F
+	}
+	return 0
+}
+
+func (m *TestScalars) GetD() float64 {
+	if m != nil && m.D != nil {
+		return *m.D
+	}
+	return 0
+}
+
+func (m *TestScalars) GetS() string {
+	if m != nil && m.S != nil {
+		return *m.S
+	}
+	return ""
+}
+
+func (m *TestScalars) GetBs() []byte {
+	if m != nil {
+		return m.Bs
+	}
+	return nil
+}
+
+type TestScalarFields struct {
+	I32              []int32   `protobuf:"varint,1,rep,name=i32" json:"i32,omitempty"`
+	I64              []int64   `protobuf:"varint,2,rep,name=i64" json:"i64,omitempty"`
+	U32              []uint32  `protobuf:"varint,3,rep,name=u32" json:"u32,omitempty"`
+	U64              []uint64  `protobuf:"varint,4,rep,name=u64" json:"u64,omitempty"`
+	Si32             []int32   `protobuf:"zigzag32,5,rep,name=si32" json:"si32,omitempty"`
+	Si64             []int64   `protobuf:"zigzag64,6,rep,name=si64" json:"si64,omitempty"`
+	Fx32             []uint32  `protobuf:"fixed32,7,rep,name=fx32" json:"fx32,omitempty"`
+	Fx64             []uint64  `protobuf:"fixed64,8,rep,name=fx64" json:"fx64,omitempty"`
+	Sfx32            []int32   `protobuf:"fixed32,9,rep,name=sfx32" json:"sfx32,omitempty"`
+	Sfx64            []int64   `protobuf:"fixed64,10,rep,name=sfx64" json:"sfx64,omitempty"`
+	B                []bool    `protobuf:"varint,11,rep,name=b" json:"b,omitempty"`
+	F                []float32 `protobuf:"fixed32,12,rep,name=f" json:"f,omitempty"`
+	D                []float64 `protobuf:"fixed64,13,rep,name=d" json:"d,omitempty"`
+	S                []string  `protobuf:"bytes,14,rep,name=s" json:"s,omitempty"`
+	Bs               [][]byte  `protobuf:"bytes,15,rep,name=bs" json:"bs,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *TestScalarFields) Reset()         { *m = TestScalarFields{} }
+func (m *TestScalarFields) String() string { return proto.CompactTextString(m) }
+func (*TestScalarFields) ProtoMessage()    {}
+
+func (m *TestScalarFields) GetI32() []int32 {
+	if m != nil {
+		return m.I32
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetI64() []int64 {
+	if m != nil {
+		return m.I64
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetU32() []uint32 {
+	if m != nil {
+		return m.U32
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetU64() []uint64 {
+	if m != nil {
+		return m.U64
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetSi32() []int32 {
+	if m != nil {
+		return m.Si32
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetSi64() []int64 {
+	if m != nil {
+		return m.Si64
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetFx32() []uint32 {
+	if m != nil {
+		return m.Fx32
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetFx64() []uint64 {
+	if m != nil {
+		return m.Fx64
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetSfx32() []int32 {
+	if m != nil {
+		return m.Sfx32
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetSfx64() []int64 {
+	if m != nil {
+		return m.Sfx64
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetB() []bool {
+	if m != nil {
+		return m.B
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetF() []float32 {
+	if m != nil {
+		return m.F
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetD() []float64 {
+	if m != nil {
+		return m.D
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetS() []string {
+	if m != nil {
+		return m.S
+	}
+	return nil
+}
+
+func (m *TestScalarFields) GetBs() [][]byte {
+	if m != nil {
+		return m.Bs
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("pbs_test.Mood", Mood_name, Mood_value)
+	proto.RegisterEnum("pbs_test.TestEnvelope_Priority", TestEnvelope_Priority_name, TestEnvelope_Priority_value)
 }
@@ -0,0 +1,87 @@
+// Code generated by protoc-gen-go.
+// source: test3.proto
+// DO NOT EDIT!
+
+package pbs_test
+
+import proto "github.com/golang/protobuf/proto"
+
+type TestProto3_Level int32
+
+const (
+	TestProto3_NONE TestProto3_Level = 0
+	TestProto3_SOME TestProto3_Level = 1
+)
+
+var TestProto3_Level_name = map[int32]string{
+	0: "NONE",
+	1: "SOME",
+}
+var TestProto3_Level_value = map[string]int32{
+	"NONE": 0,
+	"SOME": 1,
+}
+
+func (x TestProto3_Level) String() string {
+	return proto.EnumName(TestProto3_Level_name, int32(x))
+}
+
+type TestProto3 struct {
+	Name             string           `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Count            int32            `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	Samples          []int64          `protobuf:"zigzag64,4,rep,packed,name=samples,proto3" json:"samples,omitempty"`
+	Tags             []string         `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty"`
+	Done             bool             `protobuf:"varint,6,opt,name=done,proto3" json:"done,omitempty"`
+	Level            TestProto3_Level `protobuf:"varint,7,opt,name=level,proto3,enum=pbs_test.TestProto3_Level" json:"level,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (m *TestProto3) Reset()         { *m = TestProto3{} }
+func (m *TestProto3) String() string { return proto.CompactTextString(m) }
+func (*TestProto3) ProtoMessage()    {}
+
+func (m *TestProto3) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *TestProto3) GetCount() int32 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+func (m *TestProto3) GetSamples() []int64 {
+	if m != nil {
+		return m.Samples
+	}
+	return nil
+}
+
+func (m *TestProto3) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *TestProto3) GetDone() bool {
+	if m != nil {
+		return m.Done
+	}
+	return false
+}
+
+func (m *TestProto3) GetLevel() TestProto3_Level {
+	if m != nil {
+		return m.Level
+	}
+	return TestProto3_NONE
+}
+
+func init() {
+	proto.RegisterEnum("pbs_test.TestProto3_Level", TestProto3_Level_name, TestProto3_Level_value)
+}